@@ -0,0 +1,69 @@
+package audit
+
+import (
+	"time"
+
+	"github.com/Kaese72/sdup-lib/sduptemplates"
+	"github.com/Kaese72/sdup-rest/cache"
+	"github.com/Kaese72/sdup-rest/cache/filters"
+)
+
+// Cache passes everything through to a cache and lets views of it record capability triggers, see AuditAs
+type Cache struct {
+	cache cache.SDUPCache
+	log   *Log
+}
+
+func NewCache(sdupCache cache.SDUPCache, log *Log) *Cache {
+	return &Cache{cache: sdupCache, log: log}
+}
+
+func (auditCache *Cache) Initialize() ([]sduptemplates.DeviceSpec, chan sduptemplates.DeviceUpdate, error) {
+	return auditCache.cache.Initialize()
+}
+
+func (auditCache *Cache) Device(deviceID sduptemplates.DeviceID) (sduptemplates.DeviceSpec, error) {
+	return auditCache.cache.Device(deviceID)
+}
+
+func (auditCache *Cache) Devices(attrFilters filters.AttributeFilters) ([]sduptemplates.DeviceSpec, error) {
+	return auditCache.cache.Devices(attrFilters)
+}
+
+func (auditCache *Cache) TriggerCapability(deviceID sduptemplates.DeviceID, capKey sduptemplates.CapabilityKey, capArg sduptemplates.CapabilityArgument) error {
+	return auditCache.cache.TriggerCapability(deviceID, capKey, capArg)
+}
+
+// AuditAs records triggers made through a view of the cache, such as an authorized cache, as made by the principal
+func (auditCache *Cache) AuditAs(view cache.SDUPCache, principal, method string) cache.SDUPCache {
+	return auditedView{SDUPCache: view, log: auditCache.log, principal: principal, method: method}
+}
+
+type auditedView struct {
+	cache.SDUPCache
+	log       *Log
+	principal string
+	method    string
+}
+
+func (view auditedView) TriggerCapability(deviceID sduptemplates.DeviceID, capKey sduptemplates.CapabilityKey, capArg sduptemplates.CapabilityArgument) error {
+	start := time.Now()
+	err := view.SDUPCache.TriggerCapability(deviceID, capKey, capArg)
+	event := Event{
+		Time:       start,
+		Type:       TypeCapability,
+		Principal:  view.principal,
+		Method:     view.method,
+		Device:     deviceID,
+		Capability: capKey,
+		Arguments:  capArg,
+		Result:     ResultSuccess,
+		LatencyMS:  float64(time.Since(start)) / float64(time.Millisecond),
+	}
+	if err != nil {
+		event.Result = ResultFailure
+		event.Error = err.Error()
+	}
+	view.log.Record(event)
+	return err
+}
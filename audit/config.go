@@ -0,0 +1,45 @@
+package audit
+
+import "errors"
+
+const (
+	defaultMaxSizeMB  = 10
+	defaultMaxBackups = 5
+)
+
+// Config for the audit log. Without a file nothing is recorded.
+type Config struct {
+	// File receives a JSON line per event. Rotated files are suffixed with .1, .2 and so on, .1 being the newest
+	File string `json:"file"`
+	// MaxSizeMB is how large the file grows before it is rotated. 0 means the default of 10
+	MaxSizeMB int `json:"max-size-mb"`
+	// MaxBackups is how many rotated files are kept. 0 means the default of 5, at least one is always kept
+	MaxBackups int `json:"max-backups"`
+}
+
+func (conf *Config) PopulateExample() {
+	conf.File = "/var/log/sdup-rest/audit.jsonl"
+	conf.MaxSizeMB = defaultMaxSizeMB
+	conf.MaxBackups = defaultMaxBackups
+}
+
+func (conf Config) Validate() error {
+	if conf.MaxSizeMB < 0 || conf.MaxBackups < 0 {
+		return errors.New("audit max-size-mb and max-backups may not be negative")
+	}
+	return nil
+}
+
+func (conf Config) maxSize() int64 {
+	if conf.MaxSizeMB == 0 {
+		return defaultMaxSizeMB * 1024 * 1024
+	}
+	return int64(conf.MaxSizeMB) * 1024 * 1024
+}
+
+func (conf Config) maxBackups() int {
+	if conf.MaxBackups == 0 {
+		return defaultMaxBackups
+	}
+	return conf.MaxBackups
+}
@@ -0,0 +1,253 @@
+// Package audit records who did what, for later review
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Kaese72/sdup-lib/logging"
+	"github.com/Kaese72/sdup-lib/sduptemplates"
+)
+
+// Event types
+const (
+	TypeCapability  = "capability"
+	TypeLogin       = "login"
+	TypeRefresh     = "refresh"
+	TypeLogout      = "logout"
+	TypeAuthFailure = "auth-failure"
+)
+
+// Event outcomes
+const (
+	ResultSuccess = "success"
+	ResultFailure = "failure"
+)
+
+// Event is a single line in the audit log
+type Event struct {
+	Time time.Time `json:"time"`
+	Type string    `json:"type"`
+	// Principal is who acted. It may be unknown for failed authentication
+	Principal  string                           `json:"principal,omitempty"`
+	Method     string                           `json:"method,omitempty"`
+	RemoteAddr string                           `json:"remote-addr,omitempty"`
+	Device     sduptemplates.DeviceID           `json:"device,omitempty"`
+	Capability sduptemplates.CapabilityKey      `json:"capability,omitempty"`
+	Arguments  sduptemplates.CapabilityArgument `json:"arguments,omitempty"`
+	Result     string                           `json:"result"`
+	Error      string                           `json:"error,omitempty"`
+	LatencyMS  float64                          `json:"latency-ms,omitempty"`
+}
+
+// Query selects events. Zero fields match everything
+type Query struct {
+	Since     time.Time
+	Until     time.Time
+	Principal string
+	Device    sduptemplates.DeviceID
+	Type      string
+	// Limit keeps only the most recent matching events
+	Limit int
+}
+
+func (query Query) matches(event Event) bool {
+	if !query.Since.IsZero() && event.Time.Before(query.Since) {
+		return false
+	}
+	if !query.Until.IsZero() && event.Time.After(query.Until) {
+		return false
+	}
+	if query.Principal != "" && event.Principal != query.Principal {
+		return false
+	}
+	if query.Device != "" && event.Device != query.Device {
+		return false
+	}
+	if query.Type != "" && event.Type != query.Type {
+		return false
+	}
+	return true
+}
+
+// Log appends events to a file, rotating it when it grows too large
+type Log struct {
+	config Config
+
+	lock sync.Mutex
+	file *os.File
+	size int64
+}
+
+// NewLog opens the audit log for appending
+func NewLog(config Config) (*Log, error) {
+	log := &Log{config: config}
+	if config.File == "" {
+		return log, nil
+	}
+	if err := log.open(); err != nil {
+		return nil, err
+	}
+	return log, nil
+}
+
+// open must be called with the lock held
+func (log *Log) open() error {
+	file, err := os.OpenFile(log.config.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	log.file = file
+	log.size = info.Size()
+	return nil
+}
+
+func (log *Log) backup(index int) string {
+	return fmt.Sprintf("%s.%d", log.config.File, index)
+}
+
+// rotate must be called with the lock held
+func (log *Log) rotate() error {
+	if err := log.file.Close(); err != nil {
+		return err
+	}
+	os.Remove(log.backup(log.config.maxBackups()))
+	for index := log.config.maxBackups() - 1; index > 0; index-- {
+		if err := os.Rename(log.backup(index), log.backup(index+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(log.config.File, log.backup(1)); err != nil {
+		return err
+	}
+	return log.open()
+}
+
+// Record appends an event. Failing to do so is logged, but does not fail whatever is being recorded
+func (log *Log) Record(event Event) {
+	if log.config.File == "" {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	line, err := json.Marshal(event)
+	if err != nil {
+		logging.Error("Failed to encode audit event", map[string]string{"error": err.Error()})
+		return
+	}
+	line = append(line, '\n')
+
+	log.lock.Lock()
+	defer log.lock.Unlock()
+	if log.file == nil {
+		// A previous rotation failed, try again
+		if err := log.open(); err != nil {
+			logging.Error("Failed to open audit log", map[string]string{"error": err.Error()})
+			return
+		}
+	}
+	if log.size > 0 && log.size+int64(len(line)) > log.config.maxSize() {
+		if err := log.rotate(); err != nil {
+			log.file = nil
+			logging.Error("Failed to rotate audit log", map[string]string{"error": err.Error()})
+			return
+		}
+	}
+	n, err := log.file.Write(line)
+	log.size += int64(n)
+	if err != nil {
+		logging.Error("Failed to write audit event", map[string]string{"error": err.Error()})
+	}
+}
+
+// snapshotFile is a file of the log as it was when a query started
+type snapshotFile struct {
+	file *os.File
+	size int64
+}
+
+// snapshot opens the rotated and current files, oldest first.
+// Open files can still be read after rotation renames or removes them, so only opening them needs the lock.
+func (log *Log) snapshot() ([]snapshotFile, error) {
+	log.lock.Lock()
+	defer log.lock.Unlock()
+	names := []string{}
+	for index := log.config.maxBackups(); index > 0; index-- {
+		names = append(names, log.backup(index))
+	}
+	names = append(names, log.config.File)
+
+	snapshots := []snapshotFile{}
+	for _, name := range names {
+		file, err := os.Open(name)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			closeSnapshots(snapshots)
+			return nil, err
+		}
+		info, err := file.Stat()
+		if err != nil {
+			file.Close()
+			closeSnapshots(snapshots)
+			return nil, err
+		}
+		// Events recorded after the snapshot are left out, rather than read half written
+		snapshots = append(snapshots, snapshotFile{file: file, size: info.Size()})
+	}
+	return snapshots, nil
+}
+
+func closeSnapshots(snapshots []snapshotFile) {
+	for _, snapshot := range snapshots {
+		snapshot.file.Close()
+	}
+}
+
+// Query reads the current and rotated files, oldest first.
+// Events are recorded while the files are read, only taking the lock to find the files.
+func (log *Log) Query(query Query) ([]Event, error) {
+	events := []Event{}
+	if log.config.File == "" {
+		return events, nil
+	}
+	snapshots, err := log.snapshot()
+	if err != nil {
+		return nil, err
+	}
+	defer closeSnapshots(snapshots)
+
+	for _, snapshot := range snapshots {
+		scanner := bufio.NewScanner(io.LimitReader(snapshot.file, snapshot.size))
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			var event Event
+			if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+				// A line cut short by a crash should not hide the rest of the log
+				continue
+			}
+			if !query.matches(event) {
+				continue
+			}
+			events = append(events, event)
+			if query.Limit > 0 && len(events) > query.Limit {
+				events = events[1:]
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return events, nil
+}
@@ -0,0 +1,68 @@
+package audit
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestQueryWhileRecordingAndRotating(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	log, err := NewLog(Config{File: filepath.Join(dir, "audit.jsonl"), MaxSizeMB: 1, MaxBackups: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Events are large enough for the log to rotate a few times
+	const eventCount = 8000
+	padding := strings.Repeat("x", 400)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < eventCount; i++ {
+			log.Record(Event{Type: TypeCapability, Principal: strconv.Itoa(i), Result: ResultSuccess, Error: padding})
+		}
+	}()
+
+	// checkOrder fails unless events are consecutive, with none missed or read twice
+	checkOrder := func(events []Event) {
+		for i := 1; i < len(events); i++ {
+			previous, _ := strconv.Atoi(events[i-1].Principal)
+			current, _ := strconv.Atoi(events[i].Principal)
+			if current != previous+1 {
+				t.Fatalf("event %d follows event %d", current, previous)
+			}
+		}
+	}
+	for querying := true; querying; {
+		select {
+		case <-done:
+			querying = false
+		default:
+		}
+		events, err := log.Query(Query{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkOrder(events)
+	}
+
+	events, err := log.Query(Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != eventCount {
+		t.Errorf("expected %d events, got %d", eventCount, len(events))
+	}
+	checkOrder(events)
+	if _, err := os.Stat(log.backup(1)); err != nil {
+		t.Errorf("expected the log to have rotated: %s", err.Error())
+	}
+}
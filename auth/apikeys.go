@@ -0,0 +1,214 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Kaese72/sdup-lib/logging"
+)
+
+// APIKeyHeader is the request header API keys are presented in
+const APIKeyHeader = "X-API-Key"
+
+// lastUsedSaveInterval limits how often merely using a key writes the store
+const lastUsedSaveInterval = time.Minute
+
+var (
+	ErrInvalidAPIKey = errors.New("invalid API key")
+	ErrNoSuchAPIKey  = errors.New("no such API key")
+)
+
+// ErrInvalidAPIKeySpec is a name or set of roles an API key can not be created with
+type ErrInvalidAPIKeySpec struct {
+	Err error
+}
+
+func (err ErrInvalidAPIKeySpec) Error() string { return err.Err.Error() }
+func (err ErrInvalidAPIKeySpec) Unwrap() error { return err.Err }
+
+type APIKeysConfig struct {
+	// File persists the API keys. Without it keys are lost on restart
+	File string `json:"file"`
+}
+
+func (conf *APIKeysConfig) PopulateExample() {
+	conf.File = "/var/lib/sdup-rest/api-keys.json"
+}
+
+// APIKey is a long-lived credential for scripts and services.
+// What it may do is limited to its roles, regardless of who created it.
+type APIKey struct {
+	ID       string     `json:"id"`
+	Name     string     `json:"name"`
+	Roles    []string   `json:"roles"`
+	Created  time.Time  `json:"created"`
+	LastUsed *time.Time `json:"last-used,omitempty"`
+	// Hash is the SHA-256 of the secret part of the key, the key itself is only known when it is created
+	Hash string `json:"hash,omitempty"`
+}
+
+// Redacted returns the key without its hash, for showing to clients
+func (key APIKey) Redacted() APIKey {
+	key.Hash = ""
+	return key
+}
+
+// APIKeyStore keeps API keys, hashed, in a JSON file
+type APIKeyStore struct {
+	config APIKeysConfig
+
+	lock      sync.Mutex
+	keys      map[string]*APIKey
+	lastSaved time.Time
+}
+
+// NewAPIKeyStore loads the API keys file, which is created on the first change if it does not exist
+func NewAPIKeyStore(config APIKeysConfig) (*APIKeyStore, error) {
+	store := &APIKeyStore{
+		config: config,
+		keys:   map[string]*APIKey{},
+	}
+	if config.File == "" {
+		return store, nil
+	}
+	content, err := ioutil.ReadFile(config.File)
+	if os.IsNotExist(err) {
+		return store, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var stored []APIKey
+	if err := json.Unmarshal(content, &stored); err != nil {
+		return nil, fmt.Errorf("could not parse API key store: %s", err.Error())
+	}
+	for i := range stored {
+		store.keys[stored[i].ID] = &stored[i]
+	}
+	return store, nil
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// list must be called with the lock held
+func (store *APIKeyStore) list() []APIKey {
+	keys := []APIKey{}
+	for _, key := range store.keys {
+		keys = append(keys, *key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Created.Before(keys[j].Created) })
+	return keys
+}
+
+// save must be called with the lock held
+func (store *APIKeyStore) save() error {
+	store.lastSaved = time.Now()
+	if store.config.File == "" {
+		return nil
+	}
+	content, err := json.MarshalIndent(store.list(), "", "   ")
+	if err != nil {
+		return err
+	}
+	tmpFile := store.config.File + ".tmp"
+	if err := ioutil.WriteFile(tmpFile, content, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, store.config.File)
+}
+
+// List returns all keys, redacted
+func (store *APIKeyStore) List() []APIKey {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	keys := store.list()
+	for i := range keys {
+		keys[i] = keys[i].Redacted()
+	}
+	return keys
+}
+
+// Create adds a key. The returned secret is the only time the full key is available
+func (store *APIKeyStore) Create(name string, roles []string) (APIKey, string, error) {
+	if name == "" {
+		return APIKey{}, "", ErrInvalidAPIKeySpec{Err: errors.New("API keys must have a name")}
+	}
+	id, err := randomString(9)
+	if err != nil {
+		return APIKey{}, "", err
+	}
+	secret, err := randomString(32)
+	if err != nil {
+		return APIKey{}, "", err
+	}
+	key := &APIKey{
+		ID:      id,
+		Name:    name,
+		Roles:   roles,
+		Created: time.Now(),
+		Hash:    hashSecret(secret),
+	}
+
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	store.keys[id] = key
+	if err := store.save(); err != nil {
+		delete(store.keys, id)
+		return APIKey{}, "", err
+	}
+	// The ID is part of the key so that it can be looked up without comparing against every hash
+	return key.Redacted(), id + "." + secret, nil
+}
+
+// Revoke deletes a key, it stops working immediately
+func (store *APIKeyStore) Revoke(id string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	key, ok := store.keys[id]
+	if !ok {
+		return ErrNoSuchAPIKey
+	}
+	delete(store.keys, id)
+	if err := store.save(); err != nil {
+		store.keys[id] = key
+		return err
+	}
+	return nil
+}
+
+// Authenticate returns the key a presented API key belongs to and records that it was used
+func (store *APIKeyStore) Authenticate(presented string) (APIKey, error) {
+	parts := strings.SplitN(presented, ".", 2)
+	if len(parts) != 2 {
+		return APIKey{}, ErrInvalidAPIKey
+	}
+	hash := hashSecret(parts[1])
+
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	key, ok := store.keys[parts[0]]
+	if !ok || subtle.ConstantTimeCompare([]byte(key.Hash), []byte(hash)) != 1 {
+		return APIKey{}, ErrInvalidAPIKey
+	}
+	now := time.Now()
+	key.LastUsed = &now
+	// Last-used times are only approximate on disk, a busy key should not write the store on every request
+	if now.Sub(store.lastSaved) >= lastUsedSaveInterval {
+		if err := store.save(); err != nil {
+			logging.Error("Failed to save API keys", map[string]string{"error": err.Error()})
+		}
+	}
+	return key.Redacted(), nil
+}
@@ -0,0 +1,328 @@
+package auth
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+// Sample code from https://betterprogramming.pub/hands-on-with-jwt-in-golang-8c986d1bb4c0
+
+type LoginBody struct {
+	User     string `json:"user"`
+	Password string `json:"password"`
+}
+
+// JwtWrapper wraps the signing key and the issuer
+type JWTWrapper struct {
+	// keys holds every key tokens are accepted from, by key ID
+	keys                   map[string]loadedKey
+	signingKeyID           string
+	issuer                 string
+	jwtExpirationMinutes   int64
+	refreshExpirationHours int64
+	users                  UserStore
+	rbac                   RBACConfig
+	certificates           []CertificateMapping
+	refreshTokens          *RefreshTokenStore
+	apiKeys                *APIKeyStore
+	// oidc is nil unless logins are delegated to an identity provider
+	oidc *OIDCProvider
+}
+
+// NewJWTWrapper loads the configured keys and discovers the identity provider, if any.
+// It fails rather than fall back to a guessable secret
+func NewJWTWrapper(config Config, users UserStore, apiKeys *APIKeyStore) (JWTWrapper, error) {
+	wrap := JWTWrapper{
+		users:                  users,
+		apiKeys:                apiKeys,
+		rbac:                   config.RBAC,
+		certificates:           config.Certificates,
+		refreshTokens:          NewRefreshTokenStore(time.Hour*time.Duration(config.RefreshTokenHours), time.Hour*time.Duration(config.sessionHours())),
+		keys:                   map[string]loadedKey{},
+		signingKeyID:           config.SigningKey.ID,
+		issuer:                 config.Issuer,
+		jwtExpirationMinutes:   config.AccessTokenMinutes,
+		refreshExpirationHours: config.RefreshTokenHours,
+	}
+	for _, keyConfig := range append([]KeyConfig{config.SigningKey}, config.VerificationKeys...) {
+		key, err := keyConfig.load()
+		if err != nil {
+			return JWTWrapper{}, err
+		}
+		wrap.keys[keyConfig.ID] = key
+	}
+	if wrap.keys[wrap.signingKeyID].signing == nil {
+		return JWTWrapper{}, fmt.Errorf("auth signing key '%s' must be a private key", wrap.signingKeyID)
+	}
+	if config.OIDC.Enabled() {
+		provider, err := NewOIDCProvider(context.Background(), config.OIDC)
+		if err != nil {
+			return JWTWrapper{}, err
+		}
+		wrap.oidc = provider
+	}
+	return wrap, nil
+}
+
+// sign signs claims with the current signing key
+func (wrap *JWTWrapper) sign(claims jwt.Claims) (string, error) {
+	key := wrap.keys[wrap.signingKeyID]
+	token := jwt.NewWithClaims(key.method, claims)
+	token.Header["kid"] = wrap.signingKeyID
+	return token.SignedString(key.signing)
+}
+
+// verificationKey finds the key a token claims to be signed with.
+// The algorithm is taken from the key, never from the token, so that a public key can not be used as an HMAC secret.
+func (wrap *JWTWrapper) verificationKey(token *jwt.Token) (interface{}, error) {
+	kid, ok := token.Header["kid"].(string)
+	if !ok {
+		// Tokens from before key IDs were introduced
+		kid = wrap.signingKeyID
+	}
+	key, ok := wrap.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown key id '%s'", kid)
+	}
+	if token.Method.Alg() != key.method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method %s", token.Header["alg"])
+	}
+	return key.verification, nil
+}
+
+// JwtClaim adds name and roles as claims to the token
+type JwtClaim struct {
+	Name  string
+	Roles []string `json:"roles,omitempty"`
+	jwt.StandardClaims
+}
+
+type JWTUser struct {
+	Name  string
+	Roles []string
+}
+
+// Principal resolves the roles of a token holder into what it may do
+func (wrap *JWTWrapper) Principal(user JWTUser) Principal {
+	return wrap.rbac.newPrincipal(user.Name, MethodToken, user.Roles)
+}
+
+// CertificatePrincipal maps a verified client certificate to a user.
+// Certificates not matching any configured mapping are refused.
+func (wrap *JWTWrapper) CertificatePrincipal(certificate *x509.Certificate) (Principal, error) {
+	name, err := certificateUser(wrap.certificates, certificate)
+	if err != nil {
+		return Principal{}, err
+	}
+	return wrap.rbac.newPrincipal(name, MethodCertificate, wrap.rbac.UserRoles[name]), nil
+}
+
+// APIKeyPrincipal authenticates a presented API key. The principal is named after the key and has the roles of the key
+func (wrap *JWTWrapper) APIKeyPrincipal(presented string) (Principal, error) {
+	key, err := wrap.apiKeys.Authenticate(presented)
+	if err != nil {
+		return Principal{}, err
+	}
+	return wrap.rbac.newPrincipal(key.Name, MethodAPIKey, key.Roles), nil
+}
+
+// BearerPrincipal accepts tokens issued by sdup-rest and, if configured, by the identity provider
+func (wrap *JWTWrapper) BearerPrincipal(ctx context.Context, token string) (Principal, error) {
+	user, err := wrap.ValidateToken(token)
+	if err == nil {
+		return wrap.Principal(user), nil
+	}
+	if wrap.oidc == nil {
+		return Principal{}, err
+	}
+	name, roles, oidcErr := wrap.oidc.VerifyBearer(ctx, token)
+	if oidcErr != nil {
+		return Principal{}, oidcErr
+	}
+	return wrap.rbac.newPrincipal(name, MethodOIDC, wrap.federatedRoles(name, roles)), nil
+}
+
+// federatedRoles adds the roles configured for a user of the identity provider to those it was given there.
+// The name is namespaced, so the roles of a local user with the same name are never given out.
+func (wrap *JWTWrapper) federatedRoles(name string, roles []string) []string {
+	merged := append([]string{}, wrap.rbac.UserRoles[name]...)
+	for _, role := range roles {
+		if !containsString(merged, role) {
+			merged = append(merged, role)
+		}
+	}
+	return merged
+}
+
+// GenerateLoginToken generates a jwt token carrying the roles currently assigned to the user
+func (wrap *JWTWrapper) GenerateLoginToken(name string) (signedToken string, err error) {
+	return wrap.generateToken(name, wrap.rbac.UserRoles[name])
+}
+
+func (wrap *JWTWrapper) generateToken(name string, roles []string) (signedToken string, err error) {
+	claims := &JwtClaim{
+		Name:  name,
+		Roles: roles,
+		StandardClaims: jwt.StandardClaims{
+			ExpiresAt: time.Now().Local().Add(time.Minute * time.Duration(wrap.jwtExpirationMinutes)).Unix(),
+			Issuer:    wrap.issuer,
+		},
+	}
+
+	signedToken, err = wrap.sign(claims)
+	return
+}
+
+//ValidateToken validates the jwt token
+func (wrap *JWTWrapper) ValidateToken(signedToken string) (user JWTUser, err error) {
+	var claims *JwtClaim
+	token, err := jwt.ParseWithClaims(
+		signedToken,
+		&JwtClaim{},
+		wrap.verificationKey,
+	)
+
+	if err != nil {
+		return
+	}
+
+	claims, ok := token.Claims.(*JwtClaim)
+	if !ok {
+		err = errors.New("could not parse claims")
+		return
+	}
+
+	// Parsing only checks the expiry of tokens that have one, every token issued here expires
+	if !claims.VerifyExpiresAt(time.Now().Unix(), true) {
+		err = errors.New("token has no expiry or has expired")
+		return
+	}
+	// Tokens signed with the same key may have been issued by another service
+	if !claims.VerifyIssuer(wrap.issuer, true) {
+		err = errors.New("token was issued by someone else")
+		return
+	}
+
+	user.Name = claims.Name
+	user.Roles = claims.Roles
+
+	return
+
+}
+
+// Users returns the backend credentials are checked against
+func (wrap *JWTWrapper) Users() UserStore {
+	return wrap.users
+}
+
+// APIKeys returns where API keys are kept
+func (wrap *JWTWrapper) APIKeys() *APIKeyStore {
+	return wrap.apiKeys
+}
+
+// CreateAPIKey creates a key scoped to existing roles
+func (wrap *JWTWrapper) CreateAPIKey(name string, roles []string) (APIKey, string, error) {
+	if len(roles) == 0 {
+		return APIKey{}, "", ErrInvalidAPIKeySpec{Err: errors.New("API keys must have at least one role")}
+	}
+	for _, role := range roles {
+		if _, ok := wrap.rbac.Roles[role]; !ok {
+			return APIKey{}, "", ErrInvalidAPIKeySpec{Err: fmt.Errorf("unknown role '%s'", role)}
+		}
+	}
+	return wrap.apiKeys.Create(name, roles)
+}
+
+func (wrap *JWTWrapper) UserPassToToken(user, password string) (string, error) {
+	if err := wrap.users.Authenticate(user, password); err != nil {
+		return "", err
+	}
+
+	signedToken, err := wrap.GenerateLoginToken(user)
+	if err != nil {
+		return "", err
+	}
+
+	return signedToken, nil
+}
+
+// NewRefreshToken starts a new login session for a user that has authenticated
+func (wrap *JWTWrapper) NewRefreshToken(user string) (string, error) {
+	return wrap.refreshTokens.Issue(Session{User: user})
+}
+
+// OIDCEnabled tells whether logins can be delegated to an identity provider
+func (wrap *JWTWrapper) OIDCEnabled() bool {
+	return wrap.oidc != nil
+}
+
+// OIDCLoginURL is where to send a user to log in at the identity provider
+func (wrap *JWTWrapper) OIDCLoginURL() (url string, state string, err error) {
+	return wrap.oidc.LoginURL()
+}
+
+// OIDCLogin completes a login at the identity provider with the code it returned,
+// returning the user, an access token and a refresh token like a password login does
+func (wrap *JWTWrapper) OIDCLogin(ctx context.Context, state, code string) (user string, token string, refreshToken string, err error) {
+	user, roles, err := wrap.oidc.Exchange(ctx, state, code)
+	if err != nil {
+		return "", "", "", err
+	}
+	roles = wrap.federatedRoles(user, roles)
+	token, err = wrap.generateToken(user, roles)
+	if err != nil {
+		return "", "", "", err
+	}
+	refreshToken, err = wrap.refreshTokens.Issue(Session{User: user, Federated: true, Roles: roles, NotAfter: time.Now().Add(wrap.RefreshExpiration())})
+	return user, token, refreshToken, err
+}
+
+// Refresh consumes a refresh token, returning its user, a new access token and the refresh token replacing the consumed one.
+// Users that have been disabled or removed since they logged in can not refresh.
+func (wrap *JWTWrapper) Refresh(refreshToken string) (user string, token string, newRefreshToken string, err error) {
+	session, newRefreshToken, err := wrap.refreshTokens.Rotate(refreshToken)
+	if err != nil {
+		return "", "", "", err
+	}
+	user = session.User
+	if session.Federated {
+		token, err = wrap.generateToken(session.User, session.Roles)
+		return user, token, newRefreshToken, err
+	}
+	users, err := wrap.users.Users()
+	if err != nil {
+		return user, "", "", err
+	}
+	enabled := false
+	for _, candidate := range users {
+		if candidate.Name == user && !candidate.Disabled {
+			enabled = true
+		}
+	}
+	if !enabled {
+		wrap.refreshTokens.RevokeUser(user)
+		return user, "", "", ErrInvalidRefreshToken
+	}
+	token, err = wrap.GenerateLoginToken(user)
+	return user, token, newRefreshToken, err
+}
+
+// Logout revokes the login session a refresh token belongs to and returns its user
+func (wrap *JWTWrapper) Logout(refreshToken string) string {
+	return wrap.refreshTokens.Revoke(refreshToken)
+}
+
+// RevokeUserSessions ends every login session of a user
+func (wrap *JWTWrapper) RevokeUserSessions(user string) {
+	wrap.refreshTokens.RevokeUser(user)
+}
+
+// RefreshExpiration is how long a refresh token may be used
+func (wrap *JWTWrapper) RefreshExpiration() time.Duration {
+	return time.Hour * time.Duration(wrap.refreshExpirationHours)
+}
@@ -0,0 +1,52 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+func TestValidateToken(t *testing.T) {
+	wrap := newTestWrapper(t, Config{})
+	for _, test := range []struct {
+		name     string
+		claims   jwt.StandardClaims
+		accepted bool
+	}{
+		{"valid", jwt.StandardClaims{Issuer: "sdup-rest", ExpiresAt: time.Now().Add(time.Minute).Unix()}, true},
+		{"expired", jwt.StandardClaims{Issuer: "sdup-rest", ExpiresAt: time.Now().Add(-time.Minute).Unix()}, false},
+		{"wrong issuer", jwt.StandardClaims{Issuer: "another-service", ExpiresAt: time.Now().Add(time.Minute).Unix()}, false},
+		{"no issuer", jwt.StandardClaims{ExpiresAt: time.Now().Add(time.Minute).Unix()}, false},
+		{"no expiry", jwt.StandardClaims{Issuer: "sdup-rest"}, false},
+	} {
+		token, err := wrap.sign(&JwtClaim{Name: "kaese", StandardClaims: test.claims})
+		if err != nil {
+			t.Fatal(err)
+		}
+		user, err := wrap.ValidateToken(token)
+		if accepted := err == nil; accepted != test.accepted {
+			t.Errorf("%s: expected accepted=%v, got %v", test.name, test.accepted, err)
+		} else if accepted && user.Name != "kaese" {
+			t.Errorf("%s: expected kaese, got %+v", test.name, user)
+		}
+	}
+}
+
+func TestCreateAPIKeyRefusals(t *testing.T) {
+	wrap := newTestWrapper(t, Config{})
+	var invalid ErrInvalidAPIKeySpec
+	for _, test := range []struct {
+		name  string
+		roles []string
+	}{
+		{"script", nil},
+		{"script", []string{"unknown"}},
+		{"", []string{"viewer"}},
+	} {
+		if _, _, err := wrap.CreateAPIKey(test.name, test.roles); !errors.As(err, &invalid) {
+			t.Errorf("%q %v: expected the key to be refused, got %v", test.name, test.roles, err)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package auth
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+)
+
+// CertificateMapping maps client certificates to a user. A certificate matches if every field that is set matches.
+type CertificateMapping struct {
+	CommonName string `json:"common-name"`
+	// DNSName, Email and URI are matched against the subject alternative names
+	DNSName string `json:"dns-name"`
+	Email   string `json:"email"`
+	URI     string `json:"uri"`
+	// User is who the certificate authenticates as. Roles are assigned to it like to any other user
+	User string `json:"user"`
+}
+
+func (mapping CertificateMapping) Validate() error {
+	if mapping.User == "" {
+		return errors.New("certificate mappings must name a user")
+	}
+	if mapping.CommonName == "" && mapping.DNSName == "" && mapping.Email == "" && mapping.URI == "" {
+		return fmt.Errorf("certificate mapping for '%s' matches nothing", mapping.User)
+	}
+	return nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, candidate := range values {
+		if candidate == value {
+			return true
+		}
+	}
+	return false
+}
+
+func (mapping CertificateMapping) matches(certificate *x509.Certificate) bool {
+	if mapping.CommonName != "" && certificate.Subject.CommonName != mapping.CommonName {
+		return false
+	}
+	if mapping.DNSName != "" && !containsString(certificate.DNSNames, mapping.DNSName) {
+		return false
+	}
+	if mapping.Email != "" && !containsString(certificate.EmailAddresses, mapping.Email) {
+		return false
+	}
+	if mapping.URI != "" {
+		uris := []string{}
+		for _, uri := range certificate.URIs {
+			uris = append(uris, uri.String())
+		}
+		if !containsString(uris, mapping.URI) {
+			return false
+		}
+	}
+	return true
+}
+
+// ErrCertificateNotAllowed is returned for verified certificates that no mapping allows in
+var ErrCertificateNotAllowed = errors.New("client certificate is not allowed")
+
+// certificateUser finds the user of the first mapping matching the certificate
+func certificateUser(mappings []CertificateMapping, certificate *x509.Certificate) (string, error) {
+	for _, mapping := range mappings {
+		if mapping.matches(certificate) {
+			return mapping.User, nil
+		}
+	}
+	return "", ErrCertificateNotAllowed
+}
@@ -0,0 +1,156 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/Kaese72/sdup-lib/logging"
+	"github.com/Kaese72/sdup-rest/faults"
+)
+
+// Authentication methods that can be listed in Config.Methods
+const (
+	ChainCertificate = "certificate"
+	ChainAPIKey      = "api-key"
+	ChainBearer      = "bearer"
+	// ChainAnonymous lets requests without credentials in with the anonymous roles, without ever allowing changes
+	ChainAnonymous = "anonymous"
+)
+
+// defaultMethods is the order methods are tried in unless configured
+var defaultMethods = []string{ChainCertificate, ChainAPIKey, ChainBearer}
+
+var ErrNoCredentials = errors.New("No authentication method provided")
+
+// Authenticator is one way a caller can authenticate
+type Authenticator interface {
+	// Authenticate returns ok false if the caller presented no credentials for this method, so the next one is tried.
+	// An error means credentials were presented and refused.
+	Authenticate(credentials Credentials) (principal Principal, ok bool, err error)
+}
+
+// AuthenticatorFunc lets a function be used as an Authenticator
+type AuthenticatorFunc func(credentials Credentials) (Principal, bool, error)
+
+func (function AuthenticatorFunc) Authenticate(credentials Credentials) (Principal, bool, error) {
+	return function(credentials)
+}
+
+// Chain tries authenticators in order. The first one finding credentials decides.
+// The same chain authenticates callers of every server, see Credentials.
+type Chain []Authenticator
+
+func (chain Chain) Authenticate(credentials Credentials) (Principal, error) {
+	for _, authenticator := range chain {
+		principal, ok, err := authenticator.Authenticate(credentials)
+		if err != nil {
+			return Principal{}, err
+		}
+		if ok {
+			return principal, nil
+		}
+	}
+	return Principal{}, ErrNoCredentials
+}
+
+func validateMethods(methods []string) error {
+	seen := map[string]bool{}
+	for i, method := range methods {
+		switch method {
+		case ChainCertificate, ChainAPIKey, ChainBearer:
+		case ChainAnonymous:
+			if i != len(methods)-1 {
+				return errors.New("auth method anonymous must be the last one, methods after it are never tried")
+			}
+		default:
+			return fmt.Errorf("unknown auth method '%s'", method)
+		}
+		if seen[method] {
+			return fmt.Errorf("auth method '%s' is listed more than once", method)
+		}
+		seen[method] = true
+	}
+	return nil
+}
+
+// NewChain builds the configured authentication methods in their configured order
+func NewChain(config Config, wrap JWTWrapper) (Chain, error) {
+	methods := config.Methods
+	if len(methods) == 0 {
+		methods = defaultMethods
+	}
+	chain := Chain{}
+	for _, method := range methods {
+		switch method {
+		case ChainCertificate:
+			chain = append(chain, CertificateAuthenticator(wrap))
+		case ChainAPIKey:
+			chain = append(chain, APIKeyAuthenticator(wrap))
+		case ChainBearer:
+			chain = append(chain, BearerAuthenticator(wrap))
+		case ChainAnonymous:
+			chain = append(chain, AnonymousAuthenticator(wrap.rbac, config.AnonymousRoles))
+		default:
+			return nil, fmt.Errorf("unknown auth method '%s'", method)
+		}
+	}
+	return chain, nil
+}
+
+// CertificateAuthenticator accepts verified client certificates that are mapped to a user
+func CertificateAuthenticator(wrap JWTWrapper) Authenticator {
+	return AuthenticatorFunc(func(credentials Credentials) (Principal, bool, error) {
+		certificate := credentials.Certificate()
+		if certificate == nil {
+			return Principal{}, false, nil
+		}
+		principal, err := wrap.CertificatePrincipal(certificate)
+		if err != nil {
+			logging.Error("Refused client certificate", map[string]string{"subject": certificate.Subject.String(), "target": credentials.Target(), "error": err.Error()})
+			// The certificate was verified, so the client is known but not let in
+			return Principal{}, true, faults.ErrForbidden{Action: "authenticate with this client certificate"}
+		}
+		return principal, true, nil
+	})
+}
+
+// APIKeyAuthenticator accepts API keys in the APIKeyHeader header
+func APIKeyAuthenticator(wrap JWTWrapper) Authenticator {
+	return AuthenticatorFunc(func(credentials Credentials) (Principal, bool, error) {
+		apiKey := credentials.Header(APIKeyHeader)
+		if apiKey == "" {
+			return Principal{}, false, nil
+		}
+		principal, err := wrap.APIKeyPrincipal(apiKey)
+		return principal, true, err
+	})
+}
+
+// BearerAuthenticator accepts tokens in the Authorization header, issued by sdup-rest or the identity provider
+func BearerAuthenticator(wrap JWTWrapper) Authenticator {
+	return AuthenticatorFunc(func(credentials Credentials) (Principal, bool, error) {
+		authHeaderVal := credentials.Header("Authorization")
+		if authHeaderVal == "" {
+			return Principal{}, false, nil
+		}
+		parts := strings.SplitN(authHeaderVal, " ", 2)
+		if len(parts) != 2 || !strings.EqualFold(parts[0], "bearer") {
+			return Principal{}, true, errors.New("Authorization header is not a bearer token")
+		}
+		principal, err := wrap.BearerPrincipal(credentials.Context(), strings.TrimSpace(parts[1]))
+		return principal, true, err
+	})
+}
+
+// AnonymousAuthenticator lets every request in with the given roles, limited to reading
+func AnonymousAuthenticator(rbac RBACConfig, roles []string) Authenticator {
+	principal := rbac.newPrincipal(ChainAnonymous, MethodAnonymous, roles)
+	for i := range principal.roles {
+		principal.roles[i].Capabilities = nil
+		principal.roles[i].Admin = false
+	}
+	return AuthenticatorFunc(func(Credentials) (Principal, bool, error) {
+		return principal, true, nil
+	})
+}
@@ -0,0 +1,181 @@
+package auth
+
+import (
+	"context"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+const testSigningKeyEnv = "SDUP_REST_TEST_SIGNING_KEY"
+
+// newTestWrapper issues tokens with an HMAC key, knows one certificate and keeps API keys in memory
+func newTestWrapper(t *testing.T, config Config) JWTWrapper {
+	os.Setenv(testSigningKeyEnv, "a test secret that is long enough to sign with")
+	config.Issuer = "sdup-rest"
+	config.AccessTokenMinutes = 5
+	config.RefreshTokenHours = 1
+	config.SigningKey = KeyConfig{ID: "test", Env: testSigningKeyEnv}
+	config.RBAC = RBACConfig{
+		Roles: map[string]RoleConfig{
+			"admin":  {Devices: []string{matchAll}, Capabilities: []string{matchAll}, Admin: true},
+			"viewer": {Devices: []string{matchAll}},
+		},
+		UserRoles: map[string][]string{"kaese": {"admin"}, "dashboard": {"viewer"}},
+	}
+	config.Certificates = []CertificateMapping{{CommonName: "dashboard.example.com", User: "dashboard"}}
+	apiKeys, err := NewAPIKeyStore(APIKeysConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrap, err := NewJWTWrapper(config, nil, apiKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return wrap
+}
+
+// testCredentials are presented without any server in between
+type testCredentials struct {
+	headers     map[string]string
+	certificate *x509.Certificate
+}
+
+func (credentials testCredentials) Context() context.Context       { return context.Background() }
+func (credentials testCredentials) Header(name string) string      { return credentials.headers[name] }
+func (credentials testCredentials) Certificate() *x509.Certificate { return credentials.certificate }
+func (credentials testCredentials) Target() string                 { return "test" }
+
+// presentEverything returns credentials for every method
+func presentEverything(t *testing.T, wrap JWTWrapper) testCredentials {
+	_, apiKey, err := wrap.CreateAPIKey("script", []string{"viewer"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := wrap.GenerateLoginToken("kaese")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testCredentials{
+		headers:     map[string]string{APIKeyHeader: apiKey, "Authorization": "Bearer " + token},
+		certificate: &x509.Certificate{Subject: pkix.Name{CommonName: "dashboard.example.com"}},
+	}
+}
+
+func TestChainPlainHTTP(t *testing.T) {
+	wrap := newTestWrapper(t, Config{})
+	chain, err := NewChain(Config{}, wrap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Requests served without TLS have no TLS state at all
+	if _, err := chain.Authenticate(HTTPCredentials(httptest.NewRequest("GET", "/rest/v0/devices", nil))); err != ErrNoCredentials {
+		t.Errorf("expected no credentials, got %v", err)
+	}
+
+	token, _ := wrap.GenerateLoginToken("kaese")
+	request := httptest.NewRequest("GET", "/rest/v0/devices", nil)
+	request.Header.Set("Authorization", "Bearer "+token)
+	principal, err := chain.Authenticate(HTTPCredentials(request))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if principal.Name != "kaese" || principal.Method != MethodToken {
+		t.Errorf("expected kaese by token, got %+v", principal)
+	}
+}
+
+func TestChainMethodsOnTheirOwn(t *testing.T) {
+	wrap := newTestWrapper(t, Config{})
+	credentials := presentEverything(t, wrap)
+	for _, test := range []struct {
+		method         string
+		expectedName   string
+		expectedMethod string
+	}{
+		{ChainCertificate, "dashboard", MethodCertificate},
+		{ChainAPIKey, "script", MethodAPIKey},
+		{ChainBearer, "kaese", MethodToken},
+	} {
+		chain, err := NewChain(Config{Methods: []string{test.method}}, wrap)
+		if err != nil {
+			t.Fatal(err)
+		}
+		principal, err := chain.Authenticate(credentials)
+		if err != nil {
+			t.Errorf("%s: %s", test.method, err.Error())
+			continue
+		}
+		if principal.Name != test.expectedName || principal.Method != test.expectedMethod {
+			t.Errorf("%s: expected %s by %s, got %+v", test.method, test.expectedName, test.expectedMethod, principal)
+		}
+
+		// Only the enabled method is accepted
+		alone := testCredentials{headers: map[string]string{}}
+		if test.method == ChainCertificate {
+			alone.headers = credentials.headers
+		} else {
+			alone.certificate = credentials.certificate
+		}
+		if _, err := chain.Authenticate(alone); err != ErrNoCredentials {
+			t.Errorf("%s: other methods were accepted, got %v", test.method, err)
+		}
+	}
+}
+
+func TestChainOrder(t *testing.T) {
+	wrap := newTestWrapper(t, Config{})
+	credentials := presentEverything(t, wrap)
+	for _, test := range []struct {
+		methods        []string
+		expectedMethod string
+	}{
+		{[]string{ChainCertificate, ChainAPIKey, ChainBearer}, MethodCertificate},
+		{[]string{ChainAPIKey, ChainBearer, ChainCertificate}, MethodAPIKey},
+		{[]string{ChainBearer, ChainCertificate, ChainAPIKey}, MethodToken},
+	} {
+		chain, err := NewChain(Config{Methods: test.methods}, wrap)
+		if err != nil {
+			t.Fatal(err)
+		}
+		principal, err := chain.Authenticate(credentials)
+		if err != nil {
+			t.Errorf("%v: %s", test.methods, err.Error())
+		} else if principal.Method != test.expectedMethod {
+			t.Errorf("%v: expected %s first, got %s", test.methods, test.expectedMethod, principal.Method)
+		}
+	}
+}
+
+func TestChainAnonymousIsReadOnly(t *testing.T) {
+	config := Config{Methods: []string{ChainBearer, ChainAnonymous}, AnonymousRoles: []string{"admin"}}
+	wrap := newTestWrapper(t, config)
+	chain, err := NewChain(config, wrap)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	principal, err := chain.Authenticate(testCredentials{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if principal.Method != MethodAnonymous {
+		t.Errorf("expected an anonymous principal, got %+v", principal)
+	}
+	if !principal.CanReadDevice("lamp") {
+		t.Error("the anonymous roles do not allow reading")
+	}
+	if principal.CanTriggerCapability("lamp", "activate") {
+		t.Error("anonymous principals may trigger capabilities")
+	}
+	if principal.IsAdmin() {
+		t.Error("anonymous principals are administrators")
+	}
+
+	// Refused credentials are not let in anonymously
+	if _, err := chain.Authenticate(testCredentials{headers: map[string]string{"Authorization": "Bearer nonsense"}}); err == nil {
+		t.Error("an invalid token was let in anonymously")
+	}
+}
@@ -0,0 +1,136 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+)
+
+// KeyConfig locates a signing key.
+// HS256 secrets are read from either File or Env. RS256 and ES256 keys are PEM files,
+// holding a private key for signing or either a private or a public key for verification.
+type KeyConfig struct {
+	// ID is put in the kid header of tokens so the right key can be found during verification
+	ID string `json:"id"`
+	// Algorithm is one of HS256, RS256 and ES256. It defaults to HS256
+	Algorithm string `json:"algorithm,omitempty"`
+	File      string `json:"file"`
+	Env       string `json:"env"`
+}
+
+func (conf KeyConfig) algorithm() string {
+	if conf.Algorithm == "" {
+		return algorithmHS256
+	}
+	return conf.Algorithm
+}
+
+func (conf KeyConfig) Validate() error {
+	if conf.ID == "" {
+		return errors.New("auth keys must have an id")
+	}
+	switch conf.algorithm() {
+	case algorithmHS256:
+		if (conf.File == "") == (conf.Env == "") {
+			return fmt.Errorf("auth key '%s' must set exactly one of file and env", conf.ID)
+		}
+	case algorithmRS256, algorithmES256:
+		if conf.File == "" || conf.Env != "" {
+			return fmt.Errorf("auth key '%s' must be read from a PEM file", conf.ID)
+		}
+	default:
+		return fmt.Errorf("auth key '%s' has unsupported algorithm '%s'", conf.ID, conf.Algorithm)
+	}
+	return nil
+}
+
+type Config struct {
+	Issuer             string `json:"issuer"`
+	AccessTokenMinutes int64  `json:"access-token-minutes"`
+	RefreshTokenHours  int64  `json:"refresh-token-hours"`
+	// SessionHours is how long a login may be kept alive by refreshing. 0 means a week
+	SessionHours int64 `json:"session-hours"`
+	// SigningKey signs new tokens and verifies them
+	SigningKey KeyConfig `json:"signing-key"`
+	// VerificationKeys are previous signing keys whose tokens are still accepted during rotation
+	VerificationKeys []KeyConfig `json:"verification-keys"`
+	Users            UsersConfig `json:"users"`
+	RBAC             RBACConfig  `json:"rbac"`
+	// Certificates is the allow-list of client certificates and the users they authenticate as
+	Certificates []CertificateMapping `json:"certificates"`
+	APIKeys      APIKeysConfig        `json:"api-keys"`
+	OIDC         OIDCConfig           `json:"oidc"`
+	// Methods are the ways REST requests and gRPC calls may authenticate, tried in order.
+	// One of certificate, api-key, bearer and anonymous. It defaults to all but anonymous.
+	Methods []string `json:"methods"`
+	// AnonymousRoles are given to requests without credentials when the anonymous method is enabled.
+	// Anonymous requests can never trigger capabilities or use administrative endpoints.
+	AnonymousRoles []string `json:"anonymous-roles"`
+}
+
+func (conf *Config) PopulateExample() {
+	conf.Issuer = "sdup-rest"
+	conf.AccessTokenMinutes = 5
+	conf.RefreshTokenHours = 24
+	conf.SessionHours = defaultSessionHours
+	conf.SigningKey = KeyConfig{ID: "2021-06", Algorithm: algorithmES256, File: "/etc/sdup-rest/jwt-signing-key.pem"}
+	conf.VerificationKeys = []KeyConfig{}
+	conf.Users.PopulateExample()
+	conf.RBAC.PopulateExample()
+	conf.Certificates = []CertificateMapping{{CommonName: "dashboard.example.com", User: "dashboard"}}
+	conf.APIKeys.PopulateExample()
+	conf.OIDC.PopulateExample()
+	conf.Methods = []string{ChainCertificate, ChainAPIKey, ChainBearer}
+	conf.AnonymousRoles = []string{}
+}
+
+func (conf Config) sessionHours() int64 {
+	if conf.SessionHours == 0 {
+		return defaultSessionHours
+	}
+	return conf.SessionHours
+}
+
+func (conf Config) Validate() error {
+	if conf.Issuer == "" {
+		return errors.New("auth issuer must be set")
+	}
+	if conf.AccessTokenMinutes <= 0 || conf.RefreshTokenHours <= 0 || conf.SessionHours < 0 {
+		return errors.New("auth token lifetimes must be positive")
+	}
+	if err := conf.SigningKey.Validate(); err != nil {
+		return err
+	}
+	ids := map[string]bool{conf.SigningKey.ID: true}
+	for _, key := range conf.VerificationKeys {
+		if err := key.Validate(); err != nil {
+			return err
+		}
+		if ids[key.ID] {
+			return fmt.Errorf("auth key id '%s' is used more than once", key.ID)
+		}
+		ids[key.ID] = true
+	}
+	// Without a users file only users of the identity provider can log in
+	if conf.Users.File != "" || !conf.OIDC.Enabled() {
+		if err := conf.Users.Validate(); err != nil {
+			return err
+		}
+	}
+	if err := conf.OIDC.Validate(); err != nil {
+		return err
+	}
+	for _, mapping := range conf.Certificates {
+		if err := mapping.Validate(); err != nil {
+			return err
+		}
+	}
+	if err := validateMethods(conf.Methods); err != nil {
+		return err
+	}
+	for _, role := range conf.AnonymousRoles {
+		if _, ok := conf.RBAC.Roles[role]; !ok {
+			return fmt.Errorf("anonymous-roles contains unknown role '%s'", role)
+		}
+	}
+	return conf.RBAC.Validate()
+}
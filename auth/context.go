@@ -0,0 +1,32 @@
+package auth
+
+import (
+	"context"
+
+	"github.com/Kaese72/sdup-rest/cache"
+)
+
+type principalKey struct{}
+
+// WithPrincipal attaches the authenticated caller to a context
+func WithPrincipal(ctx context.Context, principal Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+// PrincipalFromContext returns the caller attached by WithPrincipal
+func PrincipalFromContext(ctx context.Context) (Principal, bool) {
+	principal, ok := ctx.Value(principalKey{}).(Principal)
+	return principal, ok
+}
+
+// AuthorizedCache restricts the cache to what the caller in the context may do.
+// Without a caller in the context nothing is allowed.
+// If the cache is audited, triggers are recorded as made by the caller, including those that are refused.
+func AuthorizedCache(ctx context.Context, sdupCache cache.SDUPCache) cache.SDUPCache {
+	principal, _ := PrincipalFromContext(ctx)
+	authorized := cache.NewAuthorizedCache(sdupCache, principal)
+	if auditor, ok := sdupCache.(cache.Auditor); ok {
+		return auditor.AuditAs(authorized, principal.Name, principal.Method)
+	}
+	return authorized
+}
@@ -0,0 +1,47 @@
+package auth
+
+import (
+	"context"
+	"crypto/x509"
+	"net/http"
+)
+
+// Credentials is what a caller presents to authenticate, whichever server it called
+type Credentials interface {
+	Context() context.Context
+	// Header returns the first value of a request header, or "" if there is none
+	Header(name string) string
+	// Certificate returns the verified client certificate, or nil if there is none
+	Certificate() *x509.Certificate
+	// Target names what was called, for logs
+	Target() string
+}
+
+type httpCredentials struct {
+	reader *http.Request
+}
+
+// HTTPCredentials are the headers and client certificate of an HTTP request
+func HTTPCredentials(reader *http.Request) Credentials {
+	return httpCredentials{reader: reader}
+}
+
+func (credentials httpCredentials) Context() context.Context {
+	return credentials.reader.Context()
+}
+
+func (credentials httpCredentials) Header(name string) string {
+	return credentials.reader.Header.Get(name)
+}
+
+func (credentials httpCredentials) Certificate() *x509.Certificate {
+	// Requests served over plain HTTP have no TLS state
+	if credentials.reader.TLS == nil || len(credentials.reader.TLS.VerifiedChains) == 0 {
+		return nil
+	}
+	return credentials.reader.TLS.PeerCertificates[0]
+}
+
+func (credentials httpCredentials) Target() string {
+	return credentials.reader.URL.Path
+}
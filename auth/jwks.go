@@ -0,0 +1,63 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"encoding/base64"
+	"math/big"
+	"sort"
+)
+
+// JWK is the public part of a signing key as described in RFC 7517
+type JWK struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	// RSA
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// EC
+	Curve string `json:"crv,omitempty"`
+	X     string `json:"x,omitempty"`
+	Y     string `json:"y,omitempty"`
+}
+
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+func encodeJWKInt(value *big.Int, size int) string {
+	// EC coordinates have a fixed size, leading zeroes are kept
+	bytes := value.Bytes()
+	if len(bytes) < size {
+		bytes = append(make([]byte, size-len(bytes)), bytes...)
+	}
+	return base64.RawURLEncoding.EncodeToString(bytes)
+}
+
+// JWKS publishes the public keys tokens are signed with, so that other services can verify them.
+// HMAC secrets are never included. Tokens signed with them can only be verified by sdup-rest itself.
+func (wrap *JWTWrapper) JWKS() JWKSet {
+	set := JWKSet{Keys: []JWK{}}
+	for id, key := range wrap.keys {
+		jwk := JWK{KeyID: id, Use: "sig", Algorithm: key.method.Alg()}
+		switch public := key.publicKey().(type) {
+		case *rsa.PublicKey:
+			jwk.KeyType = "RSA"
+			jwk.N = encodeJWKInt(public.N, 0)
+			jwk.E = encodeJWKInt(big.NewInt(int64(public.E)), 0)
+		case *ecdsa.PublicKey:
+			size := (public.Curve.Params().BitSize + 7) / 8
+			jwk.KeyType = "EC"
+			jwk.Curve = public.Curve.Params().Name
+			jwk.X = encodeJWKInt(public.X, size)
+			jwk.Y = encodeJWKInt(public.Y, size)
+		default:
+			continue
+		}
+		set.Keys = append(set.Keys, jwk)
+	}
+	sort.Slice(set.Keys, func(i, j int) bool { return set.Keys[i].KeyID < set.Keys[j].KeyID })
+	return set
+}
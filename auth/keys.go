@@ -0,0 +1,115 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+const (
+	algorithmHS256 = "HS256"
+	algorithmRS256 = "RS256"
+	algorithmES256 = "ES256"
+)
+
+// minSecretLength is the shortest HMAC secret accepted, in bytes
+const minSecretLength = 32
+
+// knownDefaultSecrets have been published and must never be used to sign tokens
+var knownDefaultSecrets = []string{"kindofsecretkey"}
+
+// loadedKey is a key ready to sign or verify tokens with.
+// signing is nil for asymmetric keys where only the public key is known.
+type loadedKey struct {
+	method       jwt.SigningMethod
+	signing      interface{}
+	verification interface{}
+}
+
+// load reads the key and refuses anything that is guessable
+func (conf KeyConfig) load() (loadedKey, error) {
+	switch conf.algorithm() {
+	case algorithmRS256:
+		return conf.loadRSA()
+	case algorithmES256:
+		return conf.loadEC()
+	default:
+		return conf.loadHMAC()
+	}
+}
+
+func (conf KeyConfig) loadHMAC() (loadedKey, error) {
+	var secret string
+	if conf.File != "" {
+		content, err := ioutil.ReadFile(conf.File)
+		if err != nil {
+			return loadedKey{}, err
+		}
+		secret = strings.TrimSpace(string(content))
+
+	} else {
+		secret = os.Getenv(conf.Env)
+	}
+
+	if len(secret) < minSecretLength {
+		return loadedKey{}, fmt.Errorf("auth key '%s' is shorter than %d bytes", conf.ID, minSecretLength)
+	}
+	for _, known := range knownDefaultSecrets {
+		if secret == known {
+			return loadedKey{}, fmt.Errorf("auth key '%s' is a published default", conf.ID)
+		}
+	}
+	return loadedKey{method: jwt.SigningMethodHS256, signing: []byte(secret), verification: []byte(secret)}, nil
+}
+
+func (conf KeyConfig) loadRSA() (loadedKey, error) {
+	content, err := ioutil.ReadFile(conf.File)
+	if err != nil {
+		return loadedKey{}, err
+	}
+	if private, err := jwt.ParseRSAPrivateKeyFromPEM(content); err == nil {
+		return loadedKey{method: jwt.SigningMethodRS256, signing: private, verification: &private.PublicKey}, nil
+	}
+	public, err := jwt.ParseRSAPublicKeyFromPEM(content)
+	if err != nil {
+		return loadedKey{}, fmt.Errorf("auth key '%s' is not a PEM encoded RSA key", conf.ID)
+	}
+	return loadedKey{method: jwt.SigningMethodRS256, verification: public}, nil
+}
+
+// loadEC accepts SEC 1 private keys, as generated by openssl ecparam, and PKIX public keys
+func (conf KeyConfig) loadEC() (loadedKey, error) {
+	content, err := ioutil.ReadFile(conf.File)
+	if err != nil {
+		return loadedKey{}, err
+	}
+	var public *ecdsa.PublicKey
+	key := loadedKey{method: jwt.SigningMethodES256}
+	if private, err := jwt.ParseECPrivateKeyFromPEM(content); err == nil {
+		key.signing = private
+		public = &private.PublicKey
+	} else if public, err = jwt.ParseECPublicKeyFromPEM(content); err != nil {
+		return loadedKey{}, fmt.Errorf("auth key '%s' is not a PEM encoded EC key", conf.ID)
+	}
+	if public.Curve != elliptic.P256() {
+		return loadedKey{}, fmt.Errorf("auth key '%s' must use curve P-256 for ES256", conf.ID)
+	}
+	key.verification = public
+	return key, nil
+}
+
+// publicKey is what may be shown to anyone, nothing for HMAC secrets
+func (key loadedKey) publicKey() interface{} {
+	switch public := key.verification.(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey:
+		return public
+	default:
+		return nil
+	}
+}
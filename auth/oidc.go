@@ -0,0 +1,247 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	oidc "github.com/coreos/go-oidc"
+	"golang.org/x/oauth2"
+)
+
+// oidcLoginTimeout is how long a user has to complete a login at the identity provider
+const oidcLoginTimeout = 10 * time.Minute
+
+// maxPendingLogins bounds the logins waiting for the identity provider. Starting a login needs no credentials,
+// so beyond this the oldest is forgotten
+const maxPendingLogins = 1024
+
+const defaultUserClaim = "sub"
+
+// federatedUserPrefix sets users of the identity provider apart from local users, whose names can not contain ':'
+const federatedUserPrefix = "oidc:"
+
+var ErrInvalidOIDCState = errors.New("unknown or expired login state")
+
+// OIDCConfig delegates logins to an OpenID Connect identity provider. It is disabled unless Issuer is set.
+// Users of the identity provider are named oidc:<user claim>, so that they can never be mistaken for local users.
+// They are assigned roles from RBACConfig.UserRoles by that name, and additionally get any roles named in the roles claim.
+type OIDCConfig struct {
+	// Issuer is the URL the provider configuration is discovered from
+	Issuer       string `json:"issuer"`
+	ClientID     string `json:"client-id"`
+	ClientSecret string `json:"client-secret"`
+	// RedirectURL is where the identity provider sends users back to, the oidc/callback endpoint
+	RedirectURL string   `json:"redirect-url"`
+	Scopes      []string `json:"scopes"`
+	// Audiences are accepted in bearer tokens issued by the provider. It defaults to the client ID
+	Audiences []string `json:"audiences"`
+	// UserClaim names the user. It defaults to "sub"
+	UserClaim string `json:"user-claim"`
+	// RolesClaim optionally holds role names, as a list or space separated. Nested claims are separated by dots
+	RolesClaim string `json:"roles-claim"`
+}
+
+func (conf *OIDCConfig) PopulateExample() {
+	conf.Issuer = "https://idp.example.com/realms/home"
+	conf.ClientID = "sdup-rest"
+	conf.ClientSecret = "client secret"
+	conf.RedirectURL = "https://sdup-rest.example.com/rest/v0/auth/oidc/callback"
+	conf.Scopes = []string{"profile"}
+	conf.Audiences = []string{"sdup-rest"}
+	conf.UserClaim = "preferred_username"
+	conf.RolesClaim = "realm_access.roles"
+}
+
+func (conf OIDCConfig) Enabled() bool {
+	return conf.Issuer != ""
+}
+
+func (conf OIDCConfig) Validate() error {
+	if !conf.Enabled() {
+		return nil
+	}
+	if conf.ClientID == "" || conf.RedirectURL == "" {
+		return errors.New("auth oidc client-id and redirect-url must be set")
+	}
+	return nil
+}
+
+func (conf OIDCConfig) userClaim() string {
+	if conf.UserClaim == "" {
+		return defaultUserClaim
+	}
+	return conf.UserClaim
+}
+
+func (conf OIDCConfig) audiences() []string {
+	if len(conf.Audiences) == 0 {
+		return []string{conf.ClientID}
+	}
+	return conf.Audiences
+}
+
+// pendingLogin is a login that has been sent to the identity provider
+type pendingLogin struct {
+	nonce   string
+	expires time.Time
+}
+
+// OIDCProvider runs the authorization code flow against an identity provider and verifies its tokens
+type OIDCProvider struct {
+	config        OIDCConfig
+	oauth2        oauth2.Config
+	idTokens      *oidc.IDTokenVerifier
+	bearerTokens  *oidc.IDTokenVerifier
+	loginsLock    sync.Mutex
+	pendingLogins map[string]pendingLogin
+}
+
+// NewOIDCProvider discovers the identity provider, which therefore has to be reachable
+func NewOIDCProvider(ctx context.Context, config OIDCConfig) (*OIDCProvider, error) {
+	provider, err := oidc.NewProvider(ctx, config.Issuer)
+	if err != nil {
+		return nil, fmt.Errorf("could not discover identity provider: %s", err.Error())
+	}
+	return &OIDCProvider{
+		config: config,
+		oauth2: oauth2.Config{
+			ClientID:     config.ClientID,
+			ClientSecret: config.ClientSecret,
+			RedirectURL:  config.RedirectURL,
+			Endpoint:     provider.Endpoint(),
+			Scopes:       append([]string{oidc.ScopeOpenID}, config.Scopes...),
+		},
+		idTokens: provider.Verifier(&oidc.Config{ClientID: config.ClientID}),
+		// Audiences of bearer tokens are checked against the configured list instead
+		bearerTokens:  provider.Verifier(&oidc.Config{SkipClientIDCheck: true}),
+		pendingLogins: map[string]pendingLogin{},
+	}, nil
+}
+
+// LoginURL starts a login. The state has to be presented again together with the code from the identity provider
+func (provider *OIDCProvider) LoginURL() (url string, state string, err error) {
+	state, err = randomString(16)
+	if err != nil {
+		return "", "", err
+	}
+	nonce, err := randomString(16)
+	if err != nil {
+		return "", "", err
+	}
+
+	provider.loginsLock.Lock()
+	defer provider.loginsLock.Unlock()
+	now := time.Now()
+	for pendingState, pending := range provider.pendingLogins {
+		if now.After(pending.expires) {
+			delete(provider.pendingLogins, pendingState)
+		}
+	}
+	if len(provider.pendingLogins) >= maxPendingLogins {
+		provider.forgetOldestLogin()
+	}
+	provider.pendingLogins[state] = pendingLogin{nonce: nonce, expires: now.Add(oidcLoginTimeout)}
+	return provider.oauth2.AuthCodeURL(state, oidc.Nonce(nonce)), state, nil
+}
+
+// forgetOldestLogin drops the login that expires first. The caller holds loginsLock
+func (provider *OIDCProvider) forgetOldestLogin() {
+	var oldestState string
+	var oldest time.Time
+	for pendingState, pending := range provider.pendingLogins {
+		if oldestState == "" || pending.expires.Before(oldest) {
+			oldestState, oldest = pendingState, pending.expires
+		}
+	}
+	delete(provider.pendingLogins, oldestState)
+}
+
+// Exchange completes a login, returning the user and the roles given to it by the identity provider
+func (provider *OIDCProvider) Exchange(ctx context.Context, state, code string) (user string, roles []string, err error) {
+	provider.loginsLock.Lock()
+	pending, ok := provider.pendingLogins[state]
+	delete(provider.pendingLogins, state)
+	provider.loginsLock.Unlock()
+	if !ok || time.Now().After(pending.expires) {
+		return "", nil, ErrInvalidOIDCState
+	}
+
+	token, err := provider.oauth2.Exchange(ctx, code)
+	if err != nil {
+		return "", nil, err
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return "", nil, errors.New("identity provider did not return an id token")
+	}
+	idToken, err := provider.idTokens.Verify(ctx, rawIDToken)
+	if err != nil {
+		return "", nil, err
+	}
+	if idToken.Nonce != pending.nonce {
+		return "", nil, errors.New("id token nonce does not match the login")
+	}
+	return provider.mapClaims(idToken)
+}
+
+// VerifyBearer accepts an access token issued by the identity provider to one of the configured audiences
+func (provider *OIDCProvider) VerifyBearer(ctx context.Context, rawToken string) (user string, roles []string, err error) {
+	token, err := provider.bearerTokens.Verify(ctx, rawToken)
+	if err != nil {
+		return "", nil, err
+	}
+	accepted := false
+	for _, audience := range provider.config.audiences() {
+		if containsString(token.Audience, audience) {
+			accepted = true
+		}
+	}
+	if !accepted {
+		return "", nil, errors.New("token is not intended for sdup-rest")
+	}
+	return provider.mapClaims(token)
+}
+
+// mapClaims finds the user and roles in a verified token. The user is namespaced, see federatedUserPrefix
+func (provider *OIDCProvider) mapClaims(token *oidc.IDToken) (user string, roles []string, err error) {
+	var claims map[string]interface{}
+	if err := token.Claims(&claims); err != nil {
+		return "", nil, err
+	}
+	user, ok := lookupClaim(claims, provider.config.userClaim()).(string)
+	if !ok || user == "" {
+		return "", nil, fmt.Errorf("token has no '%s' claim", provider.config.userClaim())
+	}
+	user = federatedUserPrefix + user
+	if provider.config.RolesClaim == "" {
+		return user, nil, nil
+	}
+	switch claimRoles := lookupClaim(claims, provider.config.RolesClaim).(type) {
+	case string:
+		roles = strings.Fields(claimRoles)
+	case []interface{}:
+		for _, role := range claimRoles {
+			if role, ok := role.(string); ok {
+				roles = append(roles, role)
+			}
+		}
+	}
+	return user, roles, nil
+}
+
+// lookupClaim follows a dot separated path into nested claims
+func lookupClaim(claims map[string]interface{}, path string) interface{} {
+	var value interface{} = claims
+	for _, name := range strings.Split(path, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = object[name]
+	}
+	return value
+}
@@ -0,0 +1,33 @@
+package auth
+
+import (
+	"context"
+	"testing"
+)
+
+func TestLoginURLBoundsPendingLogins(t *testing.T) {
+	provider := &OIDCProvider{pendingLogins: map[string]pendingLogin{}}
+	_, first, err := provider.LoginURL()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var last string
+	for i := 0; i < maxPendingLogins+10; i++ {
+		if _, last, err = provider.LoginURL(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if pending := len(provider.pendingLogins); pending != maxPendingLogins {
+		t.Errorf("expected %d pending logins, got %d", maxPendingLogins, pending)
+	}
+	if _, ok := provider.pendingLogins[first]; ok {
+		t.Error("expected the oldest login to be forgotten")
+	}
+	if _, ok := provider.pendingLogins[last]; !ok {
+		t.Error("expected the latest login to be pending")
+	}
+	if _, _, err := provider.Exchange(context.Background(), first, "code"); err != ErrInvalidOIDCState {
+		t.Errorf("expected a forgotten login to be refused, got %v", err)
+	}
+}
@@ -0,0 +1,149 @@
+package auth
+
+import (
+	"fmt"
+	"path"
+
+	"github.com/Kaese72/sdup-lib/sduptemplates"
+)
+
+// matchAll in a list of patterns or capabilities grants everything
+const matchAll = "*"
+
+// RoleConfig describes what holders of a role may do
+type RoleConfig struct {
+	// Devices are glob patterns of device IDs the role may see
+	Devices []string `json:"devices"`
+	// Capabilities are the capability keys the role may trigger on its devices. Without any the role is read-only
+	Capabilities []string `json:"capabilities"`
+	// Admin grants access to the administrative endpoints
+	Admin bool `json:"admin"`
+}
+
+func (role RoleConfig) Validate() error {
+	for _, pattern := range role.Devices {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid device pattern '%s'", pattern)
+		}
+	}
+	return nil
+}
+
+func (role RoleConfig) canReadDevice(deviceID sduptemplates.DeviceID) bool {
+	for _, pattern := range role.Devices {
+		if pattern == matchAll {
+			return true
+		}
+		if match, _ := path.Match(pattern, string(deviceID)); match {
+			return true
+		}
+	}
+	return false
+}
+
+func (role RoleConfig) canTriggerCapability(deviceID sduptemplates.DeviceID, capKey sduptemplates.CapabilityKey) bool {
+	if !role.canReadDevice(deviceID) {
+		return false
+	}
+	for _, capability := range role.Capabilities {
+		if capability == matchAll || sduptemplates.CapabilityKey(capability) == capKey {
+			return true
+		}
+	}
+	return false
+}
+
+type RBACConfig struct {
+	Roles map[string]RoleConfig `json:"roles"`
+	// UserRoles assigns roles to users, whether they log in or present a client certificate.
+	// Users of the identity provider are listed as oidc:<user>, see OIDCConfig
+	UserRoles map[string][]string `json:"user-roles"`
+}
+
+func (conf *RBACConfig) PopulateExample() {
+	conf.Roles = map[string]RoleConfig{
+		"admin":  {Devices: []string{matchAll}, Capabilities: []string{matchAll}, Admin: true},
+		"viewer": {Devices: []string{matchAll}},
+		"lights": {Devices: []string{"hue-*"}, Capabilities: []string{"activate", "deactivate"}},
+	}
+	conf.UserRoles = map[string][]string{"kaese": {"admin"}, "dashboard": {"viewer"}, "sdup-rest": {"lights"}}
+}
+
+func (conf RBACConfig) Validate() error {
+	for name, role := range conf.Roles {
+		if err := role.Validate(); err != nil {
+			return fmt.Errorf("role '%s': %s", name, err.Error())
+		}
+	}
+	for user, roles := range conf.UserRoles {
+		for _, role := range roles {
+			if _, ok := conf.Roles[role]; !ok {
+				return fmt.Errorf("'%s' is assigned unknown role '%s'", user, role)
+			}
+		}
+	}
+	return nil
+}
+
+// Ways a principal can have authenticated
+const (
+	MethodCertificate = "certificate"
+	MethodToken       = "token"
+	MethodAPIKey      = "api-key"
+	MethodOIDC        = "oidc"
+	MethodAnonymous   = "anonymous"
+	// MethodMQTT is the MQTT bridge, acting as the user named by its client ID
+	MethodMQTT = "mqtt"
+)
+
+// Principal is an authenticated caller together with what it is allowed to do
+type Principal struct {
+	Name  string
+	Roles []string
+	// Method is how the principal authenticated
+	Method string
+	roles  []RoleConfig
+}
+
+// newPrincipal resolves role names. Roles that no longer exist grant nothing
+func (conf RBACConfig) newPrincipal(name, method string, roleNames []string) Principal {
+	principal := Principal{Name: name, Roles: roleNames, Method: method}
+	for _, roleName := range roleNames {
+		if role, ok := conf.Roles[roleName]; ok {
+			principal.roles = append(principal.roles, role)
+		}
+	}
+	return principal
+}
+
+// UserPrincipal is a user with the roles assigned to it in UserRoles, for services acting as a configured user
+func (conf RBACConfig) UserPrincipal(name, method string) Principal {
+	return conf.newPrincipal(name, method, conf.UserRoles[name])
+}
+
+func (principal Principal) CanReadDevice(deviceID sduptemplates.DeviceID) bool {
+	for _, role := range principal.roles {
+		if role.canReadDevice(deviceID) {
+			return true
+		}
+	}
+	return false
+}
+
+func (principal Principal) CanTriggerCapability(deviceID sduptemplates.DeviceID, capKey sduptemplates.CapabilityKey) bool {
+	for _, role := range principal.roles {
+		if role.canTriggerCapability(deviceID, capKey) {
+			return true
+		}
+	}
+	return false
+}
+
+func (principal Principal) IsAdmin() bool {
+	for _, role := range principal.roles {
+		if role.Admin {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,180 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/Kaese72/sdup-lib/logging"
+)
+
+// sweepInterval is how often expired refresh tokens are forgotten
+const sweepInterval = time.Minute
+
+// defaultSessionHours is how long a login lasts at most, however often it is refreshed
+const defaultSessionHours = 7 * 24
+
+var (
+	ErrInvalidRefreshToken = errors.New("invalid refresh token")
+	// ErrRefreshTokenReuse means an already used refresh token was presented, so it has likely been stolen
+	ErrRefreshTokenReuse = errors.New("refresh token reused, all sessions of its login are revoked")
+)
+
+// Session is who a login was made by
+type Session struct {
+	User string
+	// Federated sessions belong to users of an identity provider. They are not in the user store
+	// and keep the roles they were given at login.
+	Federated bool
+	Roles     []string
+	// NotAfter ends the login however often it is refreshed. It is set when the login starts,
+	// federated sessions end sooner since refreshing them does not consult the identity provider
+	NotAfter time.Time
+}
+
+// refreshToken is the server side state of an issued refresh token.
+// Every login starts a family and each refresh replaces a token with a new one in the same family.
+type refreshToken struct {
+	family  string
+	session Session
+	expires time.Time
+	used    bool
+	revoked bool
+}
+
+// RefreshTokenStore issues one-time-use refresh tokens and keeps track of them.
+// Tokens only live in memory, so a restart requires everyone to log in again.
+type RefreshTokenStore struct {
+	lifetime time.Duration
+	// sessionLifetime bounds a whole family, from the login onwards
+	sessionLifetime time.Duration
+
+	lock      sync.Mutex
+	tokens    map[string]*refreshToken
+	lastSweep time.Time
+}
+
+func NewRefreshTokenStore(lifetime, sessionLifetime time.Duration) *RefreshTokenStore {
+	return &RefreshTokenStore{
+		lifetime:        lifetime,
+		sessionLifetime: sessionLifetime,
+		tokens:          map[string]*refreshToken{},
+	}
+}
+
+func randomString(length int) (string, error) {
+	buf := make([]byte, length)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// tokenKey is what tokens are stored by, so that the store itself does not contain usable tokens
+func tokenKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// sweep must be called with the lock held
+func (store *RefreshTokenStore) sweep() {
+	now := time.Now()
+	if now.Sub(store.lastSweep) < sweepInterval {
+		return
+	}
+	store.lastSweep = now
+	for key, token := range store.tokens {
+		if now.After(token.expires) {
+			delete(store.tokens, key)
+		}
+	}
+}
+
+// issue must be called with the lock held. Tokens never outlive their session
+func (store *RefreshTokenStore) issue(session Session, family string) (string, error) {
+	token, err := randomString(32)
+	if err != nil {
+		return "", err
+	}
+	expires := time.Now().Add(store.lifetime)
+	if session.NotAfter.Before(expires) {
+		expires = session.NotAfter
+	}
+	store.tokens[tokenKey(token)] = &refreshToken{
+		family:  family,
+		session: session,
+		expires: expires,
+	}
+	return token, nil
+}
+
+// Issue starts a new family for a fresh login, which ends at the latest after the session lifetime
+func (store *RefreshTokenStore) Issue(session Session) (string, error) {
+	family, err := randomString(16)
+	if err != nil {
+		return "", err
+	}
+	if notAfter := time.Now().Add(store.sessionLifetime); session.NotAfter.IsZero() || notAfter.Before(session.NotAfter) {
+		session.NotAfter = notAfter
+	}
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	store.sweep()
+	return store.issue(session, family)
+}
+
+// Rotate consumes a refresh token and returns its session and the token replacing it
+func (store *RefreshTokenStore) Rotate(token string) (session Session, newToken string, err error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	store.sweep()
+
+	current, ok := store.tokens[tokenKey(token)]
+	if !ok || current.revoked || time.Now().After(current.expires) {
+		return Session{}, "", ErrInvalidRefreshToken
+	}
+	if current.used {
+		logging.Error("Refresh token reuse detected", map[string]string{"user": current.session.User})
+		store.revokeFamily(current.family)
+		return Session{}, "", ErrRefreshTokenReuse
+	}
+	current.used = true
+	newToken, err = store.issue(current.session, current.family)
+	return current.session, newToken, err
+}
+
+// Revoke ends the login the token belongs to and returns its user. Unknown tokens are ignored
+func (store *RefreshTokenStore) Revoke(token string) string {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	current, ok := store.tokens[tokenKey(token)]
+	if !ok {
+		return ""
+	}
+	store.revokeFamily(current.family)
+	return current.session.User
+}
+
+// RevokeUser ends every login of a user
+func (store *RefreshTokenStore) RevokeUser(user string) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	for _, token := range store.tokens {
+		if token.session.User == user {
+			store.revokeFamily(token.family)
+		}
+	}
+}
+
+// revokeFamily must be called with the lock held
+func (store *RefreshTokenStore) revokeFamily(family string) {
+	for _, token := range store.tokens {
+		if token.family == family {
+			token.revoked = true
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRefreshEndsWithTheSession(t *testing.T) {
+	store := NewRefreshTokenStore(time.Hour, 200*time.Millisecond)
+	token, err := store.Issue(Session{User: "kaese"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var session, last Session
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if session, token, err = store.Rotate(token); err != nil {
+			break
+		}
+		last = session
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != ErrInvalidRefreshToken {
+		t.Fatalf("expected refreshing to end with the session, got %v", err)
+	}
+	if last.NotAfter.IsZero() || last.NotAfter.After(time.Now()) {
+		t.Errorf("expected the session to have ended, it ends %s", last.NotAfter)
+	}
+
+	// Sessions may end sooner, such as federated ones, but never later
+	notAfter := time.Now().Add(time.Minute)
+	store = NewRefreshTokenStore(time.Hour, 2*time.Minute)
+	token, _ = store.Issue(Session{User: "oidc:kaese", Federated: true, NotAfter: notAfter})
+	if session, _, err = store.Rotate(token); err != nil || !session.NotAfter.Equal(notAfter) {
+		t.Errorf("expected the session to end at %s, got %s (%v)", notAfter, session.NotAfter, err)
+	}
+	token, _ = store.Issue(Session{User: "oidc:kaese", Federated: true, NotAfter: time.Now().Add(time.Hour)})
+	if session, _, err = store.Rotate(token); err != nil || session.NotAfter.After(time.Now().Add(2*time.Minute)) {
+		t.Errorf("expected the session lifetime to bound the session, got %s (%v)", session.NotAfter, err)
+	}
+}
@@ -0,0 +1,290 @@
+package auth
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	defaultMaxFailures    = 5
+	defaultLockoutMinutes = 15
+)
+
+// disabledPrefix marks a disabled user in the htpasswd file, the hash then no longer matches any password
+const disabledPrefix = "!"
+
+var (
+	ErrInvalidCredentials = errors.New("invalid user credentials")
+	ErrUserLockedOut      = errors.New("user is temporarily locked out")
+	ErrNoSuchUser         = errors.New("no such user")
+	ErrUserExists         = errors.New("user already exists")
+)
+
+// ErrInvalidUser is a user name or password that is not acceptable
+type ErrInvalidUser struct {
+	Err error
+}
+
+func (err ErrInvalidUser) Error() string { return err.Err.Error() }
+func (err ErrInvalidUser) Unwrap() error { return err.Err }
+
+// dummyHash is compared against for unknown users so that they take as long to reject as known ones
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+
+type User struct {
+	Name     string `json:"name"`
+	Disabled bool   `json:"disabled"`
+}
+
+// UserStore is a backend that knows users and their passwords
+type UserStore interface {
+	// Authenticate returns nil only if the user exists, is enabled, is not locked out and the password matches
+	Authenticate(name, password string) error
+	Users() ([]User, error)
+	CreateUser(name, password string) error
+	SetDisabled(name string, disabled bool) error
+	// ResetPassword sets a new password and lifts any lockout
+	ResetPassword(name, password string) error
+}
+
+type UsersConfig struct {
+	// File is an htpasswd file with bcrypt hashes
+	File string `json:"file"`
+	// MaxFailures is how many consecutive failed logins lock a user out
+	MaxFailures    int `json:"max-failures"`
+	LockoutMinutes int `json:"lockout-minutes"`
+}
+
+func (conf *UsersConfig) PopulateExample() {
+	conf.File = "/etc/sdup-rest/htpasswd"
+	conf.MaxFailures = defaultMaxFailures
+	conf.LockoutMinutes = defaultLockoutMinutes
+}
+
+func (conf UsersConfig) Validate() error {
+	if conf.File == "" {
+		return errors.New("auth users file must be set")
+	}
+	if conf.MaxFailures < 0 || conf.LockoutMinutes < 0 {
+		return errors.New("auth users max-failures and lockout-minutes may not be negative")
+	}
+	return nil
+}
+
+type failures struct {
+	count       int
+	lockedUntil time.Time
+}
+
+// HtpasswdStore keeps users in an htpasswd file with bcrypt hashes
+type HtpasswdStore struct {
+	config UsersConfig
+
+	lock     sync.Mutex
+	hashes   map[string]string
+	failures map[string]*failures
+}
+
+// NewHtpasswdStore loads the users file, which is created on the first change if it does not exist.
+// Without a file the store is empty and can not be changed.
+func NewHtpasswdStore(config UsersConfig) (*HtpasswdStore, error) {
+	if config.MaxFailures == 0 {
+		config.MaxFailures = defaultMaxFailures
+	}
+	if config.LockoutMinutes == 0 {
+		config.LockoutMinutes = defaultLockoutMinutes
+	}
+	store := &HtpasswdStore{
+		config:   config,
+		hashes:   map[string]string{},
+		failures: map[string]*failures{},
+	}
+	if config.File == "" {
+		return store, nil
+	}
+
+	content, err := ioutil.ReadFile(config.File)
+	if os.IsNotExist(err) {
+		return store, nil
+	} else if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("malformed line %d in users file", lineNumber)
+		}
+		if !strings.HasPrefix(strings.TrimPrefix(parts[1], disabledPrefix), "$2") {
+			return nil, fmt.Errorf("user '%s' does not have a bcrypt hash", parts[0])
+		}
+		store.hashes[parts[0]] = parts[1]
+	}
+	return store, scanner.Err()
+}
+
+// save must be called with the lock held
+func (store *HtpasswdStore) save() error {
+	if store.config.File == "" {
+		return errors.New("no users file is configured")
+	}
+	names := make([]string, 0, len(store.hashes))
+	for name := range store.hashes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var content bytes.Buffer
+	for _, name := range names {
+		fmt.Fprintf(&content, "%s:%s\n", name, store.hashes[name])
+	}
+	tmpFile := store.config.File + ".tmp"
+	if err := ioutil.WriteFile(tmpFile, content.Bytes(), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, store.config.File)
+}
+
+func (store *HtpasswdStore) Authenticate(name, password string) error {
+	store.lock.Lock()
+	hash, ok := store.hashes[name]
+	if !ok {
+		store.lock.Unlock()
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return ErrInvalidCredentials
+	}
+	userFailures := store.failures[name]
+	if userFailures == nil {
+		userFailures = &failures{}
+		store.failures[name] = userFailures
+	}
+	if time.Now().Before(userFailures.lockedUntil) {
+		store.lock.Unlock()
+		return ErrUserLockedOut
+	}
+	// The attempt counts as failed until the password is known to match,
+	// so that concurrent guesses can not all get past the lockout before one of them is counted
+	userFailures.count++
+	if userFailures.count >= store.config.MaxFailures {
+		userFailures.count = 0
+		userFailures.lockedUntil = time.Now().Add(time.Duration(store.config.LockoutMinutes) * time.Minute)
+	}
+	store.lock.Unlock()
+
+	// Disabled users still pay for a comparison so they can not be told apart from wrong passwords
+	disabled := strings.HasPrefix(hash, disabledPrefix)
+	if err := bcrypt.CompareHashAndPassword([]byte(strings.TrimPrefix(hash, disabledPrefix)), []byte(password)); err != nil {
+		return ErrInvalidCredentials
+	}
+	store.lock.Lock()
+	delete(store.failures, name)
+	store.lock.Unlock()
+	if disabled {
+		return ErrInvalidCredentials
+	}
+	return nil
+}
+
+func (store *HtpasswdStore) Users() ([]User, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	users := []User{}
+	for name, hash := range store.hashes {
+		users = append(users, User{Name: name, Disabled: strings.HasPrefix(hash, disabledPrefix)})
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Name < users[j].Name })
+	return users, nil
+}
+
+func validateUser(name, password string) error {
+	if name == "" || strings.ContainsAny(name, ":\n") {
+		return ErrInvalidUser{Err: errors.New("user names may not be empty or contain ':'")}
+	}
+	if len(password) < 8 {
+		return ErrInvalidUser{Err: errors.New("passwords must be at least 8 characters")}
+	}
+	return nil
+}
+
+func (store *HtpasswdStore) CreateUser(name, password string) error {
+	if err := validateUser(name, password); err != nil {
+		return err
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if _, ok := store.hashes[name]; ok {
+		return ErrUserExists
+	}
+	store.hashes[name] = string(hash)
+	if err := store.save(); err != nil {
+		delete(store.hashes, name)
+		return err
+	}
+	return nil
+}
+
+func (store *HtpasswdStore) SetDisabled(name string, disabled bool) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	previous, ok := store.hashes[name]
+	if !ok {
+		return ErrNoSuchUser
+	}
+	hash := strings.TrimPrefix(previous, disabledPrefix)
+	if disabled {
+		hash = disabledPrefix + hash
+	}
+	store.hashes[name] = hash
+	if err := store.save(); err != nil {
+		store.hashes[name] = previous
+		return err
+	}
+	return nil
+}
+
+func (store *HtpasswdStore) ResetPassword(name, password string) error {
+	if err := validateUser(name, password); err != nil {
+		return err
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	previous, ok := store.hashes[name]
+	if !ok {
+		return ErrNoSuchUser
+	}
+	newHash := string(hash)
+	if strings.HasPrefix(previous, disabledPrefix) {
+		// Resetting the password does not enable the user
+		newHash = disabledPrefix + newHash
+	}
+	store.hashes[name] = newHash
+	if err := store.save(); err != nil {
+		store.hashes[name] = previous
+		return err
+	}
+	delete(store.failures, name)
+	return nil
+}
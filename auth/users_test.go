@@ -0,0 +1,98 @@
+package auth
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func newTestUserStore(t *testing.T, config UsersConfig) *HtpasswdStore {
+	dir, err := ioutil.TempDir("", "sdup-rest-users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	config.File = filepath.Join(dir, "htpasswd")
+	store, err := NewHtpasswdStore(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.CreateUser("kaese", "correct horse"); err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestAuthenticateConcurrentGuesses(t *testing.T) {
+	store := newTestUserStore(t, UsersConfig{MaxFailures: 3, LockoutMinutes: 1})
+
+	const guesses = 20
+	results := make(chan error, guesses)
+	var wait sync.WaitGroup
+	for i := 0; i < guesses; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			results <- store.Authenticate("kaese", "wrong guess")
+		}()
+	}
+	wait.Wait()
+	close(results)
+
+	compared := 0
+	for err := range results {
+		switch err {
+		case ErrInvalidCredentials:
+			compared++
+		case ErrUserLockedOut:
+		default:
+			t.Errorf("unexpected error %v", err)
+		}
+	}
+	if compared != 3 {
+		t.Errorf("expected 3 guesses before the lockout, got %d", compared)
+	}
+	if err := store.Authenticate("kaese", "correct horse"); err != ErrUserLockedOut {
+		t.Errorf("expected the user to be locked out, got %v", err)
+	}
+}
+
+func TestAuthenticateResetsFailures(t *testing.T) {
+	store := newTestUserStore(t, UsersConfig{MaxFailures: 3, LockoutMinutes: 1})
+
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 2; i++ {
+			if err := store.Authenticate("kaese", "wrong guess"); err != ErrInvalidCredentials {
+				t.Fatalf("expected invalid credentials, got %v", err)
+			}
+		}
+		if err := store.Authenticate("kaese", "correct horse"); err != nil {
+			t.Fatalf("round %d: %v", round, err)
+		}
+	}
+}
+
+func TestCreateUserErrors(t *testing.T) {
+	store := newTestUserStore(t, UsersConfig{})
+	var invalid ErrInvalidUser
+	for _, login := range [][2]string{{"", "correct horse"}, {"a:b", "correct horse"}, {"cheese", "short"}} {
+		if err := store.CreateUser(login[0], login[1]); !errors.As(err, &invalid) {
+			t.Errorf("%q: expected the user to be invalid, got %v", login[0], err)
+		}
+	}
+	if err := store.CreateUser("kaese", "correct horse"); err != ErrUserExists {
+		t.Errorf("expected the user to exist, got %v", err)
+	}
+
+	// Failing to save is not the fault of the user
+	unsaved, err := NewHtpasswdStore(UsersConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := unsaved.CreateUser("cheese", "correct horse"); err == nil || errors.As(err, &invalid) {
+		t.Errorf("expected an error that is not about the user, got %v", err)
+	}
+}
@@ -0,0 +1,145 @@
+package cache
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/Kaese72/sdup-lib/sduptemplates"
+	"github.com/Kaese72/sdup-rest/faults"
+)
+
+// Types of capability arguments, named like the attribute states
+const (
+	ArgumentBoolean = "boolean"
+	ArgumentNumeric = "numeric"
+	ArgumentString  = "string"
+)
+
+// ArgumentSpec declares a single capability argument
+type ArgumentSpec struct {
+	Type     string `json:"type"`
+	Required bool   `json:"required"`
+	// Min and Max optionally bound numeric arguments
+	Min *float64 `json:"min,omitempty"`
+	Max *float64 `json:"max,omitempty"`
+	// Enum optionally lists the values a string argument may have
+	Enum []string `json:"enum,omitempty"`
+}
+
+// ArgumentSchema declares every argument a capability accepts, by argument name
+type ArgumentSchema map[string]ArgumentSpec
+
+// ArgumentsConfig declares the arguments of capabilities by capability key.
+// SDUP targets do not describe the arguments of their capabilities, so they are declared here.
+// Arguments of capabilities that are not declared are passed on unchecked.
+type ArgumentsConfig map[sduptemplates.CapabilityKey]ArgumentSchema
+
+func (conf *ArgumentsConfig) PopulateExample() {
+	min, max := 0.0, 100.0
+	*conf = ArgumentsConfig{
+		"activate":   ArgumentSchema{},
+		"deactivate": ArgumentSchema{},
+		"setbrightness": ArgumentSchema{
+			"brightness": ArgumentSpec{Type: ArgumentNumeric, Required: true, Min: &min, Max: &max},
+		},
+	}
+}
+
+func (conf ArgumentsConfig) Validate() error {
+	for capKey, schema := range conf {
+		for name, spec := range schema {
+			switch spec.Type {
+			case ArgumentBoolean, ArgumentNumeric, ArgumentString:
+			default:
+				return fmt.Errorf("argument '%s' of capability '%s' has unknown type '%s'", name, capKey, spec.Type)
+			}
+			if (spec.Min != nil || spec.Max != nil) && spec.Type != ArgumentNumeric {
+				return fmt.Errorf("argument '%s' of capability '%s' may only have min and max if numeric", name, capKey)
+			}
+			if len(spec.Enum) > 0 && spec.Type != ArgumentString {
+				return fmt.Errorf("argument '%s' of capability '%s' may only have enum if string", name, capKey)
+			}
+		}
+	}
+	return nil
+}
+
+// check returns what is wrong with an argument value, or an empty string if nothing is
+func (spec ArgumentSpec) check(value interface{}) string {
+	switch spec.Type {
+	case ArgumentBoolean:
+		if _, ok := value.(bool); !ok {
+			return "must be a boolean"
+		}
+	case ArgumentNumeric:
+		number, ok := value.(float64)
+		if !ok || math.IsNaN(number) {
+			return "must be a number"
+		}
+		if spec.Min != nil && number < *spec.Min {
+			return fmt.Sprintf("must be at least %g", *spec.Min)
+		}
+		if spec.Max != nil && number > *spec.Max {
+			return fmt.Sprintf("must be at most %g", *spec.Max)
+		}
+	case ArgumentString:
+		text, ok := value.(string)
+		if !ok {
+			return "must be a string"
+		}
+		if len(spec.Enum) > 0 && !spec.enumerates(text) {
+			return fmt.Sprintf("must be one of %s", strings.Join(spec.Enum, ", "))
+		}
+	}
+	return ""
+}
+
+// enumerates tells whether a string argument may have the value
+func (spec ArgumentSpec) enumerates(value string) bool {
+	for _, candidate := range spec.Enum {
+		if candidate == value {
+			return true
+		}
+	}
+	return false
+}
+
+// validate checks the arguments of a trigger against the declared schema, explaining every argument that is wrong
+func (conf ArgumentsConfig) validate(capKey sduptemplates.CapabilityKey, capArg sduptemplates.CapabilityArgument) error {
+	schema, ok := conf[capKey]
+	if !ok {
+		return nil
+	}
+	fields := map[string]string{}
+	for name, spec := range schema {
+		value, ok := capArg[name]
+		if !ok || value == nil {
+			if spec.Required {
+				fields[name] = "is required"
+			}
+			continue
+		}
+		if problem := spec.check(value); problem != "" {
+			fields[name] = problem
+		}
+	}
+	for name := range capArg {
+		if _, ok := schema[name]; !ok {
+			fields[name] = "is not an argument of this capability"
+		}
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+	names := []string{}
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return faults.ErrValidation{
+		Message: fmt.Sprintf("Invalid arguments to capability '%s': %s", capKey, strings.Join(names, ", ")),
+		Fields:  fields,
+	}
+}
@@ -0,0 +1,79 @@
+package cache
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/Kaese72/sdup-lib/sduptemplates"
+	"github.com/Kaese72/sdup-rest/faults"
+)
+
+func TestArgumentsConfigValidate(t *testing.T) {
+	min := 0.0
+	for _, test := range []struct {
+		name  string
+		spec  ArgumentSpec
+		fails bool
+	}{
+		{"boolean", ArgumentSpec{Type: ArgumentBoolean}, false},
+		{"bounded number", ArgumentSpec{Type: ArgumentNumeric, Min: &min}, false},
+		{"enumerated string", ArgumentSpec{Type: ArgumentString, Enum: []string{"a"}}, false},
+		{"unknown type", ArgumentSpec{Type: "colour"}, true},
+		{"bounded string", ArgumentSpec{Type: ArgumentString, Min: &min}, true},
+		{"enumerated number", ArgumentSpec{Type: ArgumentNumeric, Enum: []string{"a"}}, true},
+	} {
+		conf := ArgumentsConfig{"cap": ArgumentSchema{"arg": test.spec}}
+		if err := conf.Validate(); (err != nil) != test.fails {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+		}
+	}
+}
+
+func TestArgumentsConfigValidatesArguments(t *testing.T) {
+	min, max := 0.0, 100.0
+	conf := ArgumentsConfig{
+		"set": ArgumentSchema{
+			"level":  ArgumentSpec{Type: ArgumentNumeric, Required: true, Min: &min, Max: &max},
+			"on":     ArgumentSpec{Type: ArgumentBoolean},
+			"effect": ArgumentSpec{Type: ArgumentString, Enum: []string{"fade", "flash"}},
+		},
+	}
+	for _, test := range []struct {
+		name   string
+		capKey sduptemplates.CapabilityKey
+		args   sduptemplates.CapabilityArgument
+		fields map[string]string
+	}{
+		{"valid", "set", sduptemplates.CapabilityArgument{"level": 50.0, "on": true, "effect": "fade"}, nil},
+		{"bounds are inclusive", "set", sduptemplates.CapabilityArgument{"level": 100.0}, nil},
+		{"undeclared capability", "other", sduptemplates.CapabilityArgument{"anything": "goes"}, nil},
+		{"missing required", "set", sduptemplates.CapabilityArgument{"on": true}, map[string]string{"level": "is required"}},
+		{"null required", "set", sduptemplates.CapabilityArgument{"level": nil}, map[string]string{"level": "is required"}},
+		{"wrong types", "set", sduptemplates.CapabilityArgument{"level": "50", "on": "yes", "effect": 1.0}, map[string]string{
+			"level":  "must be a number",
+			"on":     "must be a boolean",
+			"effect": "must be a string",
+		}},
+		{"below min", "set", sduptemplates.CapabilityArgument{"level": -1.0}, map[string]string{"level": "must be at least 0"}},
+		{"above max", "set", sduptemplates.CapabilityArgument{"level": 100.5}, map[string]string{"level": "must be at most 100"}},
+		{"not enumerated", "set", sduptemplates.CapabilityArgument{"level": 1.0, "effect": "spin"}, map[string]string{"effect": "must be one of fade, flash"}},
+		{"unknown key", "set", sduptemplates.CapabilityArgument{"level": 1.0, "colour": "red"}, map[string]string{"colour": "is not an argument of this capability"}},
+	} {
+		err := conf.validate(test.capKey, test.args)
+		if test.fields == nil {
+			if err != nil {
+				t.Errorf("%s: unexpected error %v", test.name, err)
+			}
+			continue
+		}
+		var validation faults.ErrValidation
+		if !errors.As(err, &validation) {
+			t.Errorf("%s: expected a validation fault, got %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(validation.Fields, test.fields) {
+			t.Errorf("%s: expected fields %v, got %v", test.name, test.fields, validation.Fields)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package cache
+
+import (
+	"errors"
+
+	"github.com/Kaese72/sdup-lib/sduptemplates"
+	"github.com/Kaese72/sdup-rest/cache/filters"
+	"github.com/Kaese72/sdup-rest/faults"
+)
+
+// Authorizer decides what a caller may do with the cache
+type Authorizer interface {
+	CanReadDevice(sduptemplates.DeviceID) bool
+	CanTriggerCapability(sduptemplates.DeviceID, sduptemplates.CapabilityKey) bool
+}
+
+// AuthorizedCache is a view of a cache limited by an Authorizer.
+// Devices the caller may not read behave as if they do not exist.
+type AuthorizedCache struct {
+	cache      SDUPCache
+	authorizer Authorizer
+}
+
+func NewAuthorizedCache(cache SDUPCache, authorizer Authorizer) SDUPCache {
+	return AuthorizedCache{cache: cache, authorizer: authorizer}
+}
+
+func (cache AuthorizedCache) Initialize() ([]sduptemplates.DeviceSpec, chan sduptemplates.DeviceUpdate, error) {
+	return nil, nil, errors.New("an authorized cache can not be initialized")
+}
+
+func (cache AuthorizedCache) Device(deviceID sduptemplates.DeviceID) (sduptemplates.DeviceSpec, error) {
+	if !cache.authorizer.CanReadDevice(deviceID) {
+		return sduptemplates.DeviceSpec{}, faults.ErrEntityNotFound{ID: deviceID, EntityType: faults.ETDevice}
+	}
+	return cache.cache.Device(deviceID)
+}
+
+func (cache AuthorizedCache) Devices(attrFilters filters.AttributeFilters) ([]sduptemplates.DeviceSpec, error) {
+	devices, err := cache.cache.Devices(attrFilters)
+	if err != nil {
+		return nil, err
+	}
+	allowed := []sduptemplates.DeviceSpec{}
+	for _, device := range devices {
+		if cache.authorizer.CanReadDevice(device.ID) {
+			allowed = append(allowed, device)
+		}
+	}
+	return allowed, nil
+}
+
+func (cache AuthorizedCache) TriggerCapability(deviceID sduptemplates.DeviceID, capKey sduptemplates.CapabilityKey, capArg sduptemplates.CapabilityArgument) error {
+	if !cache.authorizer.CanReadDevice(deviceID) {
+		return faults.ErrEntityNotFound{ID: deviceID, EntityType: faults.ETDevice}
+	}
+	if !cache.authorizer.CanTriggerCapability(deviceID, capKey) {
+		return faults.ErrForbidden{Action: "trigger capability " + string(capKey)}
+	}
+	return cache.cache.TriggerCapability(deviceID, capKey, capArg)
+}
+
+// Auditor is implemented by caches that can record triggers made through views of them, see auth.AuthorizedCache
+type Auditor interface {
+	AuditAs(view SDUPCache, principal, method string) SDUPCache
+}
@@ -1,8 +1,8 @@
 package cache
 
 import (
-	"errors"
 	"fmt"
+	"sync"
 
 	log "github.com/Kaese72/sdup-lib/logging"
 	"github.com/Kaese72/sdup-lib/sduptemplates"
@@ -36,13 +36,33 @@ type DeviceStore interface {
 	InsertDevice(sduptemplates.DeviceSpec) error
 }
 
+// DeviceStoreImpl is safe for concurrent use. Devices are copied in and out, so callers never share maps with the store
 type DeviceStoreImpl struct {
+	lock    sync.RWMutex
 	devices map[sduptemplates.DeviceID]sduptemplates.DeviceSpec
 }
 
+// copyDevice copies the attribute and capability maps of a device.
+// Attribute states are replaced on update, never modified, so they can be shared.
+func copyDevice(device sduptemplates.DeviceSpec) sduptemplates.DeviceSpec {
+	attributes := make(sduptemplates.AttributeSpecMap, len(device.Attributes))
+	for key, attribute := range device.Attributes {
+		attributes[key] = attribute
+	}
+	capabilities := make(sduptemplates.CapabilitySpecMap, len(device.Capabilities))
+	for key, capability := range device.Capabilities {
+		capabilities[key] = capability
+	}
+	device.Attributes = attributes
+	device.Capabilities = capabilities
+	return device
+}
+
 func (store *DeviceStoreImpl) Device(deviceID sduptemplates.DeviceID) (spec sduptemplates.DeviceSpec, err error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
 	if device, ok := store.devices[deviceID]; ok {
-		spec = device
+		spec = copyDevice(device)
 
 	} else {
 		err = sduptemplates.NoSuchDevice
@@ -50,17 +70,19 @@ func (store *DeviceStoreImpl) Device(deviceID sduptemplates.DeviceID) (spec sdup
 	return
 }
 
-func deviceMatchesFilters(device sduptemplates.DeviceSpec, filters filters.AttributeFilters) (match bool, err error) {
+// DeviceMatchesFilters reports whether device satisfies every filter in filters.
+// Filters that can not be evaluated are validation faults
+func DeviceMatchesFilters(device sduptemplates.DeviceSpec, filters filters.AttributeFilters) (match bool, err error) {
 	for _, filter := range filters {
 		operator, err := filter.GetOperator()
 		if err != nil {
 			// Invalid operators lead to wacky scenarios
-			return false, err
+			return false, faults.ErrValidation{Message: err.Error()}
 		}
 
 		if _, _, err := filter.Key.KeyValKeys(); err == nil {
 			// Composite key, we should use keyval
-			return false, errors.New("keyval currently not supported")
+			return false, faults.ErrValidation{Message: "keyval currently not supported"}
 
 		} else {
 			if _, ok := device.Attributes[sduptemplates.AttributeKey(filter.Key)]; !ok {
@@ -69,22 +91,32 @@ func deviceMatchesFilters(device sduptemplates.DeviceSpec, filters filters.Attri
 			}
 			// Simple key
 			// Get value based on what type the comparator is
+			attrState := device.Attributes[sduptemplates.AttributeKey(filter.Key)].AttributeState
+			var matched bool
+			var matchErr error
 			switch comp := filter.Value.(type) {
 			case int:
-				return matchNumericComparison(device.Attributes[sduptemplates.AttributeKey(filter.Key)].AttributeState.Numeric, float32(comp), operator)
+				matched, matchErr = matchNumericComparison(attrState.Numeric, float32(comp), operator)
 
 			case float32:
-				return matchNumericComparison(device.Attributes[sduptemplates.AttributeKey(filter.Key)].AttributeState.Numeric, comp, operator)
+				matched, matchErr = matchNumericComparison(attrState.Numeric, comp, operator)
+
+			case float64:
+				// Numbers decoded from JSON
+				matched, matchErr = matchNumericComparison(attrState.Numeric, float32(comp), operator)
 
 			case string:
-				return matchStringComparison(device.Attributes[sduptemplates.AttributeKey(filter.Key)].AttributeState.Text, comp, operator)
+				matched, matchErr = matchStringComparison(attrState.Text, comp, operator)
 
 			case bool:
-				return matchBooleanComparison(device.Attributes[sduptemplates.AttributeKey(filter.Key)].AttributeState.Boolean, comp, operator)
+				matched, matchErr = matchBooleanComparison(attrState.Boolean, comp, operator)
 
 			default:
 				// FIXME log better
-				return false, errors.New("unsupported filter type")
+				return false, faults.ErrValidation{Message: "unsupported filter type"}
+			}
+			if matchErr != nil || !matched {
+				return false, matchErr
 			}
 		}
 
@@ -102,7 +134,7 @@ func matchBooleanComparison(attrVal *bool, compVal bool, operator filters.Operat
 	case filters.Equal:
 		return *attrVal == compVal, nil
 	default:
-		return false, errors.New("not a supported operand")
+		return false, faults.ErrValidation{Message: "not a supported operand"}
 	}
 }
 
@@ -116,7 +148,7 @@ func matchStringComparison(attrVal *string, compVal string, operator filters.Ope
 	case filters.Equal:
 		return *attrVal == compVal, nil
 	default:
-		return false, errors.New("not a supported operand")
+		return false, faults.ErrValidation{Message: "not a supported operand"}
 	}
 }
 
@@ -130,45 +162,51 @@ func matchNumericComparison(attrVal *float32, compVal float32, operator filters.
 	case filters.Equal:
 		return *attrVal == compVal, nil
 	default:
-		return false, errors.New("not a supported operand")
+		return false, faults.ErrValidation{Message: "not a supported operand"}
 	}
 }
 
 func (store *DeviceStoreImpl) Devices(attrFilters filters.AttributeFilters) ([]sduptemplates.DeviceSpec, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
 	specs := []sduptemplates.DeviceSpec{}
 	for _, device := range store.devices {
-		match, err := deviceMatchesFilters(device, attrFilters)
+		match, err := DeviceMatchesFilters(device, attrFilters)
 		if err != nil {
 			return nil, err
 		}
 
 		if match {
-			specs = append(specs, device)
+			specs = append(specs, copyDevice(device))
 		}
 	}
 	return specs, nil
 }
 
+// UpdateDevice applies every known attribute of an update, returning NoSuchAttribute if any were unknown
 func (store *DeviceStoreImpl) UpdateDevice(update sduptemplates.DeviceUpdate) error {
-	if device, ok := store.devices[update.ID]; ok {
-		for attrKey, attrChange := range update.AttributesDiff {
-			if attr, ok := device.Attributes[attrKey]; ok {
-				attr.AttributeState = attrChange
-				device.Attributes[attrKey] = attr
-			} else {
-				return sduptemplates.NoSuchAttribute
-			}
-		}
-		store.devices[update.ID] = device
-
-	} else {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	device, ok := store.devices[update.ID]
+	if !ok {
 		return sduptemplates.NoSuchDevice
 	}
-	return nil
+	var err error
+	for attrKey, attrChange := range update.AttributesDiff {
+		if attr, ok := device.Attributes[attrKey]; ok {
+			attr.AttributeState = attrChange
+			device.Attributes[attrKey] = attr
+		} else {
+			err = sduptemplates.NoSuchAttribute
+		}
+	}
+	return err
 }
 
 func (store *DeviceStoreImpl) InsertDevice(spec sduptemplates.DeviceSpec) error {
-	store.devices[spec.ID] = spec
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	store.devices[spec.ID] = copyDevice(spec)
 	return nil
 }
 
@@ -177,11 +215,13 @@ type SDUPCacheImpl struct {
 	devices     DeviceStore
 	updateChan  chan sduptemplates.DeviceUpdate
 	initialized bool
+	arguments   ArgumentsConfig
 }
 
-func NewSDUPCache(target sduptemplates.SDUPTarget) SDUPCache {
+func NewSDUPCache(target sduptemplates.SDUPTarget, arguments ArgumentsConfig) SDUPCache {
 	return &SDUPCacheImpl{
 		target:     target,
+		arguments:  arguments,
 		devices:    &DeviceStoreImpl{devices: map[sduptemplates.DeviceID]sduptemplates.DeviceSpec{}},
 		updateChan: make(chan sduptemplates.DeviceUpdate, 10),
 	}
@@ -204,22 +244,12 @@ func (cache *SDUPCacheImpl) Initialize() (specs []sduptemplates.DeviceSpec, chan
 	go func() {
 		for update := range upstreamChan {
 			log.Info(fmt.Sprintf("Received update on device %s", string(update.ID)))
-			//FIXME Lock cache writes
 			//FIXME Handle detection of devices first
-			if device, err := cache.devices.Device(update.ID); err == nil {
-				for attrKey, attrState := range update.AttributesDiff {
-					if attrValue, ok := device.Attributes[attrKey]; ok {
-						attrValue.AttributeState = attrState
-						device.Attributes[attrKey] = attrValue
-
-					} else {
-						log.Error("Unknown device attribute", map[string]string{"device": string(update.ID), "attribute": string(attrKey)})
-					}
-
-				}
-				cache.devices.InsertDevice(device)
-
-			} else {
+			switch err := cache.devices.UpdateDevice(update); err {
+			case nil:
+			case sduptemplates.NoSuchAttribute:
+				log.Error("Unknown device attribute", map[string]string{"device": string(update.ID)})
+			default:
 				//FIXME Create device events
 				log.Error("Unknown device", map[string]string{"device": string(update.ID)})
 			}
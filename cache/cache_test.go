@@ -0,0 +1,138 @@
+package cache
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/Kaese72/sdup-lib/sduptemplates"
+	"github.com/Kaese72/sdup-rest/cache/filters"
+	"github.com/Kaese72/sdup-rest/faults"
+	"github.com/Kaese72/sdup-rest/internal/sduptest"
+)
+
+func TestCacheConcurrentReadsAndUpdates(t *testing.T) {
+	target := sduptest.NewTarget(sduptest.Device("lamp", "active", false), sduptest.Device("other", "active", false))
+	sdupCache := NewSDUPCache(target, nil)
+	_, updates, err := sdupCache.Initialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const updateCount = 200
+	done := make(chan struct{})
+	var readers sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if _, err := sdupCache.Device("lamp"); err != nil {
+					t.Error(err)
+					return
+				}
+				// Callers own what they are given
+				other, err := sdupCache.Device("other")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				other.Attributes["active"] = sduptemplates.AttributeSpec{AttributeState: sduptest.BoolState(true)}
+				if _, err := sdupCache.Devices(filters.AttributeFilters{{Key: "active", Operator: filters.Equal, Value: true}}); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+
+	go func() {
+		for i := 0; i < updateCount; i++ {
+			target.Updates <- sduptest.BoolUpdate("lamp", "active", i%2 == 1)
+		}
+	}()
+	for i := 0; i < updateCount; i++ {
+		<-updates
+	}
+	close(done)
+	readers.Wait()
+
+	device, err := sdupCache.Device("lamp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if active := *device.Attributes["active"].Boolean; active != true {
+		t.Errorf("expected the last update to be applied, got active=%v", active)
+	}
+	other, _ := sdupCache.Device("other")
+	if active := *other.Attributes["active"].Boolean; active {
+		t.Error("changes made to a returned device leaked into the cache")
+	}
+}
+
+func TestDeviceMatchesFilters(t *testing.T) {
+	level := float32(3)
+	device := sduptemplates.DeviceSpec{
+		ID: "lamp",
+		Attributes: sduptemplates.AttributeSpecMap{
+			"a":     {AttributeState: sduptest.BoolState(true)},
+			"b":     {AttributeState: sduptest.BoolState(false)},
+			"level": {AttributeState: sduptemplates.AttributeState{Numeric: &level}},
+		},
+	}
+	for _, test := range []struct {
+		name     string
+		filters  filters.AttributeFilters
+		expected bool
+		fails    bool
+	}{
+		{"no filters", filters.AttributeFilters{}, true, false},
+		{"single match", filters.AttributeFilters{{Key: "a", Operator: filters.Equal, Value: true}}, true, false},
+		{"single mismatch", filters.AttributeFilters{{Key: "b", Operator: filters.Equal, Value: true}}, false, false},
+		{"every filter matches", filters.AttributeFilters{{Key: "a", Operator: filters.Equal, Value: true}, {Key: "b", Operator: filters.Equal, Value: false}}, true, false},
+		{"first matches, second does not", filters.AttributeFilters{{Key: "a", Operator: filters.Equal, Value: true}, {Key: "b", Operator: filters.Equal, Value: true}}, false, false},
+		{"first does not match, second does", filters.AttributeFilters{{Key: "b", Operator: filters.Equal, Value: true}, {Key: "a", Operator: filters.Equal, Value: true}}, false, false},
+		{"missing attribute", filters.AttributeFilters{{Key: "missing", Operator: filters.Equal, Value: true}}, false, false},
+		{"int", filters.AttributeFilters{{Key: "level", Operator: filters.Equal, Value: 3}}, true, false},
+		{"JSON number", filters.AttributeFilters{{Key: "level", Operator: filters.Equal, Value: float64(3)}}, true, false},
+		{"unsupported type", filters.AttributeFilters{{Key: "a", Operator: filters.Equal, Value: []string{}}}, false, true},
+		{"unsupported operand", filters.AttributeFilters{{Key: "a", Operator: filters.LessThan, Value: true}}, false, true},
+	} {
+		match, err := DeviceMatchesFilters(device, test.filters)
+		if (err != nil) != test.fails {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+			continue
+		}
+		// Filters are given by clients, so they are told what is wrong with them
+		var validation faults.ErrValidation
+		if err != nil && !errors.As(err, &validation) {
+			t.Errorf("%s: expected a validation fault, got %v", test.name, err)
+		}
+		if match != test.expected {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, match)
+		}
+	}
+}
+
+func TestDevicesAppliesEveryFilter(t *testing.T) {
+	sdupCache := NewSDUPCache(sduptest.NewTarget(sduptest.Device("lamp", "active", false), sduptest.Device("other", "active", true)), nil)
+	if _, _, err := sdupCache.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	// Only the first filter used to decide whether a device was returned
+	devices, err := sdupCache.Devices(filters.AttributeFilters{
+		{Key: "active", Operator: filters.Equal, Value: true},
+		{Key: "active", Operator: filters.Equal, Value: false},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 0 {
+		t.Errorf("expected no device to match contradicting filters, got %d", len(devices))
+	}
+}
@@ -1,7 +1,22 @@
 package cache
 
-import "github.com/Kaese72/sdup-lib/sduptemplates"
+import (
+	"github.com/Kaese72/sdup-lib/sduptemplates"
+	"github.com/Kaese72/sdup-rest/faults"
+)
 
+// TriggerCapability checks the trigger against what is known of the device before passing it on to the target
 func (cache SDUPCacheImpl) TriggerCapability(deviceID sduptemplates.DeviceID, capKey sduptemplates.CapabilityKey, capArg sduptemplates.CapabilityArgument) error {
-	return cache.target.TriggerCapability(deviceID, capKey, capArg)
+	device, err := cache.devices.Device(deviceID)
+	if err != nil {
+		return faults.ErrEntityNotFound{ID: deviceID, EntityType: faults.ETDevice}
+	}
+	if _, ok := device.Capabilities[capKey]; !ok {
+		return faults.ErrEntityNotFound{ID: deviceID, EntityType: faults.ETCapability, Key: string(capKey)}
+	}
+	if err := cache.arguments.validate(capKey, capArg); err != nil {
+		return err
+	}
+	err = cache.target.TriggerCapability(deviceID, capKey, capArg)
+	return faults.FromUpstream(err, deviceID, capKey)
 }
@@ -3,11 +3,27 @@ package config
 import (
 	"github.com/Kaese72/sdup-lib/httpsdup"
 	sdupclientconfig "github.com/Kaese72/sdup-lib/sdupclient/config"
+	"github.com/Kaese72/sdup-rest/audit"
+	"github.com/Kaese72/sdup-rest/auth"
+	"github.com/Kaese72/sdup-rest/cache"
+	"github.com/Kaese72/sdup-rest/grpcsdup"
+	"github.com/Kaese72/sdup-rest/mqttsdup"
+	"github.com/Kaese72/sdup-rest/ratelimit"
+	"github.com/Kaese72/sdup-rest/rest"
+	"github.com/Kaese72/sdup-rest/webhooks"
 )
 
 type Config struct {
 	SDUPClientConfig sdupclientconfig.Config `json:"sdup-client"`
 	SDUPServerConfig httpsdup.Config         `json:"sdup-server"`
+	TLSConfig        rest.TLSConfig          `json:"tls"`
+	GRPCServerConfig grpcsdup.Config         `json:"grpc-server"`
+	MQTTConfig       mqttsdup.Config         `json:"mqtt"`
+	WebhooksConfig   webhooks.Config         `json:"webhooks"`
+	AuthConfig       auth.Config             `json:"auth"`
+	AuditConfig      audit.Config            `json:"audit"`
+	RateLimitConfig  ratelimit.Config        `json:"rate-limits"`
+	ArgumentsConfig  cache.ArgumentsConfig   `json:"capability-arguments"`
 }
 
 func (conf *Config) PopulateExample() {
@@ -16,6 +32,30 @@ func (conf *Config) PopulateExample() {
 
 	conf.SDUPServerConfig = httpsdup.Config{}
 	conf.SDUPServerConfig.PopulateExample()
+
+	conf.TLSConfig = rest.TLSConfig{}
+	conf.TLSConfig.PopulateExample()
+
+	conf.GRPCServerConfig = grpcsdup.Config{}
+	conf.GRPCServerConfig.PopulateExample()
+
+	conf.MQTTConfig = mqttsdup.Config{}
+	conf.MQTTConfig.PopulateExample()
+
+	conf.WebhooksConfig = webhooks.Config{}
+	conf.WebhooksConfig.PopulateExample()
+
+	conf.AuthConfig = auth.Config{}
+	conf.AuthConfig.PopulateExample()
+
+	conf.AuditConfig = audit.Config{}
+	conf.AuditConfig.PopulateExample()
+
+	conf.RateLimitConfig = ratelimit.Config{}
+	conf.RateLimitConfig.PopulateExample()
+
+	conf.ArgumentsConfig = cache.ArgumentsConfig{}
+	conf.ArgumentsConfig.PopulateExample()
 }
 
 func (conf Config) Validate() error {
@@ -25,5 +65,29 @@ func (conf Config) Validate() error {
 	if err := conf.SDUPServerConfig.Validate(); err != nil {
 		return err
 	}
+	if err := conf.TLSConfig.Validate(); err != nil {
+		return err
+	}
+	if err := conf.GRPCServerConfig.Validate(); err != nil {
+		return err
+	}
+	if err := conf.MQTTConfig.Validate(); err != nil {
+		return err
+	}
+	if err := conf.WebhooksConfig.Validate(); err != nil {
+		return err
+	}
+	if err := conf.AuthConfig.Validate(); err != nil {
+		return err
+	}
+	if err := conf.AuditConfig.Validate(); err != nil {
+		return err
+	}
+	if err := conf.RateLimitConfig.Validate(); err != nil {
+		return err
+	}
+	if err := conf.ArgumentsConfig.Validate(); err != nil {
+		return err
+	}
 	return nil
 }
@@ -2,6 +2,7 @@ package faults
 
 import (
 	"fmt"
+	"net/http"
 
 	"github.com/Kaese72/sdup-lib/sduptemplates"
 )
@@ -14,11 +15,48 @@ const (
 	ETCapability EntityType = "Capability"
 )
 
+// ErrEntityNotFound is a device, or an attribute or capability of a device, that does not exist
 type ErrEntityNotFound struct {
 	ID         sduptemplates.DeviceID
 	EntityType EntityType
+	// Key names the attribute or capability of the device that was not found
+	Key string
 }
 
 func (err ErrEntityNotFound) Error() string {
+	if err.Key != "" {
+		return fmt.Sprintf("Could not find '%s' with key='%s' on device with ID='%s'", err.EntityType, err.Key, err.ID)
+	}
 	return fmt.Sprintf("Could not find '%s' with ID='%s'", err.EntityType, err.ID)
 }
+
+func (err ErrEntityNotFound) Status() int {
+	return http.StatusNotFound
+}
+
+func (err ErrEntityNotFound) Code() string {
+	switch err.EntityType {
+	case ETAttribute:
+		return CodeAttributeNotFound
+	case ETCapability:
+		return CodeCapabilityNotFound
+	default:
+		return CodeDeviceNotFound
+	}
+}
+
+type ErrForbidden struct {
+	Action string
+}
+
+func (err ErrForbidden) Error() string {
+	return fmt.Sprintf("Not allowed to %s", err.Action)
+}
+
+func (err ErrForbidden) Status() int {
+	return http.StatusForbidden
+}
+
+func (err ErrForbidden) Code() string {
+	return CodeForbidden
+}
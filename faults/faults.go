@@ -0,0 +1,144 @@
+package faults
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+)
+
+// Codes identify kinds of errors to clients. They are part of the API and must not change
+const (
+	CodeDeviceNotFound       = "device-not-found"
+	CodeAttributeNotFound    = "attribute-not-found"
+	CodeCapabilityNotFound   = "capability-not-found"
+	CodeNotFound             = "not-found"
+	CodeMalformedRequest     = "malformed-request"
+	CodeValidationFailed     = "validation-failed"
+	CodeMethodNotAllowed     = "method-not-allowed"
+	CodeUnsupportedMediaType = "unsupported-media-type"
+	CodeUnauthorized         = "unauthorized"
+	CodeForbidden            = "forbidden"
+	CodeConflict             = "conflict"
+	CodeRateLimited          = "rate-limited"
+	CodeUpstreamUnavailable  = "upstream-unavailable"
+	CodeUpstreamTimeout      = "upstream-timeout"
+	CodeCapabilityFailed     = "capability-failed"
+	CodeWaitTimeout          = "wait-timeout"
+	CodeUpdatesStopped       = "updates-stopped"
+	CodeCancelled            = "cancelled"
+	CodeStreamingUnsupported = "streaming-unsupported"
+	CodeInternal             = "internal-error"
+)
+
+// Fault is an error that knows how it is presented to clients
+type Fault interface {
+	error
+	Status() int
+	Code() string
+}
+
+// ErrNotFound is anything but a device, attribute or capability that does not exist, such as a user or a webhook
+type ErrNotFound struct {
+	Err error
+}
+
+func (err ErrNotFound) Error() string { return err.Err.Error() }
+func (err ErrNotFound) Unwrap() error { return err.Err }
+func (err ErrNotFound) Status() int   { return http.StatusNotFound }
+func (err ErrNotFound) Code() string  { return CodeNotFound }
+
+// ErrMalformedRequest is a request that could not be parsed
+type ErrMalformedRequest struct {
+	Err error
+}
+
+func (err ErrMalformedRequest) Error() string { return err.Err.Error() }
+func (err ErrMalformedRequest) Unwrap() error { return err.Err }
+func (err ErrMalformedRequest) Status() int   { return http.StatusBadRequest }
+func (err ErrMalformedRequest) Code() string  { return CodeMalformedRequest }
+
+// ErrValidation is a well formed request with content that is not acceptable
+type ErrValidation struct {
+	Message string
+	// Fields optionally explains what is wrong with individual fields, by field name
+	Fields map[string]string
+}
+
+func (err ErrValidation) Error() string { return err.Message }
+func (err ErrValidation) Status() int   { return http.StatusUnprocessableEntity }
+func (err ErrValidation) Code() string  { return CodeValidationFailed }
+
+// ErrMethodNotAllowed is a request made with a method the resource does not accept for it
+type ErrMethodNotAllowed struct {
+	Err error
+	// Allow lists the methods that are accepted
+	Allow []string
+}
+
+func (err ErrMethodNotAllowed) Error() string { return err.Err.Error() }
+func (err ErrMethodNotAllowed) Unwrap() error { return err.Err }
+func (err ErrMethodNotAllowed) Status() int   { return http.StatusMethodNotAllowed }
+func (err ErrMethodNotAllowed) Code() string  { return CodeMethodNotAllowed }
+
+// ErrUnsupportedMediaType is a request body of a type that is not accepted
+type ErrUnsupportedMediaType struct {
+	Err error
+}
+
+func (err ErrUnsupportedMediaType) Error() string { return err.Err.Error() }
+func (err ErrUnsupportedMediaType) Unwrap() error { return err.Err }
+func (err ErrUnsupportedMediaType) Status() int   { return http.StatusUnsupportedMediaType }
+func (err ErrUnsupportedMediaType) Code() string  { return CodeUnsupportedMediaType }
+
+// ErrUnauthorized means no or invalid credentials were presented
+type ErrUnauthorized struct {
+	Err error
+}
+
+func (err ErrUnauthorized) Error() string { return err.Err.Error() }
+func (err ErrUnauthorized) Unwrap() error { return err.Err }
+func (err ErrUnauthorized) Status() int   { return http.StatusUnauthorized }
+func (err ErrUnauthorized) Code() string  { return CodeUnauthorized }
+
+// ErrConflict is a request that clashes with existing state, such as creating something that exists
+type ErrConflict struct {
+	Err error
+}
+
+func (err ErrConflict) Error() string { return err.Err.Error() }
+func (err ErrConflict) Unwrap() error { return err.Err }
+func (err ErrConflict) Status() int   { return http.StatusConflict }
+func (err ErrConflict) Code() string  { return CodeConflict }
+
+type ErrRateLimited struct {
+	RetryAfter time.Duration
+}
+
+func (err ErrRateLimited) Error() string {
+	return fmt.Sprintf("Too many requests, retry in %s", err.RetryAfter.Round(time.Second))
+}
+func (err ErrRateLimited) Status() int  { return http.StatusTooManyRequests }
+func (err ErrRateLimited) Code() string { return CodeRateLimited }
+
+func (err ErrRateLimited) retryAfterSeconds() string {
+	return fmt.Sprintf("%d", int(math.Ceil(err.RetryAfter.Seconds())))
+}
+
+// ErrUpstreamUnavailable means the SDUP target behind the cache could not be reached or did not respond.
+// Err may reveal where the target is, so it is logged rather than shown to clients, see FromUpstream
+type ErrUpstreamUnavailable struct {
+	Err error
+}
+
+func (err ErrUpstreamUnavailable) Error() string { return "Upstream unavailable" }
+func (err ErrUpstreamUnavailable) Unwrap() error { return err.Err }
+func (err ErrUpstreamUnavailable) Status() int   { return http.StatusServiceUnavailable }
+func (err ErrUpstreamUnavailable) Code() string  { return CodeUpstreamUnavailable }
+
+// ErrStreamingUnsupported means the connection can not stream, such as when a proxy or middleware buffers responses
+type ErrStreamingUnsupported struct{}
+
+func (err ErrStreamingUnsupported) Error() string { return "Streaming unsupported" }
+func (err ErrStreamingUnsupported) Status() int   { return http.StatusInternalServerError }
+func (err ErrStreamingUnsupported) Code() string  { return CodeStreamingUnsupported }
@@ -0,0 +1,94 @@
+package faults
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/Kaese72/sdup-lib/logging"
+)
+
+// ProblemContentType is the media type of problem details, RFC 7807
+const ProblemContentType = "application/problem+json"
+
+// problemTypePrefix makes problem types URIs. Clients should rely on the code rather than the type
+const problemTypePrefix = "urn:sdup-rest:problem:"
+
+// Problem is an error as described by RFC 7807, with the stable error code as an extension member
+type Problem struct {
+	Type     string            `json:"type"`
+	Title    string            `json:"title"`
+	Status   int               `json:"status"`
+	Detail   string            `json:"detail,omitempty"`
+	Instance string            `json:"instance,omitempty"`
+	Code     string            `json:"code"`
+	Fields   map[string]string `json:"fields,omitempty"`
+}
+
+// statusText also names the non-standard statuses used by faults
+func statusText(status int) string {
+	if status == StatusClientClosedRequest {
+		return "Client Closed Request"
+	}
+	return http.StatusText(status)
+}
+
+// internalDetail is all clients are told about errors that are not faults, which may reveal paths, addresses and the like
+const internalDetail = "An internal error occurred"
+
+// NewProblem describes an error. Errors that are not faults are internal errors, which are only logged
+func NewProblem(err error) Problem {
+	var fault Fault
+	if !errors.As(err, &fault) {
+		logging.Error("Internal error", map[string]string{"error": err.Error()})
+		return Problem{
+			Type:   problemTypePrefix + CodeInternal,
+			Title:  http.StatusText(http.StatusInternalServerError),
+			Status: http.StatusInternalServerError,
+			Detail: internalDetail,
+			Code:   CodeInternal,
+		}
+	}
+	problem := Problem{
+		Type:   problemTypePrefix + fault.Code(),
+		Title:  statusText(fault.Status()),
+		Status: fault.Status(),
+		Detail: fault.Error(),
+		Code:   fault.Code(),
+	}
+	var validation ErrValidation
+	if errors.As(err, &validation) {
+		problem.Fields = validation.Fields
+	}
+	return problem
+}
+
+// ServeProblem writes an error as problem details
+func ServeProblem(writer http.ResponseWriter, reader *http.Request, err error) {
+	problem := NewProblem(err)
+	problem.Instance = reader.URL.Path
+
+	var rateLimited ErrRateLimited
+	if errors.As(err, &rateLimited) {
+		writer.Header().Set("Retry-After", rateLimited.retryAfterSeconds())
+	}
+	var methodNotAllowed ErrMethodNotAllowed
+	if errors.As(err, &methodNotAllowed) {
+		writer.Header().Set("Allow", strings.Join(methodNotAllowed.Allow, ", "))
+	}
+	var unauthorized ErrUnauthorized
+	if errors.As(err, &unauthorized) {
+		writer.Header().Set("WWW-Authenticate", "Bearer")
+	}
+
+	jsonEncoded, jsonErr := json.Marshal(problem)
+	if jsonErr != nil {
+		http.Error(writer, problem.Detail, problem.Status)
+		return
+	}
+	writer.Header().Set("Content-Type", ProblemContentType)
+	writer.Header().Set("X-Content-Type-Options", "nosniff")
+	writer.WriteHeader(problem.Status)
+	writer.Write(jsonEncoded)
+}
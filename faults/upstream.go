@@ -0,0 +1,108 @@
+package faults
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/Kaese72/sdup-lib/logging"
+	"github.com/Kaese72/sdup-lib/sduptemplates"
+)
+
+// ErrUpstreamTimeout means the SDUP target did not respond in time. The capability may or may not have been triggered.
+// Like for ErrUpstreamUnavailable, Err is only logged
+type ErrUpstreamTimeout struct {
+	Err error
+}
+
+func (err ErrUpstreamTimeout) Error() string { return "Upstream timed out" }
+func (err ErrUpstreamTimeout) Unwrap() error { return err.Err }
+func (err ErrUpstreamTimeout) Status() int   { return http.StatusGatewayTimeout }
+func (err ErrUpstreamTimeout) Code() string  { return CodeUpstreamTimeout }
+
+// ErrCapabilityFailed means the SDUP target was reached but could not carry out a capability.
+// Like for ErrUpstreamUnavailable, Err is only logged
+type ErrCapabilityFailed struct {
+	ID  sduptemplates.DeviceID
+	Key sduptemplates.CapabilityKey
+	Err error
+}
+
+func (err ErrCapabilityFailed) Error() string {
+	return fmt.Sprintf("Capability '%s' of device with ID='%s' failed", err.Key, err.ID)
+}
+func (err ErrCapabilityFailed) Unwrap() error { return err.Err }
+func (err ErrCapabilityFailed) Status() int   { return http.StatusBadGateway }
+func (err ErrCapabilityFailed) Code() string  { return CodeCapabilityFailed }
+
+// ErrWaitTimeout means a capability was triggered, but the device was not seen reaching the expected state in time
+type ErrWaitTimeout struct {
+	ID      sduptemplates.DeviceID
+	Timeout time.Duration
+}
+
+func (err ErrWaitTimeout) Error() string {
+	return fmt.Sprintf("Device with ID='%s' did not reach the expected state within %s", err.ID, err.Timeout)
+}
+func (err ErrWaitTimeout) Status() int  { return http.StatusGatewayTimeout }
+func (err ErrWaitTimeout) Code() string { return CodeWaitTimeout }
+
+// ErrUpdatesStopped means a capability was triggered, but device updates stopped reaching the request before
+// the device reached the expected state. That happens to requests that fall behind the updates, so retrying may work
+type ErrUpdatesStopped struct {
+	ID sduptemplates.DeviceID
+}
+
+func (err ErrUpdatesStopped) Error() string {
+	return fmt.Sprintf("Updates of device with ID='%s' stopped while waiting for the expected state", err.ID)
+}
+func (err ErrUpdatesStopped) Status() int  { return http.StatusServiceUnavailable }
+func (err ErrUpdatesStopped) Code() string { return CodeUpdatesStopped }
+
+// StatusClientClosedRequest is not a standard status, but the one commonly used for requests abandoned by the client
+const StatusClientClosedRequest = 499
+
+// ErrCancelled means the work was not done because the request was abandoned, such as by the client disconnecting
+type ErrCancelled struct {
+	Err error
+}
+
+func (err ErrCancelled) Error() string {
+	return fmt.Sprintf("Cancelled: %s", err.Err.Error())
+}
+func (err ErrCancelled) Unwrap() error { return err.Err }
+func (err ErrCancelled) Status() int   { return StatusClientClosedRequest }
+func (err ErrCancelled) Code() string  { return CodeCancelled }
+
+// FromUpstream translates an error from the SDUP target into a fault, so that what clients see
+// does not depend on how the client library reports errors. Errors of the target itself are logged.
+func FromUpstream(err error, deviceID sduptemplates.DeviceID, capKey sduptemplates.CapabilityKey) error {
+	if err == nil {
+		return nil
+	}
+	var fault Fault
+	switch {
+	case errors.As(err, &fault):
+		return err
+	case errors.Is(err, sduptemplates.NoSuchDevice):
+		return ErrEntityNotFound{ID: deviceID, EntityType: ETDevice}
+	case errors.Is(err, sduptemplates.NoSuchAttribute):
+		return ErrEntityNotFound{ID: deviceID, EntityType: ETAttribute}
+	}
+
+	logging.Error("Upstream error", map[string]string{"device": string(deviceID), "capability": string(capKey), "error": err.Error()})
+	var netErr net.Error
+	var opErr *net.OpError
+	switch {
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return ErrUpstreamTimeout{Err: err}
+	case errors.As(err, &opErr):
+		// The target could not be connected to or the connection broke
+		return ErrUpstreamUnavailable{Err: err}
+	default:
+		return ErrCapabilityFailed{ID: deviceID, Key: capKey, Err: err}
+	}
+}
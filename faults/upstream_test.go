@@ -0,0 +1,34 @@
+package faults
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestFromUpstreamHidesCauses(t *testing.T) {
+	refused := &net.OpError{Op: "dial", Net: "tcp", Addr: &net.TCPAddr{IP: net.IPv4(10, 0, 0, 7), Port: 8080}, Err: errors.New("connection refused")}
+	for _, test := range []struct {
+		name   string
+		err    error
+		status int
+	}{
+		{"unavailable", refused, 503},
+		{"timeout", context.DeadlineExceeded, 504},
+		{"failed", errors.New("relay 3 at 10.0.0.7:8080 is stuck"), 502},
+	} {
+		fault := FromUpstream(test.err, "lamp", "activate")
+		if !errors.Is(fault, test.err) {
+			t.Errorf("%s: the cause is not wrapped", test.name)
+		}
+		problem := NewProblem(fault)
+		if problem.Status != test.status {
+			t.Errorf("%s: expected %d, got %d", test.name, test.status, problem.Status)
+		}
+		if strings.Contains(problem.Detail, "10.0.0.7") {
+			t.Errorf("%s: the detail reveals the target: %s", test.name, problem.Detail)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package graphqlsdup
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/Kaese72/sdup-lib/logging"
+	"github.com/Kaese72/sdup-rest/cache"
+	"github.com/Kaese72/sdup-rest/faults"
+	"github.com/Kaese72/sdup-rest/stream"
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/graphql-go/graphql/language/parser"
+)
+
+// requestBody is a GraphQL request as POSTed by clients
+type requestBody struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+// Handler serves GraphQL queries and mutations as JSON and subscriptions as server-sent events
+type Handler struct {
+	schema graphql.Schema
+}
+
+func NewHandler(sdupCache cache.SDUPCache, broker *stream.Broker) (*Handler, error) {
+	schema, err := NewSchema(sdupCache, broker)
+	if err != nil {
+		return nil, err
+	}
+	return &Handler{schema: schema}, nil
+}
+
+// parseRequest reads GET requests from the query string, which is how EventSource subscribes,
+// and anything else from a JSON body
+func parseRequest(reader *http.Request) (body requestBody, err error) {
+	if reader.Method == http.MethodGet {
+		query := reader.URL.Query()
+		body.Query = query.Get("query")
+		body.OperationName = query.Get("operationName")
+		if variables := query.Get("variables"); variables != "" {
+			if err = json.Unmarshal([]byte(variables), &body.Variables); err != nil {
+				err = faults.ErrMalformedRequest{Err: err}
+			}
+		}
+		if err == nil && containsMutation(body.Query) {
+			// Browsers make GET requests cross-site with cookies and client certificates, so they must not change anything
+			err = faults.ErrMethodNotAllowed{Err: errors.New("mutations must be POSTed"), Allow: []string{http.MethodPost}}
+		}
+		return
+	}
+	// Cross-site forms can only POST form and text bodies, requiring JSON keeps them from posting mutations
+	if mediaType, _, _ := mime.ParseMediaType(reader.Header.Get("Content-Type")); mediaType != "application/json" {
+		err = faults.ErrUnsupportedMediaType{Err: errors.New("GraphQL requests must be POSTed as application/json")}
+		return
+	}
+	if err = json.NewDecoder(reader.Body).Decode(&body); err != nil {
+		err = faults.ErrMalformedRequest{Err: err}
+	}
+	return
+}
+
+// containsMutation reports whether any operation of a query is a mutation. Queries that do not parse fail when executed
+func containsMutation(query string) bool {
+	document, err := parser.Parse(parser.ParseParams{Source: query})
+	if err != nil {
+		return false
+	}
+	for _, definition := range document.Definitions {
+		if operation, ok := definition.(*ast.OperationDefinition); ok && operation.Operation == ast.OperationTypeMutation {
+			return true
+		}
+	}
+	return false
+}
+
+func (handler *Handler) ServeHTTP(writer http.ResponseWriter, reader *http.Request) {
+	body, err := parseRequest(reader)
+	if err != nil {
+		faults.ServeProblem(writer, reader, err)
+		return
+	}
+	params := graphql.Params{
+		Schema:         handler.schema,
+		RequestString:  body.Query,
+		OperationName:  body.OperationName,
+		VariableValues: body.Variables,
+		Context:        reader.Context(),
+	}
+
+	if strings.Contains(reader.Header.Get("Accept"), "text/event-stream") {
+		handler.serveSubscription(writer, reader, params)
+		return
+	}
+
+	result := graphql.Do(params)
+	writer.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(writer).Encode(result); err != nil {
+		logging.Error("Failed to encode GraphQL result", map[string]string{"error": err.Error()})
+	}
+}
+
+// serveSubscription streams every result as a "next" event followed by a "complete" event when the subscription ends
+func (handler *Handler) serveSubscription(writer http.ResponseWriter, reader *http.Request, params graphql.Params) {
+	flusher, ok := writer.(http.Flusher)
+	if !ok {
+		faults.ServeProblem(writer, reader, faults.ErrStreamingUnsupported{})
+		return
+	}
+
+	writer.Header().Set("Content-Type", "text/event-stream")
+	writer.Header().Set("Cache-Control", "no-cache")
+	writer.Header().Set("Connection", "keep-alive")
+
+	results := graphql.Subscribe(params)
+	// The subscription only stops producing once the request context is done, drain it so it can finish
+	defer func() {
+		go func() {
+			for range results {
+			}
+		}()
+	}()
+
+	for result := range results {
+		jsonString, err := json.Marshal(result)
+		if err != nil {
+			logging.Error("Failed to encode GraphQL result", map[string]string{"error": err.Error()})
+			continue
+		}
+		if _, err := fmt.Fprintf(writer, "event: next\ndata: %s\n\n", jsonString); err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+	fmt.Fprint(writer, "event: complete\ndata:\n\n")
+	flusher.Flush()
+}
@@ -0,0 +1,133 @@
+package graphqlsdup
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/Kaese72/sdup-rest/auth"
+	"github.com/Kaese72/sdup-rest/cache"
+	"github.com/Kaese72/sdup-rest/internal/sduptest"
+	"github.com/Kaese72/sdup-rest/stream"
+)
+
+// graphqlResult is the JSON of a query or mutation result
+type graphqlResult struct {
+	Data   json.RawMessage `json:"data"`
+	Errors []struct {
+		Message string `json:"message"`
+	} `json:"errors"`
+}
+
+// newTestHandler serves a lamp and a safe to someone who may only see and trigger the lamp
+func newTestHandler(t *testing.T) (http.Handler, *sduptest.Target) {
+	target := sduptest.NewTarget(sduptest.Device("lamp", "active", false), sduptest.Device("safe", "open", false))
+	sdupCache := cache.NewSDUPCache(target, nil)
+	_, updates, err := sdupCache.Initialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler, err := NewHandler(sdupCache, stream.NewBroker(updates))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rbac := auth.RBACConfig{
+		Roles:     map[string]auth.RoleConfig{"lights": {Devices: []string{"lamp"}, Capabilities: []string{"activate"}}},
+		UserRoles: map[string][]string{"kaese": {"lights"}},
+	}
+	principal := rbac.UserPrincipal("kaese", auth.MethodToken)
+	return http.HandlerFunc(func(writer http.ResponseWriter, reader *http.Request) {
+		handler.ServeHTTP(writer, reader.WithContext(auth.WithPrincipal(reader.Context(), principal)))
+	}), target
+}
+
+func post(handler http.Handler, query string) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(requestBody{Query: query})
+	request := httptest.NewRequest("POST", "/rest/v0/graphql", strings.NewReader(string(body)))
+	request.Header.Set("Content-Type", "application/json")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func decodeResult(t *testing.T, recorder *httptest.ResponseRecorder) graphqlResult {
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+	var result graphqlResult
+	if err := json.NewDecoder(recorder.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+func TestQueryDevices(t *testing.T) {
+	handler, _ := newTestHandler(t)
+
+	result := decodeResult(t, post(handler, `{ devices { id attributes { key state { boolean } } capabilities { key } } }`))
+	if len(result.Errors) > 0 {
+		t.Fatalf("unexpected errors %+v", result.Errors)
+	}
+	expected := `{"devices":[{"attributes":[{"key":"active","state":{"boolean":false}}],"capabilities":[{"key":"activate"}],"id":"lamp"}]}`
+	if string(result.Data) != expected {
+		t.Errorf("expected only the lamp, got %s", result.Data)
+	}
+
+	result = decodeResult(t, post(handler, `{ device(id: "safe") { id } }`))
+	if len(result.Errors) == 0 {
+		t.Errorf("a device that may not be read was returned: %s", result.Data)
+	}
+}
+
+func TestMutationTriggersCapability(t *testing.T) {
+	handler, target := newTestHandler(t)
+
+	result := decodeResult(t, post(handler, `mutation { triggerCapability(deviceId: "lamp", capabilityKey: "activate") }`))
+	if len(result.Errors) > 0 || string(result.Data) != `{"triggerCapability":true}` {
+		t.Errorf("expected the lamp to be triggered, got %s %+v", result.Data, result.Errors)
+	}
+	result = decodeResult(t, post(handler, `mutation { triggerCapability(deviceId: "safe", capabilityKey: "activate") }`))
+	if len(result.Errors) == 0 {
+		t.Error("a capability that may not be triggered was triggered")
+	}
+	if triggered := target.Triggered(); len(triggered) != 1 || triggered[0] != "lamp" {
+		t.Errorf("expected only the lamp to be triggered, got %v", triggered)
+	}
+}
+
+func TestMutationsRequirePOSTedJSON(t *testing.T) {
+	handler, target := newTestHandler(t)
+
+	get := func(query string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/rest/v0/graphql?"+url.Values{"query": {query}}.Encode(), nil))
+		return recorder
+	}
+	if result := decodeResult(t, get(`{ devices { id } }`)); len(result.Errors) > 0 {
+		t.Errorf("queries should be allowed over GET, got %+v", result.Errors)
+	}
+	for _, query := range []string{
+		`mutation { triggerCapability(deviceId: "lamp", capabilityKey: "activate") }`,
+		`query q { devices { id } } mutation m { triggerCapability(deviceId: "lamp", capabilityKey: "activate") }`,
+	} {
+		recorder := get(query)
+		if recorder.Code != http.StatusMethodNotAllowed || recorder.Header().Get("Allow") != "POST" {
+			t.Errorf("expected a mutation over GET to be refused with 405, got %d", recorder.Code)
+		}
+	}
+
+	request := httptest.NewRequest("POST", "/rest/v0/graphql", strings.NewReader(`{"query": "mutation { triggerCapability(deviceId: \"lamp\", capabilityKey: \"activate\") }"}`))
+	request.Header.Set("Content-Type", "text/plain")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("expected a mutation posted as text to be refused with 415, got %d", recorder.Code)
+	}
+
+	if triggered := target.Triggered(); len(triggered) != 0 {
+		t.Errorf("refused mutations triggered %v", triggered)
+	}
+}
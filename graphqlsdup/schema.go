@@ -0,0 +1,380 @@
+package graphqlsdup
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+
+	"github.com/Kaese72/sdup-lib/sduptemplates"
+	"github.com/Kaese72/sdup-rest/auth"
+	"github.com/Kaese72/sdup-rest/cache"
+	"github.com/Kaese72/sdup-rest/cache/filters"
+	"github.com/Kaese72/sdup-rest/stream"
+	"github.com/graphql-go/graphql"
+)
+
+// maxPendingEvents is how many events a subscription may buffer for a slow client
+const maxPendingEvents = 64
+
+// attribute is a single entry of an attribute map, GraphQL has no notion of maps
+type attribute struct {
+	Key   sduptemplates.AttributeKey
+	State sduptemplates.AttributeState
+}
+
+// deviceEvent is the payload of the deviceEvents subscription
+type deviceEvent struct {
+	Type    stream.EventType
+	Devices []sduptemplates.DeviceSpec
+	Update  *sduptemplates.DeviceUpdate
+}
+
+// attributeList flattens an attribute map, optionally limited to the given keys
+func attributeList(states map[sduptemplates.AttributeKey]sduptemplates.AttributeState, keys []interface{}) []attribute {
+	wanted := map[sduptemplates.AttributeKey]bool{}
+	for _, key := range keys {
+		wanted[sduptemplates.AttributeKey(key.(string))] = true
+	}
+	attributes := []attribute{}
+	for key, state := range states {
+		if len(wanted) == 0 || wanted[key] {
+			attributes = append(attributes, attribute{Key: key, State: state})
+		}
+	}
+	sort.Slice(attributes, func(i, j int) bool { return attributes[i].Key < attributes[j].Key })
+	return attributes
+}
+
+func deviceAttributeStates(device sduptemplates.DeviceSpec) map[sduptemplates.AttributeKey]sduptemplates.AttributeState {
+	states := map[sduptemplates.AttributeKey]sduptemplates.AttributeState{}
+	for key, attr := range device.Attributes {
+		states[key] = attr.AttributeState
+	}
+	return states
+}
+
+// filtersFromArgs maps AttributeFilter input objects onto cache filters
+func filtersFromArgs(args map[string]interface{}) filters.AttributeFilters {
+	attrFilters := filters.AttributeFilters{}
+	list, _ := args["filters"].([]interface{})
+	for _, item := range list {
+		input := item.(map[string]interface{})
+		filter := filters.AttributeFilter{
+			Key:      filters.AttributeFilterKey(input["key"].(string)),
+			Operator: filters.Operator(input["operator"].(string)),
+		}
+		if value, ok := input["boolean"]; ok && value != nil {
+			filter.Value = value.(bool)
+		} else if value, ok := input["numeric"]; ok && value != nil {
+			filter.Value = float32(value.(float64))
+		} else if value, ok := input["text"]; ok && value != nil {
+			filter.Value = value.(string)
+		}
+		attrFilters = append(attrFilters, filter)
+	}
+	return attrFilters
+}
+
+var attributeStateType = graphql.NewObject(graphql.ObjectConfig{
+	Name: "AttributeState",
+	Fields: graphql.Fields{
+		"boolean": &graphql.Field{
+			Type: graphql.Boolean,
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				state := p.Source.(sduptemplates.AttributeState)
+				if state.Boolean == nil {
+					return nil, nil
+				}
+				return *state.Boolean, nil
+			},
+		},
+		"numeric": &graphql.Field{
+			Type: graphql.Float,
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				state := p.Source.(sduptemplates.AttributeState)
+				if state.Numeric == nil {
+					return nil, nil
+				}
+				return *state.Numeric, nil
+			},
+		},
+		"text": &graphql.Field{
+			Type: graphql.String,
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				state := p.Source.(sduptemplates.AttributeState)
+				if state.Text == nil {
+					return nil, nil
+				}
+				return *state.Text, nil
+			},
+		},
+	},
+})
+
+var attributeType = graphql.NewObject(graphql.ObjectConfig{
+	Name: "Attribute",
+	Fields: graphql.Fields{
+		"key": &graphql.Field{
+			Type: graphql.NewNonNull(graphql.String),
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return string(p.Source.(attribute).Key), nil
+			},
+		},
+		"state": &graphql.Field{
+			Type: graphql.NewNonNull(attributeStateType),
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return p.Source.(attribute).State, nil
+			},
+		},
+	},
+})
+
+var capabilityType = graphql.NewObject(graphql.ObjectConfig{
+	Name: "Capability",
+	Fields: graphql.Fields{
+		"key": &graphql.Field{
+			Type: graphql.NewNonNull(graphql.String),
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return string(p.Source.(sduptemplates.CapabilityKey)), nil
+			},
+		},
+	},
+})
+
+var attributeKeysArgument = &graphql.ArgumentConfig{
+	Type:        graphql.NewList(graphql.NewNonNull(graphql.String)),
+	Description: "Only return these attributes",
+}
+
+var deviceType = graphql.NewObject(graphql.ObjectConfig{
+	Name: "Device",
+	Fields: graphql.Fields{
+		"id": &graphql.Field{
+			Type: graphql.NewNonNull(graphql.ID),
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return string(p.Source.(sduptemplates.DeviceSpec).ID), nil
+			},
+		},
+		"attributes": &graphql.Field{
+			Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(attributeType))),
+			Args: graphql.FieldConfigArgument{"keys": attributeKeysArgument},
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				keys, _ := p.Args["keys"].([]interface{})
+				return attributeList(deviceAttributeStates(p.Source.(sduptemplates.DeviceSpec)), keys), nil
+			},
+		},
+		"capabilities": &graphql.Field{
+			Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(capabilityType))),
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				capabilities := []sduptemplates.CapabilityKey{}
+				for key := range p.Source.(sduptemplates.DeviceSpec).Capabilities {
+					capabilities = append(capabilities, key)
+				}
+				sort.Slice(capabilities, func(i, j int) bool { return capabilities[i] < capabilities[j] })
+				return capabilities, nil
+			},
+		},
+	},
+})
+
+var deviceUpdateType = graphql.NewObject(graphql.ObjectConfig{
+	Name: "DeviceUpdate",
+	Fields: graphql.Fields{
+		"id": &graphql.Field{
+			Type: graphql.NewNonNull(graphql.ID),
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return string(p.Source.(*sduptemplates.DeviceUpdate).ID), nil
+			},
+		},
+		"attributesDiff": &graphql.Field{
+			Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(attributeType))),
+			Args: graphql.FieldConfigArgument{"keys": attributeKeysArgument},
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				keys, _ := p.Args["keys"].([]interface{})
+				return attributeList(p.Source.(*sduptemplates.DeviceUpdate).AttributesDiff, keys), nil
+			},
+		},
+	},
+})
+
+var deviceEventType = graphql.NewObject(graphql.ObjectConfig{
+	Name: "DeviceEvent",
+	Fields: graphql.Fields{
+		"type": &graphql.Field{
+			Type:        graphql.NewNonNull(graphql.String),
+			Description: "One of snapshot, update, added and removed",
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return string(p.Source.(deviceEvent).Type), nil
+			},
+		},
+		"devices": &graphql.Field{
+			Type:        graphql.NewList(graphql.NewNonNull(deviceType)),
+			Description: "Set for snapshot and added events",
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return p.Source.(deviceEvent).Devices, nil
+			},
+		},
+		"update": &graphql.Field{
+			Type:        deviceUpdateType,
+			Description: "Set for update and removed events",
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				update := p.Source.(deviceEvent).Update
+				if update == nil {
+					return nil, nil
+				}
+				return update, nil
+			},
+		},
+	},
+})
+
+var attributeFilterInput = graphql.NewInputObject(graphql.InputObjectConfig{
+	Name:        "AttributeFilter",
+	Description: "Exactly one of boolean, numeric and text should be set",
+	Fields: graphql.InputObjectConfigFieldMap{
+		"key":      &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.String)},
+		"operator": &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.String)},
+		"boolean":  &graphql.InputObjectFieldConfig{Type: graphql.Boolean},
+		"numeric":  &graphql.InputObjectFieldConfig{Type: graphql.Float},
+		"text":     &graphql.InputObjectFieldConfig{Type: graphql.String},
+	},
+})
+
+var filtersArgument = &graphql.ArgumentConfig{
+	Type: graphql.NewList(graphql.NewNonNull(attributeFilterInput)),
+}
+
+// NewSchema builds the GraphQL schema on top of the cache and the broker distributing its updates
+func NewSchema(sdupCache cache.SDUPCache, broker *stream.Broker) (graphql.Schema, error) {
+	query := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Query",
+		Fields: graphql.Fields{
+			"device": &graphql.Field{
+				Type: deviceType,
+				Args: graphql.FieldConfigArgument{
+					"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.ID)},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					device, err := auth.AuthorizedCache(p.Context, sdupCache).Device(sduptemplates.DeviceID(p.Args["id"].(string)))
+					if err != nil {
+						return nil, err
+					}
+					return device, nil
+				},
+			},
+			"devices": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(deviceType))),
+				Args: graphql.FieldConfigArgument{"filters": filtersArgument},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return auth.AuthorizedCache(p.Context, sdupCache).Devices(filtersFromArgs(p.Args))
+				},
+			},
+		},
+	})
+
+	mutation := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Mutation",
+		Fields: graphql.Fields{
+			"triggerCapability": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.Boolean),
+				Args: graphql.FieldConfigArgument{
+					"deviceId":      &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.ID)},
+					"capabilityKey": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+					"args": &graphql.ArgumentConfig{
+						Type:        graphql.String,
+						Description: "JSON encoded capability arguments",
+					},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					capArg := sduptemplates.CapabilityArgument{}
+					if encoded, ok := p.Args["args"].(string); ok && encoded != "" {
+						if err := json.Unmarshal([]byte(encoded), &capArg); err != nil {
+							return nil, err
+						}
+					}
+					err := auth.AuthorizedCache(p.Context, sdupCache).TriggerCapability(sduptemplates.DeviceID(p.Args["deviceId"].(string)), sduptemplates.CapabilityKey(p.Args["capabilityKey"].(string)), capArg)
+					if err != nil {
+						return nil, err
+					}
+					return true, nil
+				},
+			},
+		},
+	})
+
+	subscription := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Subscription",
+		Fields: graphql.Fields{
+			"deviceEvents": &graphql.Field{
+				Type: graphql.NewNonNull(deviceEventType),
+				Args: graphql.FieldConfigArgument{"filters": filtersArgument},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					event, ok := p.Source.(deviceEvent)
+					if !ok {
+						return nil, errors.New("deviceEvents is only available as a subscription")
+					}
+					return event, nil
+				},
+				Subscribe: func(p graphql.ResolveParams) (interface{}, error) {
+					// Subscribe before taking the snapshot so that no update falls between the two
+					subscription := broker.Subscribe()
+					view, devices, err := stream.NewView(auth.AuthorizedCache(p.Context, sdupCache), filtersFromArgs(p.Args))
+					if err != nil {
+						broker.Unsubscribe(subscription)
+						return nil, err
+					}
+
+					events := make(chan interface{})
+					go func() {
+						defer close(events)
+						defer broker.Unsubscribe(subscription)
+
+						pending := []deviceEvent{{Type: stream.EventSnapshot, Devices: devices}}
+						for {
+							var out chan interface{}
+							var next deviceEvent
+							if len(pending) > 0 {
+								out = events
+								next = pending[0]
+							}
+							select {
+							case <-p.Context.Done():
+								return
+
+							case out <- next:
+								pending = pending[1:]
+
+							case update, ok := <-subscription.Updates():
+								if !ok {
+									return
+								}
+								eventType, device, ok := view.Classify(update)
+								if !ok {
+									continue
+								}
+								event := deviceEvent{Type: eventType}
+								if eventType == stream.EventAdded {
+									event.Devices = []sduptemplates.DeviceSpec{device}
+								} else {
+									event.Update = &update
+								}
+								if len(pending) >= maxPendingEvents {
+									// The client is not keeping up, end the subscription rather than buffer forever
+									return
+								}
+								pending = append(pending, event)
+							}
+						}
+					}()
+					return events, nil
+				},
+			},
+		},
+	})
+
+	return graphql.NewSchema(graphql.SchemaConfig{
+		Query:        query,
+		Mutation:     mutation,
+		Subscription: subscription,
+	})
+}
@@ -0,0 +1,43 @@
+package grpcsdup
+
+import "errors"
+
+// Config for the gRPC server. The server is disabled when no port is configured.
+type Config struct {
+	ListenAddress string `json:"listen-address"`
+	ListenPort    int    `json:"listen-port"`
+	// CertFile and KeyFile enable TLS. Without them the server speaks plaintext and client certificates can not be used
+	CertFile string `json:"cert-file"`
+	KeyFile  string `json:"key-file"`
+	// ClientCAFile enables authentication with client certificates signed by the CA
+	ClientCAFile string `json:"client-ca-file"`
+}
+
+func (conf *Config) PopulateExample() {
+	conf.ListenAddress = "0.0.0.0"
+	conf.ListenPort = 8081
+	conf.CertFile = "/etc/sdup-rest/server.crt"
+	conf.KeyFile = "/etc/sdup-rest/server.key"
+	conf.ClientCAFile = "/etc/sdup-rest/client-ca.crt"
+}
+
+// Enabled reports whether the gRPC server should be started
+func (conf Config) Enabled() bool {
+	return conf.ListenPort != 0
+}
+
+func (conf Config) Validate() error {
+	if !conf.Enabled() {
+		return nil
+	}
+	if conf.ListenPort < 0 || conf.ListenPort > 65535 {
+		return errors.New("grpc listen-port out of range")
+	}
+	if (conf.CertFile == "") != (conf.KeyFile == "") {
+		return errors.New("grpc cert-file and key-file must be set together")
+	}
+	if conf.ClientCAFile != "" && conf.CertFile == "" {
+		return errors.New("grpc client-ca-file requires cert-file and key-file")
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package grpcsdup
+
+import (
+	"encoding/json"
+
+	"github.com/Kaese72/sdup-lib/sduptemplates"
+	"github.com/Kaese72/sdup-rest/cache/filters"
+	"github.com/Kaese72/sdup-rest/grpcsdup/sduppb"
+	"github.com/Kaese72/sdup-rest/stream"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func attributeStateToProto(state sduptemplates.AttributeState) *sduppb.AttributeState {
+	return &sduppb.AttributeState{
+		Boolean: state.Boolean,
+		Numeric: state.Numeric,
+		Text:    state.Text,
+	}
+}
+
+func deviceToProto(device sduptemplates.DeviceSpec) *sduppb.Device {
+	pbDevice := &sduppb.Device{
+		Id:         string(device.ID),
+		Attributes: map[string]*sduppb.AttributeState{},
+	}
+	for key, attr := range device.Attributes {
+		pbDevice.Attributes[string(key)] = attributeStateToProto(attr.AttributeState)
+	}
+	for key := range device.Capabilities {
+		pbDevice.Capabilities = append(pbDevice.Capabilities, string(key))
+	}
+	return pbDevice
+}
+
+func devicesToProto(devices []sduptemplates.DeviceSpec) []*sduppb.Device {
+	pbDevices := []*sduppb.Device{}
+	for _, device := range devices {
+		pbDevices = append(pbDevices, deviceToProto(device))
+	}
+	return pbDevices
+}
+
+func updateToProto(update sduptemplates.DeviceUpdate) *sduppb.DeviceUpdate {
+	pbUpdate := &sduppb.DeviceUpdate{
+		Id:             string(update.ID),
+		AttributesDiff: map[string]*sduppb.AttributeState{},
+	}
+	for key, state := range update.AttributesDiff {
+		pbUpdate.AttributesDiff[string(key)] = attributeStateToProto(state)
+	}
+	return pbUpdate
+}
+
+func filtersFromProto(pbFilters []*sduppb.AttributeFilter) filters.AttributeFilters {
+	attrFilters := filters.AttributeFilters{}
+	for _, pbFilter := range pbFilters {
+		filter := filters.AttributeFilter{
+			Key:      filters.AttributeFilterKey(pbFilter.Key),
+			Operator: filters.Operator(pbFilter.Operator),
+		}
+		switch value := pbFilter.Value.(type) {
+		case *sduppb.AttributeFilter_Boolean:
+			filter.Value = value.Boolean
+		case *sduppb.AttributeFilter_Numeric:
+			filter.Value = value.Numeric
+		case *sduppb.AttributeFilter_Text:
+			filter.Value = value.Text
+		}
+		attrFilters = append(attrFilters, filter)
+	}
+	return attrFilters
+}
+
+// argumentFromProto converts capability arguments by way of JSON, which is what the REST API accepts
+func argumentFromProto(args *structpb.Struct) (sduptemplates.CapabilityArgument, error) {
+	capArg := sduptemplates.CapabilityArgument{}
+	if args == nil {
+		return capArg, nil
+	}
+	encoded, err := args.MarshalJSON()
+	if err != nil {
+		return capArg, err
+	}
+	err = json.Unmarshal(encoded, &capArg)
+	return capArg, err
+}
+
+func eventTypeToProto(event stream.EventType) sduppb.DeviceEvent_Type {
+	switch event {
+	case stream.EventSnapshot:
+		return sduppb.DeviceEvent_SNAPSHOT
+	case stream.EventUpdate:
+		return sduppb.DeviceEvent_UPDATE
+	case stream.EventAdded:
+		return sduppb.DeviceEvent_ADDED
+	case stream.EventRemoved:
+		return sduppb.DeviceEvent_REMOVED
+	default:
+		return sduppb.DeviceEvent_TYPE_UNSPECIFIED
+	}
+}
+
+// eventToProto builds the event sent to subscribers. Added devices are sent in full since the subscriber has not seen them before
+func eventToProto(event stream.EventType, update sduptemplates.DeviceUpdate, device sduptemplates.DeviceSpec) *sduppb.DeviceEvent {
+	pbEvent := &sduppb.DeviceEvent{Type: eventTypeToProto(event)}
+	if event == stream.EventAdded {
+		pbEvent.Devices = []*sduppb.Device{deviceToProto(device)}
+	} else {
+		pbEvent.Update = updateToProto(update)
+	}
+	return pbEvent
+}
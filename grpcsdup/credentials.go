@@ -0,0 +1,66 @@
+package grpcsdup
+
+import (
+	"context"
+	"crypto/x509"
+	"net"
+	"strings"
+
+	"github.com/Kaese72/sdup-rest/auth"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+// grpcCredentials are the metadata and client certificate of a call, so that it is authenticated by the same chain as HTTP requests
+type grpcCredentials struct {
+	ctx    context.Context
+	method string
+}
+
+func newCredentials(ctx context.Context, method string) auth.Credentials {
+	return grpcCredentials{ctx: ctx, method: method}
+}
+
+func (creds grpcCredentials) Context() context.Context {
+	return creds.ctx
+}
+
+// Header reads metadata, which gRPC keys in lower case
+func (creds grpcCredentials) Header(name string) string {
+	md, _ := metadata.FromIncomingContext(creds.ctx)
+	if values := md.Get(strings.ToLower(name)); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+func (creds grpcCredentials) Certificate() *x509.Certificate {
+	p, ok := peer.FromContext(creds.ctx)
+	if !ok {
+		return nil
+	}
+	// Plaintext calls have no TLS info
+	tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(tlsInfo.State.VerifiedChains) == 0 {
+		return nil
+	}
+	return tlsInfo.State.PeerCertificates[0]
+}
+
+func (creds grpcCredentials) Target() string {
+	return creds.method
+}
+
+// peerAddress is who a call is from, as far as rate limits and the audit log are concerned
+func peerAddress(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		return p.Addr.String()
+	}
+	return host
+}
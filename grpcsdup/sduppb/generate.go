@@ -0,0 +1,3 @@
+package sduppb
+
+//go:generate protoc --go_out=paths=source_relative:. --go-grpc_out=paths=source_relative:. sdup.proto
@@ -0,0 +1,249 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.2.0
+// - protoc             v3.19.1
+// source: sdup.proto
+
+package sduppb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+// SDUPClient is the client API for SDUP service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type SDUPClient interface {
+	// Device fetches a single device
+	Device(ctx context.Context, in *DeviceRequest, opts ...grpc.CallOption) (*Device, error)
+	// Devices lists all devices matching every given filter
+	Devices(ctx context.Context, in *DevicesRequest, opts ...grpc.CallOption) (*DevicesResponse, error)
+	// TriggerCapability triggers a capability on a device
+	TriggerCapability(ctx context.Context, in *TriggerCapabilityRequest, opts ...grpc.CallOption) (*TriggerCapabilityResponse, error)
+	// Subscribe streams a snapshot of all matching devices followed by changes to them
+	Subscribe(ctx context.Context, in *SubscribeRequest, opts ...grpc.CallOption) (SDUP_SubscribeClient, error)
+}
+
+type sDUPClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewSDUPClient(cc grpc.ClientConnInterface) SDUPClient {
+	return &sDUPClient{cc}
+}
+
+func (c *sDUPClient) Device(ctx context.Context, in *DeviceRequest, opts ...grpc.CallOption) (*Device, error) {
+	out := new(Device)
+	err := c.cc.Invoke(ctx, "/sdup.v0.SDUP/Device", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *sDUPClient) Devices(ctx context.Context, in *DevicesRequest, opts ...grpc.CallOption) (*DevicesResponse, error) {
+	out := new(DevicesResponse)
+	err := c.cc.Invoke(ctx, "/sdup.v0.SDUP/Devices", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *sDUPClient) TriggerCapability(ctx context.Context, in *TriggerCapabilityRequest, opts ...grpc.CallOption) (*TriggerCapabilityResponse, error) {
+	out := new(TriggerCapabilityResponse)
+	err := c.cc.Invoke(ctx, "/sdup.v0.SDUP/TriggerCapability", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *sDUPClient) Subscribe(ctx context.Context, in *SubscribeRequest, opts ...grpc.CallOption) (SDUP_SubscribeClient, error) {
+	stream, err := c.cc.NewStream(ctx, &SDUP_ServiceDesc.Streams[0], "/sdup.v0.SDUP/Subscribe", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &sDUPSubscribeClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type SDUP_SubscribeClient interface {
+	Recv() (*DeviceEvent, error)
+	grpc.ClientStream
+}
+
+type sDUPSubscribeClient struct {
+	grpc.ClientStream
+}
+
+func (x *sDUPSubscribeClient) Recv() (*DeviceEvent, error) {
+	m := new(DeviceEvent)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// SDUPServer is the server API for SDUP service.
+// All implementations must embed UnimplementedSDUPServer
+// for forward compatibility
+type SDUPServer interface {
+	// Device fetches a single device
+	Device(context.Context, *DeviceRequest) (*Device, error)
+	// Devices lists all devices matching every given filter
+	Devices(context.Context, *DevicesRequest) (*DevicesResponse, error)
+	// TriggerCapability triggers a capability on a device
+	TriggerCapability(context.Context, *TriggerCapabilityRequest) (*TriggerCapabilityResponse, error)
+	// Subscribe streams a snapshot of all matching devices followed by changes to them
+	Subscribe(*SubscribeRequest, SDUP_SubscribeServer) error
+	mustEmbedUnimplementedSDUPServer()
+}
+
+// UnimplementedSDUPServer must be embedded to have forward compatible implementations.
+type UnimplementedSDUPServer struct {
+}
+
+func (UnimplementedSDUPServer) Device(context.Context, *DeviceRequest) (*Device, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Device not implemented")
+}
+func (UnimplementedSDUPServer) Devices(context.Context, *DevicesRequest) (*DevicesResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Devices not implemented")
+}
+func (UnimplementedSDUPServer) TriggerCapability(context.Context, *TriggerCapabilityRequest) (*TriggerCapabilityResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method TriggerCapability not implemented")
+}
+func (UnimplementedSDUPServer) Subscribe(*SubscribeRequest, SDUP_SubscribeServer) error {
+	return status.Errorf(codes.Unimplemented, "method Subscribe not implemented")
+}
+func (UnimplementedSDUPServer) mustEmbedUnimplementedSDUPServer() {}
+
+// UnsafeSDUPServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to SDUPServer will
+// result in compilation errors.
+type UnsafeSDUPServer interface {
+	mustEmbedUnimplementedSDUPServer()
+}
+
+func RegisterSDUPServer(s grpc.ServiceRegistrar, srv SDUPServer) {
+	s.RegisterService(&SDUP_ServiceDesc, srv)
+}
+
+func _SDUP_Device_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeviceRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SDUPServer).Device(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/sdup.v0.SDUP/Device",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SDUPServer).Device(ctx, req.(*DeviceRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _SDUP_Devices_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DevicesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SDUPServer).Devices(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/sdup.v0.SDUP/Devices",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SDUPServer).Devices(ctx, req.(*DevicesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _SDUP_TriggerCapability_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(TriggerCapabilityRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SDUPServer).TriggerCapability(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/sdup.v0.SDUP/TriggerCapability",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SDUPServer).TriggerCapability(ctx, req.(*TriggerCapabilityRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _SDUP_Subscribe_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(SubscribeRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(SDUPServer).Subscribe(m, &sDUPSubscribeServer{stream})
+}
+
+type SDUP_SubscribeServer interface {
+	Send(*DeviceEvent) error
+	grpc.ServerStream
+}
+
+type sDUPSubscribeServer struct {
+	grpc.ServerStream
+}
+
+func (x *sDUPSubscribeServer) Send(m *DeviceEvent) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+// SDUP_ServiceDesc is the grpc.ServiceDesc for SDUP service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var SDUP_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "sdup.v0.SDUP",
+	HandlerType: (*SDUPServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Device",
+			Handler:    _SDUP_Device_Handler,
+		},
+		{
+			MethodName: "Devices",
+			Handler:    _SDUP_Devices_Handler,
+		},
+		{
+			MethodName: "TriggerCapability",
+			Handler:    _SDUP_TriggerCapability_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Subscribe",
+			Handler:       _SDUP_Subscribe_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "sdup.proto",
+}
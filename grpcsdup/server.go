@@ -0,0 +1,255 @@
+package grpcsdup
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+
+	"github.com/Kaese72/sdup-lib/logging"
+	"github.com/Kaese72/sdup-lib/sduptemplates"
+	"github.com/Kaese72/sdup-rest/audit"
+	"github.com/Kaese72/sdup-rest/auth"
+	"github.com/Kaese72/sdup-rest/cache"
+	"github.com/Kaese72/sdup-rest/faults"
+	"github.com/Kaese72/sdup-rest/grpcsdup/sduppb"
+	"github.com/Kaese72/sdup-rest/metrics"
+	"github.com/Kaese72/sdup-rest/ratelimit"
+	"github.com/Kaese72/sdup-rest/stream"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+)
+
+// SDUPGRPC serves the device cache over gRPC
+type SDUPGRPC struct {
+	sduppb.UnimplementedSDUPServer
+	authChain        auth.Chain
+	audit            *audit.Log
+	ipLimiter        *ratelimit.Limiter
+	principalLimiter *ratelimit.Limiter
+	config           Config
+	cache            cache.SDUPCache
+	broker           *stream.Broker
+}
+
+// Names of the limits in metrics, the same as for REST requests
+const (
+	limitIP        = "ip"
+	limitPrincipal = "principal"
+)
+
+func NewSDUPGRPC(config Config, cache cache.SDUPCache, broker *stream.Broker, authChain auth.Chain, auditLog *audit.Log, rateLimits ratelimit.Config) *SDUPGRPC {
+	return &SDUPGRPC{
+		authChain:        authChain,
+		audit:            auditLog,
+		ipLimiter:        ratelimit.NewLimiter(rateLimits.PerIP),
+		principalLimiter: ratelimit.NewLimiter(rateLimits.PerPrincipal),
+		config:           config,
+		cache:            cache,
+		broker:           broker,
+	}
+}
+
+// grpcCodes maps fault codes onto gRPC status codes
+var grpcCodes = map[string]codes.Code{
+	faults.CodeDeviceNotFound:      codes.NotFound,
+	faults.CodeAttributeNotFound:   codes.NotFound,
+	faults.CodeCapabilityNotFound:  codes.NotFound,
+	faults.CodeNotFound:            codes.NotFound,
+	faults.CodeMalformedRequest:    codes.InvalidArgument,
+	faults.CodeValidationFailed:    codes.InvalidArgument,
+	faults.CodeUnauthorized:        codes.Unauthenticated,
+	faults.CodeForbidden:           codes.PermissionDenied,
+	faults.CodeConflict:            codes.AlreadyExists,
+	faults.CodeRateLimited:         codes.ResourceExhausted,
+	faults.CodeUpstreamUnavailable: codes.Unavailable,
+	faults.CodeUpstreamTimeout:     codes.DeadlineExceeded,
+	faults.CodeCapabilityFailed:    codes.Aborted,
+	faults.CodeWaitTimeout:         codes.DeadlineExceeded,
+	faults.CodeCancelled:           codes.Canceled,
+}
+
+// errorToStatus maps errors from the cache onto gRPC status codes, the same way the REST API maps them onto HTTP statuses
+// Messages are the details problems have, so that internal errors are only logged
+func errorToStatus(err error) error {
+	problem := faults.NewProblem(err)
+	if code, ok := grpcCodes[problem.Code]; ok {
+		return status.Error(code, problem.Detail)
+	}
+	return status.Error(codes.Internal, problem.Detail)
+}
+
+func (server *SDUPGRPC) Device(ctx context.Context, request *sduppb.DeviceRequest) (*sduppb.Device, error) {
+	device, err := auth.AuthorizedCache(ctx, server.cache).Device(sduptemplates.DeviceID(request.Id))
+	if err != nil {
+		return nil, errorToStatus(err)
+	}
+	return deviceToProto(device), nil
+}
+
+func (server *SDUPGRPC) Devices(ctx context.Context, request *sduppb.DevicesRequest) (*sduppb.DevicesResponse, error) {
+	devices, err := auth.AuthorizedCache(ctx, server.cache).Devices(filtersFromProto(request.Filters))
+	if err != nil {
+		// Only filters the cache can not evaluate are invalid arguments, see cache.DeviceMatchesFilters
+		return nil, errorToStatus(err)
+	}
+	return &sduppb.DevicesResponse{Devices: devicesToProto(devices)}, nil
+}
+
+func (server *SDUPGRPC) TriggerCapability(ctx context.Context, request *sduppb.TriggerCapabilityRequest) (*sduppb.TriggerCapabilityResponse, error) {
+	args, err := argumentFromProto(request.Args)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	err = auth.AuthorizedCache(ctx, server.cache).TriggerCapability(sduptemplates.DeviceID(request.DeviceId), sduptemplates.CapabilityKey(request.CapabilityKey), args)
+	if err != nil {
+		return nil, errorToStatus(err)
+	}
+	return &sduppb.TriggerCapabilityResponse{}, nil
+}
+
+func (server *SDUPGRPC) Subscribe(request *sduppb.SubscribeRequest, subscribeServer sduppb.SDUP_SubscribeServer) error {
+	// Subscribe before taking the snapshot so that no update falls between the two
+	subscription := server.broker.Subscribe()
+	defer server.broker.Unsubscribe(subscription)
+
+	view, devices, err := stream.NewView(auth.AuthorizedCache(subscribeServer.Context(), server.cache), filtersFromProto(request.Filters))
+	if err != nil {
+		return errorToStatus(err)
+	}
+	err = subscribeServer.Send(&sduppb.DeviceEvent{Type: sduppb.DeviceEvent_SNAPSHOT, Devices: devicesToProto(devices)})
+	if err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case <-subscribeServer.Context().Done():
+			return nil
+
+		case update, ok := <-subscription.Updates():
+			if !ok {
+				return status.Error(codes.Unavailable, "subscription ended")
+			}
+			event, device, ok := view.Classify(update)
+			if !ok {
+				continue
+			}
+			if err := subscribeServer.Send(eventToProto(event, update, device)); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// authenticate runs the call through the same authentication chain and rate limits as REST requests.
+// Calls are limited by peer address before authenticating, and by principal after.
+// The returned context carries the authenticated principal.
+func (server *SDUPGRPC) authenticate(ctx context.Context, method string) (context.Context, error) {
+	address := peerAddress(ctx)
+	if ok, retryAfter := server.ipLimiter.Allow(address); !ok {
+		metrics.RateLimited.WithLabelValues(limitIP).Inc()
+		return nil, errorToStatus(faults.ErrRateLimited{RetryAfter: retryAfter})
+	}
+	principal, err := server.authChain.Authenticate(newCredentials(ctx, method))
+	if err != nil {
+		// Calls without credentials are turned away, but are not attempts to authenticate
+		if err != auth.ErrNoCredentials {
+			server.audit.Record(audit.Event{Type: audit.TypeAuthFailure, RemoteAddr: address, Result: audit.ResultFailure, Error: err.Error()})
+		}
+		// Refused credentials are unauthenticated unless the authenticator said otherwise
+		if _, ok := err.(faults.Fault); !ok {
+			err = faults.ErrUnauthorized{Err: err}
+		}
+		return nil, errorToStatus(err)
+	}
+	// Anonymous calls share a principal, they are limited by address instead
+	if principal.Method != auth.MethodAnonymous {
+		if ok, retryAfter := server.principalLimiter.Allow(principal.Method + ":" + principal.Name); !ok {
+			metrics.RateLimited.WithLabelValues(limitPrincipal).Inc()
+			return nil, errorToStatus(faults.ErrRateLimited{RetryAfter: retryAfter})
+		}
+	}
+	logging.Info("Authenticated call", map[string]string{"principal": principal.Name, "method": principal.Method, "call": method})
+	return auth.WithPrincipal(ctx, principal), nil
+}
+
+func (server *SDUPGRPC) unaryAuthInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, err := server.authenticate(ctx, info.FullMethod)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+// authenticatedStream replaces the context of a stream with one carrying the principal
+type authenticatedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (authStream authenticatedStream) Context() context.Context {
+	return authStream.ctx
+}
+
+func (server *SDUPGRPC) streamAuthInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := server.authenticate(ss.Context(), info.FullMethod)
+	if err != nil {
+		return err
+	}
+	return handler(srv, authenticatedStream{ServerStream: ss, ctx: ctx})
+}
+
+func (server *SDUPGRPC) serverOptions() ([]grpc.ServerOption, error) {
+	options := []grpc.ServerOption{
+		grpc.UnaryInterceptor(server.unaryAuthInterceptor),
+		grpc.StreamInterceptor(server.streamAuthInterceptor),
+	}
+	if server.config.CertFile == "" {
+		return options, nil
+	}
+
+	certificate, err := tls.LoadX509KeyPair(server.config.CertFile, server.config.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+	}
+	if server.config.ClientCAFile != "" {
+		caCert, err := ioutil.ReadFile(server.config.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		caCertPool := x509.NewCertPool()
+		caCertPool.AppendCertsFromPEM(caCert)
+		tlsConfig.ClientCAs = caCertPool
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return append(options, grpc.Creds(credentials.NewTLS(tlsConfig))), nil
+}
+
+func (server *SDUPGRPC) ListenAndServe() error {
+	options, err := server.serverOptions()
+	if err != nil {
+		logging.Error(err.Error())
+		return err
+	}
+	grpcServer := grpc.NewServer(options...)
+	sduppb.RegisterSDUPServer(grpcServer, server)
+
+	listener, err := net.Listen("tcp", fmt.Sprintf("%s:%d", server.config.ListenAddress, server.config.ListenPort))
+	if err != nil {
+		logging.Error(err.Error())
+		return err
+	}
+	if err := grpcServer.Serve(listener); err != nil {
+		logging.Error(err.Error())
+		return err
+	}
+	return nil
+}
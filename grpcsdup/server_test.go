@@ -0,0 +1,38 @@
+package grpcsdup
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/Kaese72/sdup-lib/sduptemplates"
+	"github.com/Kaese72/sdup-rest/cache"
+	"github.com/Kaese72/sdup-rest/cache/filters"
+	"github.com/Kaese72/sdup-rest/faults"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestErrorToStatus(t *testing.T) {
+	_, filterErr := cache.DeviceMatchesFilters(sduptemplates.DeviceSpec{
+		Attributes: sduptemplates.AttributeSpecMap{"active": {}},
+	}, filters.AttributeFilters{{Key: "active", Operator: filters.Equal, Value: []string{}}})
+	for _, test := range []struct {
+		name     string
+		err      error
+		expected codes.Code
+	}{
+		{"invalid filter", filterErr, codes.InvalidArgument},
+		{"upstream", faults.ErrUpstreamUnavailable{Err: errors.New("connection refused")}, codes.Unavailable},
+		{"other", errors.New("disk full"), codes.Internal},
+	} {
+		converted := status.Convert(errorToStatus(test.err))
+		if converted.Code() != test.expected {
+			t.Errorf("%s: expected %s, got %s", test.name, test.expected, converted.Code())
+		}
+		// Internal and upstream errors are only logged
+		if strings.Contains(converted.Message(), "disk full") || strings.Contains(converted.Message(), "connection refused") {
+			t.Errorf("%s: the message reveals the cause: %s", test.name, converted.Message())
+		}
+	}
+}
@@ -0,0 +1,70 @@
+// Package sduptest provides an SDUP target and devices for the tests of other packages
+package sduptest
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Kaese72/sdup-lib/sduptemplates"
+)
+
+// Target serves a fixed set of devices, lets tests push updates and records triggers
+type Target struct {
+	Devices []sduptemplates.DeviceSpec
+	Updates chan sduptemplates.DeviceUpdate
+
+	lock      sync.Mutex
+	triggered []sduptemplates.DeviceID
+}
+
+func NewTarget(devices ...sduptemplates.DeviceSpec) *Target {
+	return &Target{Devices: devices, Updates: make(chan sduptemplates.DeviceUpdate)}
+}
+
+func (target *Target) Initialize() ([]sduptemplates.DeviceSpec, chan sduptemplates.DeviceUpdate, error) {
+	return target.Devices, target.Updates, nil
+}
+
+func (target *Target) TriggerCapability(deviceID sduptemplates.DeviceID, _ sduptemplates.CapabilityKey, _ sduptemplates.CapabilityArgument) error {
+	target.lock.Lock()
+	defer target.lock.Unlock()
+	target.triggered = append(target.triggered, deviceID)
+	return nil
+}
+
+// Triggered returns the devices triggered so far, in order
+func (target *Target) Triggered() []sduptemplates.DeviceID {
+	target.lock.Lock()
+	defer target.lock.Unlock()
+	return append([]sduptemplates.DeviceID{}, target.triggered...)
+}
+
+func BoolState(value bool) sduptemplates.AttributeState {
+	return sduptemplates.AttributeState{Boolean: &value}
+}
+
+// Device has a single boolean attribute and the activate capability
+func Device(id sduptemplates.DeviceID, attrKey sduptemplates.AttributeKey, value bool) sduptemplates.DeviceSpec {
+	return sduptemplates.DeviceSpec{
+		ID:           id,
+		Attributes:   sduptemplates.AttributeSpecMap{attrKey: {AttributeState: BoolState(value)}},
+		Capabilities: sduptemplates.CapabilitySpecMap{"activate": {}},
+	}
+}
+
+// BoolUpdate sets a single boolean attribute
+func BoolUpdate(id sduptemplates.DeviceID, attrKey sduptemplates.AttributeKey, value bool) sduptemplates.DeviceUpdate {
+	return sduptemplates.DeviceUpdate{ID: id, AttributesDiff: sduptemplates.AttributeStateMap{attrKey: BoolState(value)}}
+}
+
+// WaitFor polls a condition until it holds or the timeout passes
+func WaitFor(timeout time.Duration, condition func() bool) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if condition() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return condition()
+}
@@ -1,15 +1,23 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"os"
 
 	"github.com/Kaese72/sdup-lib/logging"
 	"github.com/Kaese72/sdup-lib/sdupclient"
+	"github.com/Kaese72/sdup-rest/audit"
+	"github.com/Kaese72/sdup-rest/auth"
 	"github.com/Kaese72/sdup-rest/cache"
 	"github.com/Kaese72/sdup-rest/config"
+	"github.com/Kaese72/sdup-rest/grpcsdup"
+	"github.com/Kaese72/sdup-rest/mqttsdup"
+	"github.com/Kaese72/sdup-rest/ratelimit"
 	"github.com/Kaese72/sdup-rest/rest"
+	"github.com/Kaese72/sdup-rest/stream"
+	"github.com/Kaese72/sdup-rest/webhooks"
 )
 
 func main() {
@@ -45,12 +53,70 @@ func main() {
 		return
 	}
 
+	users, err := auth.NewHtpasswdStore(conf.AuthConfig.Users)
+	if err != nil {
+		logging.Error(err.Error())
+		return
+	}
+	apiKeys, err := auth.NewAPIKeyStore(conf.AuthConfig.APIKeys)
+	if err != nil {
+		logging.Error(err.Error())
+		return
+	}
+	authentication, err := auth.NewJWTWrapper(conf.AuthConfig, users, apiKeys)
+	if err != nil {
+		logging.Error(err.Error())
+		return
+	}
+
+	authChain, err := auth.NewChain(conf.AuthConfig, authentication)
+	if err != nil {
+		logging.Error(err.Error())
+		return
+	}
+
+	auditLog, err := audit.NewLog(conf.AuditConfig)
+	if err != nil {
+		logging.Error(err.Error())
+		return
+	}
+
 	sdupClient, err := sdupclient.NewSDUPClient(conf.SDUPClientConfig)
 	if err != nil {
 		logging.Error(err.Error())
 		return
 	}
-	sdupCache := cache.NewSDUPCache(sdupClient)
-	router := rest.NewSDUPRestCache(conf.SDUPServerConfig, sdupCache)
+	sdupCache := cache.NewSDUPCache(sdupClient, conf.ArgumentsConfig)
+	_, channel, err := sdupCache.Initialize()
+	if err != nil {
+		logging.Error(err.Error())
+		return
+	}
+	broker := stream.NewBroker(channel)
+	// Capability triggers through the audited cache are recorded as made by whoever is authorized to make them
+	auditedCache := audit.NewCache(sdupCache, auditLog)
+	// Capability triggers are limited per principal, whichever server they come through
+	limitedCache := ratelimit.NewCache(auditedCache, conf.RateLimitConfig.Triggers)
+
+	if conf.GRPCServerConfig.Enabled() {
+		grpcServer := grpcsdup.NewSDUPGRPC(conf.GRPCServerConfig, limitedCache, broker, authChain, auditLog, conf.RateLimitConfig)
+		go grpcServer.ListenAndServe()
+	}
+
+	if conf.MQTTConfig.Enabled() {
+		// The bridge is authorized like any other caller, as the user named by its client ID
+		mqttPrincipal := conf.AuthConfig.RBAC.UserPrincipal(conf.MQTTConfig.ClientID, auth.MethodMQTT)
+		mqttBridge := mqttsdup.NewBridge(conf.MQTTConfig, auth.AuthorizedCache(auth.WithPrincipal(context.Background(), mqttPrincipal), limitedCache), broker)
+		go mqttBridge.Run()
+	}
+
+	webhookManager, err := webhooks.NewManager(conf.WebhooksConfig, sdupCache)
+	if err != nil {
+		logging.Error(err.Error())
+		return
+	}
+	go webhookManager.Run(broker)
+
+	router := rest.NewSDUPRestCache(conf.SDUPServerConfig, conf.TLSConfig, limitedCache, broker, authentication, authChain, webhookManager, auditLog, conf.RateLimitConfig)
 	router.ListenAndServe()
 }
@@ -0,0 +1,30 @@
+// Package metrics holds the Prometheus metrics exported by sdup-rest
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const namespace = "sdup_rest"
+
+var (
+	// TLSCertificateExpiry is when the certificate currently served expires
+	TLSCertificateExpiry = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "tls_certificate_expiry_timestamp_seconds",
+		Help:      "Unix time the served TLS certificate expires at",
+	})
+	// TLSReloads counts attempts to load changed certificate files, by result
+	TLSReloads = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "tls_reloads_total",
+		Help:      "Attempts to load changed TLS files, by result",
+	}, []string{"result"})
+	// RateLimited counts requests rejected by rate limits, by the limit that rejected them
+	RateLimited = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rate_limited_requests_total",
+		Help:      "Requests rejected for exceeding a rate limit, by limit",
+	}, []string{"limit"})
+)
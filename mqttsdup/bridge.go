@@ -0,0 +1,196 @@
+package mqttsdup
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Kaese72/sdup-lib/logging"
+	"github.com/Kaese72/sdup-lib/sduptemplates"
+	"github.com/Kaese72/sdup-rest/cache"
+	"github.com/Kaese72/sdup-rest/cache/filters"
+	"github.com/Kaese72/sdup-rest/stream"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Every topic the bridge uses is below the configured prefix.
+// Attribute state is retained on <prefix>/<device>/<attribute>.
+// Publishing capability arguments to <prefix>/<device>/capabilities/<capability> triggers the capability
+// and the outcome is published to the same topic suffixed with /result.
+// Device IDs, attribute keys and capability keys are escaped, see escapeLevel.
+const capabilitiesLevel = "capabilities"
+
+const qos = 1
+
+// connectRetryInterval is how long to wait between attempts to reach the broker, also when it is down at startup
+var connectRetryInterval = 10 * time.Second
+
+// levelEscaper percent-encodes what MQTT would otherwise read as a level separator or a wildcard
+var levelEscaper = strings.NewReplacer("%", "%25", "/", "%2F", "+", "%2B", "#", "%23")
+
+// escapeLevel makes an ID or key usable as a single topic level
+func escapeLevel(level string) string {
+	return levelEscaper.Replace(level)
+}
+
+// unescapeLevel reverses escapeLevel
+func unescapeLevel(level string) (string, error) {
+	return url.PathUnescape(level)
+}
+
+// commandResult is published after a capability has been triggered
+type commandResult struct {
+	Error string `json:"error,omitempty"`
+}
+
+// Bridge publishes the cached device state to an MQTT broker and accepts capability triggers from it.
+// The cache should be authorized, the bridge only publishes devices it can read and triggers what it is allowed to.
+type Bridge struct {
+	config Config
+	cache  cache.SDUPCache
+	broker *stream.Broker
+	client mqtt.Client
+	// connected tells Run to publish the full state, so that all publishing happens on one goroutine and in order
+	connected chan struct{}
+}
+
+func NewBridge(config Config, cache cache.SDUPCache, broker *stream.Broker) *Bridge {
+	bridge := &Bridge{
+		config:    config,
+		cache:     cache,
+		broker:    broker,
+		connected: make(chan struct{}, 1),
+	}
+	options := mqtt.NewClientOptions().
+		AddBroker(config.Broker).
+		SetClientID(config.ClientID).
+		SetUsername(config.Username).
+		SetPassword(config.Password).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetConnectRetryInterval(connectRetryInterval).
+		SetOnConnectHandler(bridge.onConnect).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			logging.Error("Lost connection to MQTT broker", map[string]string{"error": err.Error()})
+		})
+	bridge.client = mqtt.NewClient(options)
+	return bridge
+}
+
+func (bridge *Bridge) attributeTopic(deviceID sduptemplates.DeviceID, attrKey sduptemplates.AttributeKey) string {
+	return fmt.Sprintf("%s/%s/%s", bridge.config.TopicPrefix, escapeLevel(string(deviceID)), escapeLevel(string(attrKey)))
+}
+
+func (bridge *Bridge) publishAttribute(deviceID sduptemplates.DeviceID, attrKey sduptemplates.AttributeKey, state sduptemplates.AttributeState) {
+	payload, err := json.Marshal(state)
+	if err != nil {
+		logging.Error("Failed to encode attribute state", map[string]string{"device": string(deviceID), "attribute": string(attrKey), "error": err.Error()})
+		return
+	}
+	// Retained so that new subscribers immediately learn the current state
+	bridge.client.Publish(bridge.attributeTopic(deviceID, attrKey), qos, true, payload)
+}
+
+// publishAll publishes the state of every cached device
+func (bridge *Bridge) publishAll() {
+	devices, err := bridge.cache.Devices(filters.AttributeFilters{})
+	if err != nil {
+		logging.Error("Failed to list devices for MQTT", map[string]string{"error": err.Error()})
+		return
+	}
+	for _, device := range devices {
+		for attrKey, attr := range device.Attributes {
+			bridge.publishAttribute(device.ID, attrKey, attr.AttributeState)
+		}
+	}
+}
+
+// onConnect runs on every (re)connect, the broker may have lost retained messages and subscriptions meanwhile
+func (bridge *Bridge) onConnect(client mqtt.Client) {
+	logging.Info("Connected to MQTT broker", map[string]string{"broker": bridge.config.Broker})
+	commandTopic := fmt.Sprintf("%s/+/%s/+", bridge.config.TopicPrefix, capabilitiesLevel)
+	token := client.Subscribe(commandTopic, qos, bridge.onCommand)
+	if token.Wait() && token.Error() != nil {
+		logging.Error("Failed to subscribe to MQTT command topic", map[string]string{"topic": commandTopic, "error": token.Error().Error()})
+	}
+	select {
+	case bridge.connected <- struct{}{}:
+	default:
+		// Run has yet to publish after a previous connect, once is enough
+	}
+}
+
+func (bridge *Bridge) onCommand(client mqtt.Client, message mqtt.Message) {
+	// Retained commands are delivered again on every (re)subscribe, only commands as they are sent count
+	if message.Retained() {
+		logging.Info("Ignoring retained MQTT command", map[string]string{"topic": message.Topic()})
+		return
+	}
+	levels := strings.Split(strings.TrimPrefix(message.Topic(), bridge.config.TopicPrefix+"/"), "/")
+	if len(levels) != 3 || levels[1] != capabilitiesLevel {
+		return
+	}
+	deviceID, err := unescapeLevel(levels[0])
+	if err != nil {
+		return
+	}
+	capKey, err := unescapeLevel(levels[2])
+	if err != nil {
+		return
+	}
+
+	// Payloads are handled concurrently by paho, triggering may take a while
+	go func() {
+		var result commandResult
+		args := sduptemplates.CapabilityArgument{}
+		if len(message.Payload()) > 0 {
+			if err := json.Unmarshal(message.Payload(), &args); err != nil {
+				result.Error = err.Error()
+			}
+		}
+		if result.Error == "" {
+			if err := bridge.cache.TriggerCapability(sduptemplates.DeviceID(deviceID), sduptemplates.CapabilityKey(capKey), args); err != nil {
+				result.Error = err.Error()
+			}
+		}
+		if result.Error != "" {
+			logging.Error("MQTT capability trigger failed", map[string]string{"device": deviceID, "capability": capKey, "error": result.Error})
+		}
+		payload, _ := json.Marshal(result)
+		client.Publish(message.Topic()+"/result", qos, false, payload)
+	}()
+}
+
+// Run connects to the broker and forwards updates until the update stream ends.
+// Connecting is retried in the background for as long as the broker can not be reached.
+func (bridge *Bridge) Run() error {
+	subscription := bridge.broker.Subscribe()
+	defer bridge.broker.Unsubscribe(subscription)
+
+	bridge.client.Connect()
+	defer bridge.client.Disconnect(250)
+
+	for {
+		select {
+		case <-bridge.connected:
+			bridge.publishAll()
+		case update, ok := <-subscription.Updates():
+			if !ok {
+				return nil
+			}
+			// Updates while disconnected are not queued, the full state is published on connect
+			if !bridge.client.IsConnectionOpen() {
+				continue
+			}
+			// The cache is authorized, devices the bridge may not read are not found
+			if _, err := bridge.cache.Device(update.ID); err != nil {
+				continue
+			}
+			for attrKey, state := range update.AttributesDiff {
+				bridge.publishAttribute(update.ID, attrKey, state)
+			}
+		}
+	}
+}
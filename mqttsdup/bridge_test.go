@@ -0,0 +1,315 @@
+package mqttsdup
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Kaese72/sdup-lib/sduptemplates"
+	"github.com/Kaese72/sdup-rest/auth"
+	"github.com/Kaese72/sdup-rest/cache"
+	"github.com/Kaese72/sdup-rest/internal/sduptest"
+	"github.com/Kaese72/sdup-rest/stream"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// testBroker is just enough of an MQTT broker for the bridge: QoS 0 delivery, retained messages and wildcards
+type testBroker struct {
+	listener net.Listener
+
+	lock     sync.Mutex
+	retained map[string][]byte
+	clients  map[*testBrokerClient]bool
+}
+
+type testBrokerClient struct {
+	conn      net.Conn
+	writeLock sync.Mutex
+	filters   []string
+}
+
+func (client *testBrokerClient) write(packet packets.ControlPacket) {
+	client.writeLock.Lock()
+	defer client.writeLock.Unlock()
+	packet.Write(client.conn)
+}
+
+func startTestBroker(t *testing.T, address string) *testBroker {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	broker := &testBroker{listener: listener, retained: map[string][]byte{}, clients: map[*testBrokerClient]bool{}}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go broker.serve(&testBrokerClient{conn: conn})
+		}
+	}()
+	return broker
+}
+
+func (broker *testBroker) close() {
+	broker.listener.Close()
+	broker.lock.Lock()
+	defer broker.lock.Unlock()
+	for client := range broker.clients {
+		client.conn.Close()
+	}
+}
+
+func (broker *testBroker) retainedMessage(topic string) ([]byte, bool) {
+	broker.lock.Lock()
+	defer broker.lock.Unlock()
+	payload, ok := broker.retained[topic]
+	return payload, ok
+}
+
+// matchTopic matches a topic against a filter with + and # wildcards
+func matchTopic(filter, topic string) bool {
+	filterLevels, topicLevels := strings.Split(filter, "/"), strings.Split(topic, "/")
+	for i, level := range filterLevels {
+		if level == "#" {
+			return true
+		}
+		if i >= len(topicLevels) || (level != "+" && level != topicLevels[i]) {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
+
+func deliver(client *testBrokerClient, topic string, payload []byte, retain bool) {
+	publish := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	publish.TopicName = topic
+	publish.Payload = payload
+	publish.Retain = retain
+	client.write(publish)
+}
+
+func (broker *testBroker) serve(client *testBrokerClient) {
+	defer client.conn.Close()
+	for {
+		packet, err := packets.ReadPacket(client.conn)
+		if err != nil {
+			broker.lock.Lock()
+			delete(broker.clients, client)
+			broker.lock.Unlock()
+			return
+		}
+		switch packet := packet.(type) {
+		case *packets.ConnectPacket:
+			broker.lock.Lock()
+			broker.clients[client] = true
+			broker.lock.Unlock()
+			client.write(packets.NewControlPacket(packets.Connack))
+		case *packets.SubscribePacket:
+			suback := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+			suback.MessageID = packet.MessageID
+			suback.ReturnCodes = make([]byte, len(packet.Topics))
+			client.write(suback)
+			broker.lock.Lock()
+			client.filters = append(client.filters, packet.Topics...)
+			for topic, payload := range broker.retained {
+				for _, filter := range packet.Topics {
+					if matchTopic(filter, topic) {
+						deliver(client, topic, payload, true)
+					}
+				}
+			}
+			broker.lock.Unlock()
+		case *packets.PublishPacket:
+			if packet.Qos > 0 {
+				puback := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+				puback.MessageID = packet.MessageID
+				client.write(puback)
+			}
+			broker.lock.Lock()
+			if packet.Retain {
+				broker.retained[packet.TopicName] = packet.Payload
+			}
+			for subscriber := range broker.clients {
+				for _, filter := range subscriber.filters {
+					if matchTopic(filter, packet.TopicName) {
+						deliver(subscriber, packet.TopicName, packet.Payload, false)
+						break
+					}
+				}
+			}
+			broker.lock.Unlock()
+		case *packets.PingreqPacket:
+			client.write(packets.NewControlPacket(packets.Pingresp))
+		case *packets.DisconnectPacket:
+			return
+		}
+	}
+}
+
+// startBridge runs a bridge allowed to see and trigger lamp and hall/*, but not the safe
+func startBridge(t *testing.T, brokerAddress string) *sduptest.Target {
+	target := sduptest.NewTarget(
+		sduptest.Device("lamp", "active", false),
+		sduptest.Device("hall/light#1", "level+1", false),
+		sduptest.Device("safe", "open", false),
+	)
+	sdupCache := cache.NewSDUPCache(target, nil)
+	_, updates, err := sdupCache.Initialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rbac := auth.RBACConfig{
+		Roles:     map[string]auth.RoleConfig{"lights": {Devices: []string{"lamp", "hall/*"}, Capabilities: []string{"activate"}}},
+		UserRoles: map[string][]string{"bridge": {"lights"}},
+	}
+	principal := rbac.UserPrincipal("bridge", auth.MethodMQTT)
+	authorized := auth.AuthorizedCache(auth.WithPrincipal(context.Background(), principal), sdupCache)
+
+	bridge := NewBridge(Config{Broker: "tcp://" + brokerAddress, ClientID: "bridge", TopicPrefix: "sdup"}, authorized, stream.NewBroker(updates))
+	go bridge.Run()
+	return target
+}
+
+func retainedBoolean(broker *testBroker, topic string) (value bool, ok bool) {
+	payload, ok := broker.retainedMessage(topic)
+	if !ok {
+		return false, false
+	}
+	var state sduptemplates.AttributeState
+	if err := json.Unmarshal(payload, &state); err != nil || state.Boolean == nil {
+		return false, false
+	}
+	return *state.Boolean, true
+}
+
+func TestBridgeRetriesUntilBrokerIsUp(t *testing.T) {
+	connectRetryInterval = 50 * time.Millisecond
+	// Find a free port, then leave it closed while the bridge starts
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+
+	startBridge(t, address)
+	time.Sleep(200 * time.Millisecond)
+	broker := startTestBroker(t, address)
+	defer broker.close()
+
+	if !sduptest.WaitFor(5*time.Second, func() bool { _, ok := broker.retainedMessage("sdup/lamp/active"); return ok }) {
+		t.Fatal("the bridge never published after the broker came up")
+	}
+	// IDs and keys with separators or wildcards are escaped into a single level
+	if _, ok := broker.retainedMessage("sdup/hall%2Flight%231/level%2B1"); !ok {
+		t.Error("the escaped device was not published")
+	}
+	if _, ok := broker.retainedMessage("sdup/safe/open"); ok {
+		t.Error("a device the bridge may not read was published")
+	}
+}
+
+func TestBridgePublishesLatestState(t *testing.T) {
+	connectRetryInterval = 50 * time.Millisecond
+	broker := startTestBroker(t, "127.0.0.1:0")
+	defer broker.close()
+	target := startBridge(t, broker.listener.Addr().String())
+
+	// Updates race with the state published on connect. The last one activates the lamp, which starts out inactive
+	for i := 0; i <= 200; i++ {
+		target.Updates <- sduptest.BoolUpdate("lamp", "active", i%2 == 0)
+	}
+	expected := true
+	if !sduptest.WaitFor(5*time.Second, func() bool { value, ok := retainedBoolean(broker, "sdup/lamp/active"); return ok && value == expected }) {
+		value, _ := retainedBoolean(broker, "sdup/lamp/active")
+		t.Errorf("expected the retained state to end up %v, got %v", expected, value)
+	}
+}
+
+func TestBridgeCommands(t *testing.T) {
+	connectRetryInterval = 50 * time.Millisecond
+	broker := startTestBroker(t, "127.0.0.1:0")
+	defer broker.close()
+	target := startBridge(t, broker.listener.Addr().String())
+	if !sduptest.WaitFor(5*time.Second, func() bool { _, ok := broker.retainedMessage("sdup/lamp/active"); return ok }) {
+		t.Fatal("the bridge never connected")
+	}
+
+	client := mqtt.NewClient(mqtt.NewClientOptions().AddBroker("tcp://" + broker.listener.Addr().String()).SetClientID("test"))
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	defer client.Disconnect(0)
+	results := make(chan mqtt.Message, 10)
+	if token := client.Subscribe("sdup/+/capabilities/+/result", 0, func(_ mqtt.Client, message mqtt.Message) { results <- message }); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+
+	for _, test := range []struct {
+		device  string
+		allowed bool
+	}{
+		{"lamp", true},
+		{"hall%2Flight%231", true},
+		{"safe", false},
+	} {
+		client.Publish("sdup/"+test.device+"/capabilities/activate", 1, false, "{}").Wait()
+		select {
+		case message := <-results:
+			var result commandResult
+			json.Unmarshal(message.Payload(), &result)
+			if (result.Error == "") != test.allowed {
+				t.Errorf("%s: expected allowed=%v, got %q", test.device, test.allowed, result.Error)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: no result", test.device)
+		}
+	}
+	triggered := target.Triggered()
+	if len(triggered) != 2 || triggered[0] != "lamp" || triggered[1] != "hall/light#1" {
+		t.Errorf("expected lamp and hall/light#1 to be triggered, got %v", triggered)
+	}
+}
+
+func TestBridgeIgnoresRetainedCommands(t *testing.T) {
+	connectRetryInterval = 50 * time.Millisecond
+	broker := startTestBroker(t, "127.0.0.1:0")
+	defer broker.close()
+
+	client := mqtt.NewClient(mqtt.NewClientOptions().AddBroker("tcp://" + broker.listener.Addr().String()).SetClientID("test"))
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	defer client.Disconnect(0)
+	// Left behind before the bridge subscribes, as by a misbehaving client
+	client.Publish("sdup/lamp/capabilities/activate", 1, true, "{}").Wait()
+	results := make(chan mqtt.Message, 10)
+	if token := client.Subscribe("sdup/+/capabilities/+/result", 0, func(_ mqtt.Client, message mqtt.Message) { results <- message }); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+
+	target := startBridge(t, broker.listener.Addr().String())
+	if !sduptest.WaitFor(5*time.Second, func() bool { _, ok := broker.retainedMessage("sdup/lamp/active"); return ok }) {
+		t.Fatal("the bridge never connected")
+	}
+	// Results are published in order, so once the live command is answered the retained one would have been as well
+	client.Publish("sdup/hall%2Flight%231/capabilities/activate", 1, false, "{}").Wait()
+	select {
+	case message := <-results:
+		if message.Topic() != "sdup/hall%2Flight%231/capabilities/activate/result" {
+			t.Errorf("expected only the live command to be answered, got %s", message.Topic())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no result")
+	}
+	if triggered := target.Triggered(); len(triggered) != 1 || triggered[0] != "hall/light#1" {
+		t.Errorf("expected only hall/light#1 to be triggered, got %v", triggered)
+	}
+}
@@ -0,0 +1,46 @@
+package mqttsdup
+
+import (
+	"errors"
+	"strings"
+)
+
+// Config for the MQTT bridge. The bridge is disabled when no broker is configured.
+type Config struct {
+	// Broker is the URL of the MQTT broker, eg. tcp://localhost:1883
+	Broker string `json:"broker"`
+	// ClientID is also the user the bridge acts as. It publishes the devices and triggers the capabilities
+	// allowed by the roles assigned to it in auth rbac user-roles, and nothing without any
+	ClientID string `json:"client-id"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	// TopicPrefix is the first level of every topic the bridge uses
+	TopicPrefix string `json:"topic-prefix"`
+}
+
+func (conf *Config) PopulateExample() {
+	conf.Broker = "tcp://localhost:1883"
+	conf.ClientID = "sdup-rest"
+	conf.TopicPrefix = "sdup"
+}
+
+// Enabled reports whether the bridge should be started
+func (conf Config) Enabled() bool {
+	return conf.Broker != ""
+}
+
+func (conf Config) Validate() error {
+	if !conf.Enabled() {
+		return nil
+	}
+	if conf.TopicPrefix == "" {
+		return errors.New("mqtt topic-prefix must be set")
+	}
+	if strings.ContainsAny(conf.TopicPrefix, "+#") {
+		return errors.New("mqtt topic-prefix may not contain wildcards")
+	}
+	if conf.ClientID == "" {
+		return errors.New("mqtt client-id must be set")
+	}
+	return nil
+}
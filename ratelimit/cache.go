@@ -0,0 +1,63 @@
+package ratelimit
+
+import (
+	"github.com/Kaese72/sdup-lib/sduptemplates"
+	"github.com/Kaese72/sdup-rest/cache"
+	"github.com/Kaese72/sdup-rest/cache/filters"
+	"github.com/Kaese72/sdup-rest/faults"
+	"github.com/Kaese72/sdup-rest/metrics"
+)
+
+// limitTrigger names the trigger limit in metrics
+const limitTrigger = "trigger"
+
+// Cache passes everything through to a cache and limits capability triggers made through views of it, see AuditAs.
+// Every transport triggers capabilities through such a view, so the limit applies however a principal connects.
+type Cache struct {
+	cache   cache.SDUPCache
+	limiter *Limiter
+}
+
+func NewCache(sdupCache cache.SDUPCache, config LimitConfig) *Cache {
+	return &Cache{cache: sdupCache, limiter: NewLimiter(config)}
+}
+
+func (limitCache *Cache) Initialize() ([]sduptemplates.DeviceSpec, chan sduptemplates.DeviceUpdate, error) {
+	return limitCache.cache.Initialize()
+}
+
+func (limitCache *Cache) Device(deviceID sduptemplates.DeviceID) (sduptemplates.DeviceSpec, error) {
+	return limitCache.cache.Device(deviceID)
+}
+
+func (limitCache *Cache) Devices(attrFilters filters.AttributeFilters) ([]sduptemplates.DeviceSpec, error) {
+	return limitCache.cache.Devices(attrFilters)
+}
+
+func (limitCache *Cache) TriggerCapability(deviceID sduptemplates.DeviceID, capKey sduptemplates.CapabilityKey, capArg sduptemplates.CapabilityArgument) error {
+	return limitCache.cache.TriggerCapability(deviceID, capKey, capArg)
+}
+
+// AuditAs limits triggers made through the view by the principal.
+// If the wrapped cache is audited, triggers refused by the limit are recorded as well.
+func (limitCache *Cache) AuditAs(view cache.SDUPCache, principal, method string) cache.SDUPCache {
+	var limited cache.SDUPCache = limitedView{SDUPCache: view, limiter: limitCache.limiter, key: method + ":" + principal}
+	if auditor, ok := limitCache.cache.(cache.Auditor); ok {
+		return auditor.AuditAs(limited, principal, method)
+	}
+	return limited
+}
+
+type limitedView struct {
+	cache.SDUPCache
+	limiter *Limiter
+	key     string
+}
+
+func (view limitedView) TriggerCapability(deviceID sduptemplates.DeviceID, capKey sduptemplates.CapabilityKey, capArg sduptemplates.CapabilityArgument) error {
+	if ok, retryAfter := view.limiter.Allow(view.key); !ok {
+		metrics.RateLimited.WithLabelValues(limitTrigger).Inc()
+		return faults.ErrRateLimited{RetryAfter: retryAfter}
+	}
+	return view.SDUPCache.TriggerCapability(deviceID, capKey, capArg)
+}
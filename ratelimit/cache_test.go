@@ -0,0 +1,48 @@
+package ratelimit
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/Kaese72/sdup-lib/sduptemplates"
+	"github.com/Kaese72/sdup-rest/cache"
+	"github.com/Kaese72/sdup-rest/faults"
+)
+
+// countingCache counts the triggers that get through
+type countingCache struct {
+	cache.SDUPCache
+	triggers int
+}
+
+func (counting *countingCache) TriggerCapability(sduptemplates.DeviceID, sduptemplates.CapabilityKey, sduptemplates.CapabilityArgument) error {
+	counting.triggers++
+	return nil
+}
+
+func TestCacheLimitsTriggersPerPrincipal(t *testing.T) {
+	counting := &countingCache{}
+	limitCache := NewCache(counting, LimitConfig{RequestsPerSecond: 0.001, Burst: 2})
+	alice := limitCache.AuditAs(limitCache, "alice", "api-key")
+	bob := limitCache.AuditAs(limitCache, "bob", "api-key")
+
+	for i := 0; i < 2; i++ {
+		if err := alice.TriggerCapability("lamp", "activate", nil); err != nil {
+			t.Fatalf("trigger %d: %s", i, err.Error())
+		}
+	}
+	var rateLimited faults.ErrRateLimited
+	if err := alice.TriggerCapability("lamp", "activate", nil); !errors.As(err, &rateLimited) {
+		t.Errorf("expected the third trigger to be rate limited, got %v", err)
+	}
+	if err := bob.TriggerCapability("lamp", "activate", nil); err != nil {
+		t.Errorf("another principal was limited: %s", err.Error())
+	}
+	if counting.triggers != 3 {
+		t.Errorf("expected 3 triggers to get through, got %d", counting.triggers)
+	}
+	// Triggers made directly on the cache are not made by anyone
+	if err := limitCache.TriggerCapability("lamp", "activate", nil); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,54 @@
+package ratelimit
+
+import "errors"
+
+// LimitConfig is a token bucket refilled with RequestsPerSecond tokens per second, holding at most Burst tokens.
+// A limit without a rate is disabled.
+type LimitConfig struct {
+	RequestsPerSecond float64 `json:"requests-per-second"`
+	Burst             int     `json:"burst"`
+}
+
+func (conf LimitConfig) Enabled() bool {
+	return conf.RequestsPerSecond > 0
+}
+
+func (conf LimitConfig) Validate() error {
+	if conf.RequestsPerSecond < 0 {
+		return errors.New("rate limit requests-per-second may not be negative")
+	}
+	if conf.Enabled() && conf.Burst < 1 {
+		return errors.New("rate limit burst must be at least 1")
+	}
+	return nil
+}
+
+type Config struct {
+	// PerIP limits every request by client address
+	PerIP LimitConfig `json:"per-ip"`
+	// PerPrincipal limits authenticated requests by who made them
+	PerPrincipal LimitConfig `json:"per-principal"`
+	// Triggers limits capability triggers by who made them, whichever transport they came through
+	Triggers LimitConfig `json:"triggers"`
+	// Login limits attempts to log in or refresh tokens by client address, on top of PerIP
+	Login LimitConfig `json:"login"`
+	// TrustForwardedFor takes the client address from the last X-Forwarded-For entry.
+	// Only enable it behind a proxy that sets the header, otherwise clients can pick their own address.
+	TrustForwardedFor bool `json:"trust-forwarded-for"`
+}
+
+func (conf *Config) PopulateExample() {
+	conf.PerIP = LimitConfig{RequestsPerSecond: 20, Burst: 40}
+	conf.PerPrincipal = LimitConfig{RequestsPerSecond: 10, Burst: 20}
+	conf.Triggers = LimitConfig{RequestsPerSecond: 5, Burst: 20}
+	conf.Login = LimitConfig{RequestsPerSecond: 0.1, Burst: 5}
+}
+
+func (conf Config) Validate() error {
+	for _, limit := range []LimitConfig{conf.PerIP, conf.PerPrincipal, conf.Triggers, conf.Login} {
+		if err := limit.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
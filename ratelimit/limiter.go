@@ -0,0 +1,79 @@
+// Package ratelimit keeps token buckets per client
+package ratelimit
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// idleTimeout is how long a client has to be quiet before its bucket is forgotten.
+// A full bucket is the same as no bucket, so this only has to be longer than it takes to refill.
+const idleTimeout = 10 * time.Minute
+
+type bucket struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// Limiter keeps a token bucket per key, such as a client address or a principal
+type Limiter struct {
+	config LimitConfig
+
+	lock      sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+func NewLimiter(config LimitConfig) *Limiter {
+	return &Limiter{config: config, buckets: map[string]*bucket{}}
+}
+
+// sweep must be called with the lock held
+func (limiter *Limiter) sweep(now time.Time) {
+	if now.Sub(limiter.lastSweep) < idleTimeout {
+		return
+	}
+	limiter.lastSweep = now
+	for key, bucket := range limiter.buckets {
+		if now.Sub(bucket.lastSeen) > idleTimeout {
+			delete(limiter.buckets, key)
+		}
+	}
+}
+
+// Allow takes a token for the key. If there is none, it returns how long until there will be
+func (limiter *Limiter) Allow(key string) (bool, time.Duration) {
+	return limiter.AllowN(key, 1)
+}
+
+// AllowN takes n tokens for the key, or none of them if there are not enough
+func (limiter *Limiter) AllowN(key string, n int) (bool, time.Duration) {
+	if !limiter.config.Enabled() {
+		return true, 0
+	}
+	now := time.Now()
+
+	limiter.lock.Lock()
+	limiter.sweep(now)
+	keyBucket, ok := limiter.buckets[key]
+	if !ok {
+		keyBucket = &bucket{limiter: rate.NewLimiter(rate.Limit(limiter.config.RequestsPerSecond), limiter.config.Burst)}
+		limiter.buckets[key] = keyBucket
+	}
+	keyBucket.lastSeen = now
+	limiter.lock.Unlock()
+
+	reservation := keyBucket.limiter.ReserveN(now, n)
+	if !reservation.OK() {
+		// More than the burst can never be allowed
+		return false, 0
+	}
+	if delay := reservation.DelayFrom(now); delay > 0 {
+		// The token is not taken, rejected requests should not push the wait further out
+		reservation.CancelAt(now)
+		return false, delay
+	}
+	return true, 0
+}
@@ -0,0 +1,58 @@
+package rest
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/Kaese72/sdup-rest/auth"
+	"github.com/Kaese72/sdup-rest/faults"
+	"github.com/gorilla/mux"
+)
+
+// apiKeyBody is accepted when creating an API key
+type apiKeyBody struct {
+	Name  string   `json:"name"`
+	Roles []string `json:"roles"`
+}
+
+// createdAPIKey is the only response that ever contains the key itself
+type createdAPIKey struct {
+	auth.APIKey
+	Key string `json:"key"`
+}
+
+func (rest *SDUPRest) listAPIKeys(writer http.ResponseWriter, reader *http.Request) {
+	writeJSON(writer, http.StatusOK, rest.authentication.APIKeys().List())
+}
+
+func (rest *SDUPRest) createAPIKey(writer http.ResponseWriter, reader *http.Request) {
+	var body apiKeyBody
+	if err := json.NewDecoder(reader.Body).Decode(&body); err != nil {
+		faults.ServeProblem(writer, reader, faults.ErrMalformedRequest{Err: err})
+		return
+	}
+	apiKey, key, err := rest.authentication.CreateAPIKey(body.Name, body.Roles)
+	var invalid auth.ErrInvalidAPIKeySpec
+	if errors.As(err, &invalid) {
+		faults.ServeProblem(writer, reader, faults.ErrValidation{Message: err.Error()})
+		return
+	} else if err != nil {
+		// Such as failing to save the store
+		faults.ServeProblem(writer, reader, err)
+		return
+	}
+	writeJSON(writer, http.StatusCreated, createdAPIKey{APIKey: apiKey, Key: key})
+}
+
+func (rest *SDUPRest) revokeAPIKey(writer http.ResponseWriter, reader *http.Request) {
+	err := rest.authentication.APIKeys().Revoke(mux.Vars(reader)["keyID"])
+	if err == auth.ErrNoSuchAPIKey {
+		faults.ServeProblem(writer, reader, faults.ErrNotFound{Err: err})
+		return
+	} else if err != nil {
+		faults.ServeProblem(writer, reader, err)
+		return
+	}
+	writer.WriteHeader(http.StatusNoContent)
+}
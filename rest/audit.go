@@ -0,0 +1,57 @@
+package rest
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Kaese72/sdup-lib/sduptemplates"
+	"github.com/Kaese72/sdup-rest/audit"
+	"github.com/Kaese72/sdup-rest/faults"
+)
+
+// defaultAuditLimit is how many events are returned unless asked for more
+const defaultAuditLimit = 1000
+
+// parseAuditQuery reads the since, until, user, device, type and limit query parameters
+func parseAuditQuery(reader *http.Request) (audit.Query, error) {
+	values := reader.URL.Query()
+	query := audit.Query{
+		Principal: values.Get("user"),
+		Device:    sduptemplates.DeviceID(values.Get("device")),
+		Type:      values.Get("type"),
+		Limit:     defaultAuditLimit,
+	}
+	var err error
+	if since := values.Get("since"); since != "" {
+		if query.Since, err = time.Parse(time.RFC3339, since); err != nil {
+			return audit.Query{}, fmt.Errorf("since must be an RFC 3339 time")
+		}
+	}
+	if until := values.Get("until"); until != "" {
+		if query.Until, err = time.Parse(time.RFC3339, until); err != nil {
+			return audit.Query{}, fmt.Errorf("until must be an RFC 3339 time")
+		}
+	}
+	if limit := values.Get("limit"); limit != "" {
+		if query.Limit, err = strconv.Atoi(limit); err != nil || query.Limit <= 0 {
+			return audit.Query{}, fmt.Errorf("limit must be a positive number")
+		}
+	}
+	return query, nil
+}
+
+func (rest *SDUPRest) queryAudit(writer http.ResponseWriter, reader *http.Request) {
+	query, err := parseAuditQuery(reader)
+	if err != nil {
+		faults.ServeProblem(writer, reader, faults.ErrMalformedRequest{Err: err})
+		return
+	}
+	events, err := rest.audit.Query(query)
+	if err != nil {
+		faults.ServeProblem(writer, reader, err)
+		return
+	}
+	writeJSON(writer, http.StatusOK, events)
+}
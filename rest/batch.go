@@ -0,0 +1,169 @@
+package rest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/Kaese72/sdup-lib/sduptemplates"
+	"github.com/Kaese72/sdup-rest/auth"
+	"github.com/Kaese72/sdup-rest/cache"
+	"github.com/Kaese72/sdup-rest/cache/filters"
+	"github.com/Kaese72/sdup-rest/faults"
+)
+
+const (
+	// batchParallelism is how many triggers of a batch are sent upstream at the same time
+	batchParallelism = 8
+	// maxBatchSize limits how many triggers a single batch may cause
+	maxBatchSize = 500
+)
+
+// batchTrigger is a single capability trigger in a batch
+type batchTrigger struct {
+	DeviceID      sduptemplates.DeviceID           `json:"deviceID"`
+	CapabilityKey sduptemplates.CapabilityKey      `json:"capabilityKey"`
+	Args          sduptemplates.CapabilityArgument `json:"args,omitempty"`
+}
+
+// batchBody either lists triggers, or triggers a capability with the same arguments on every device matching filters.
+// Devices matching the filters that do not have the capability are left out.
+type batchBody struct {
+	Triggers      []batchTrigger                   `json:"triggers,omitempty"`
+	Filters       *filters.AttributeFilters        `json:"filters,omitempty"`
+	CapabilityKey sduptemplates.CapabilityKey      `json:"capabilityKey,omitempty"`
+	Args          sduptemplates.CapabilityArgument `json:"args,omitempty"`
+}
+
+// batchResult is the outcome of one trigger. Error is set when it failed
+type batchResult struct {
+	batchTrigger
+	Status int             `json:"status"`
+	Error  *faults.Problem `json:"error,omitempty"`
+}
+
+type batchReport struct {
+	Succeeded int           `json:"succeeded"`
+	Failed    int           `json:"failed"`
+	Cancelled int           `json:"cancelled"`
+	Results   []batchResult `json:"results"`
+}
+
+// cancelledResult reports a trigger that was not made because the request was abandoned
+func cancelledResult(trigger batchTrigger, err error) batchResult {
+	problem := faults.NewProblem(faults.ErrCancelled{Err: err})
+	return batchResult{batchTrigger: trigger, Status: problem.Status, Error: &problem}
+}
+
+// triggers resolves the body into the triggers to make
+func (body batchBody) triggers(sdupCache cache.SDUPCache) ([]batchTrigger, error) {
+	if body.Filters == nil {
+		if len(body.Triggers) == 0 {
+			return nil, faults.ErrValidation{Message: "A batch needs either triggers or filters"}
+		}
+		if body.CapabilityKey != "" || body.Args != nil {
+			return nil, faults.ErrValidation{Message: "capabilityKey and args are only used together with filters"}
+		}
+		for i, trigger := range body.Triggers {
+			if trigger.DeviceID == "" || trigger.CapabilityKey == "" {
+				return nil, faults.ErrValidation{
+					Message: fmt.Sprintf("Trigger %d is incomplete", i),
+					Fields:  map[string]string{fmt.Sprintf("triggers[%d]", i): "must have a deviceID and a capabilityKey"},
+				}
+			}
+		}
+		return body.Triggers, nil
+	}
+
+	if len(body.Triggers) > 0 {
+		return nil, faults.ErrValidation{Message: "A batch either lists triggers or has filters, not both"}
+	}
+	if body.CapabilityKey == "" {
+		return nil, faults.ErrValidation{Message: "A batch with filters needs a capability", Fields: map[string]string{"capabilityKey": "is required"}}
+	}
+	devices, err := sdupCache.Devices(*body.Filters)
+	if err != nil {
+		return nil, err
+	}
+	triggers := []batchTrigger{}
+	for _, device := range devices {
+		if _, ok := device.Capabilities[body.CapabilityKey]; ok {
+			triggers = append(triggers, batchTrigger{DeviceID: device.ID, CapabilityKey: body.CapabilityKey, Args: body.Args})
+		}
+	}
+	return triggers, nil
+}
+
+// triggerBatch triggers capabilities concurrently and reports the outcome of each, in the order of the triggers
+func (rest *SDUPRest) triggerBatch(writer http.ResponseWriter, reader *http.Request) {
+	var body batchBody
+	if err := json.NewDecoder(reader.Body).Decode(&body); err != nil {
+		faults.ServeProblem(writer, reader, faults.ErrMalformedRequest{Err: err})
+		return
+	}
+	authorizedCache := auth.AuthorizedCache(reader.Context(), rest.cache)
+	triggers, err := body.triggers(authorizedCache)
+	if err != nil {
+		faults.ServeProblem(writer, reader, err)
+		return
+	}
+	if len(triggers) > maxBatchSize {
+		faults.ServeProblem(writer, reader, faults.ErrValidation{Message: fmt.Sprintf("A batch may trigger at most %d capabilities, this one would trigger %d", maxBatchSize, len(triggers))})
+		return
+	}
+
+	if !rest.chargeBatch(writer, reader, len(triggers)) {
+		return
+	}
+
+	// Triggers not yet made when the client goes away are reported as cancelled rather than made
+	ctx := reader.Context()
+	report := batchReport{Results: make([]batchResult, len(triggers))}
+	slots := make(chan struct{}, batchParallelism)
+	var wait sync.WaitGroup
+	for i := range triggers {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			report.Results[i] = cancelledResult(triggers[i], ctx.Err())
+			continue
+		}
+		wait.Add(1)
+		go func(i int) {
+			defer func() {
+				<-slots
+				wait.Done()
+			}()
+			trigger := triggers[i]
+			if err := ctx.Err(); err != nil {
+				report.Results[i] = cancelledResult(trigger, err)
+				return
+			}
+			args := trigger.Args
+			if args == nil {
+				args = sduptemplates.CapabilityArgument{}
+			}
+			result := batchResult{batchTrigger: trigger, Status: http.StatusNoContent}
+			if err := authorizedCache.TriggerCapability(trigger.DeviceID, trigger.CapabilityKey, args); err != nil {
+				problem := faults.NewProblem(err)
+				result.Status = problem.Status
+				result.Error = &problem
+			}
+			report.Results[i] = result
+		}(i)
+	}
+	wait.Wait()
+
+	for _, result := range report.Results {
+		switch {
+		case result.Error == nil:
+			report.Succeeded++
+		case result.Error.Code == faults.CodeCancelled:
+			report.Cancelled++
+		default:
+			report.Failed++
+		}
+	}
+	writeJSON(writer, http.StatusOK, report)
+}
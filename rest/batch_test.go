@@ -0,0 +1,65 @@
+package rest
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Kaese72/sdup-rest/faults"
+	"github.com/Kaese72/sdup-rest/ratelimit"
+)
+
+const twoTriggers = `{"triggers": [{"deviceID": "lamp", "capabilityKey": "activate"}, {"deviceID": "lamp", "capabilityKey": "activate"}]}`
+
+func TestBatchRefusesMoreThanTheBurst(t *testing.T) {
+	rest, _ := newTestRest(t)
+	rest.rateLimits.PerPrincipal = ratelimit.LimitConfig{RequestsPerSecond: 1, Burst: 1}
+	rest.principalLimiter = ratelimit.NewLimiter(rest.rateLimits.PerPrincipal)
+
+	recorder := httptest.NewRecorder()
+	withViewer(http.HandlerFunc(rest.triggerBatch)).ServeHTTP(recorder, httptest.NewRequest("POST", "/rest/v0/capabilities:batch", strings.NewReader(twoTriggers)))
+	if recorder.Code != http.StatusUnprocessableEntity {
+		t.Errorf("expected 422, got %d", recorder.Code)
+	}
+}
+
+func TestBatchReportsCancelledTriggers(t *testing.T) {
+	rest, _ := newTestRest(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest("POST", "/rest/v0/capabilities:batch", strings.NewReader(twoTriggers)).WithContext(ctx)
+	withViewer(http.HandlerFunc(rest.triggerBatch)).ServeHTTP(recorder, request)
+
+	var report batchReport
+	if err := json.NewDecoder(recorder.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	if report.Cancelled != 2 || report.Succeeded != 0 || report.Failed != 0 {
+		t.Errorf("expected every trigger to be cancelled, got %+v", report)
+	}
+	for _, result := range report.Results {
+		if result.Error == nil || result.Error.Code != faults.CodeCancelled {
+			t.Errorf("expected a cancelled result, got %+v", result)
+		}
+	}
+}
+
+func TestBatchReportsInvalidFilters(t *testing.T) {
+	rest, _ := newTestRest(t)
+	body := `{"filters": [{"key": "active", "operator": "lt", "value": true}], "capabilityKey": "activate"}`
+
+	recorder := httptest.NewRecorder()
+	withViewer(http.HandlerFunc(rest.triggerBatch)).ServeHTTP(recorder, httptest.NewRequest("POST", "/rest/v0/capabilities:batch", strings.NewReader(body)))
+	var problem faults.Problem
+	if err := json.NewDecoder(recorder.Body).Decode(&problem); err != nil {
+		t.Fatal(err)
+	}
+	if recorder.Code != http.StatusUnprocessableEntity || problem.Code != faults.CodeValidationFailed {
+		t.Errorf("expected a validation problem, got %d %+v", recorder.Code, problem)
+	}
+}
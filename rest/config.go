@@ -0,0 +1,64 @@
+package rest
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Client certificate modes
+const (
+	ClientAuthNone     = "none"
+	ClientAuthOptional = "optional"
+	ClientAuthRequired = "required"
+)
+
+// TLSConfig for the REST API
+type TLSConfig struct {
+	// PlainHTTP serves the API without TLS. Only meant for running behind a TLS terminating proxy,
+	// client certificates can then not be used.
+	PlainHTTP bool   `json:"plain-http"`
+	CertFile  string `json:"cert-file"`
+	KeyFile   string `json:"key-file"`
+	// ClientCAFile is the CA client certificates must be signed by
+	ClientCAFile string `json:"client-ca-file"`
+	// ClientAuth is one of none, optional and required. It defaults to optional when a client CA is configured
+	ClientAuth string `json:"client-auth"`
+}
+
+func (conf *TLSConfig) PopulateExample() {
+	conf.CertFile = "/etc/sdup-rest/server.crt"
+	conf.KeyFile = "/etc/sdup-rest/server.key"
+	conf.ClientCAFile = "/etc/sdup-rest/client-ca.crt"
+	conf.ClientAuth = ClientAuthOptional
+}
+
+func (conf TLSConfig) clientAuth() string {
+	if conf.ClientAuth == "" && conf.ClientCAFile != "" {
+		return ClientAuthOptional
+	} else if conf.ClientAuth == "" {
+		return ClientAuthNone
+	}
+	return conf.ClientAuth
+}
+
+func (conf TLSConfig) Validate() error {
+	if conf.PlainHTTP {
+		if conf.CertFile != "" || conf.KeyFile != "" || conf.ClientCAFile != "" {
+			return errors.New("tls files can not be used with plain-http")
+		}
+		return nil
+	}
+	if conf.CertFile == "" || conf.KeyFile == "" {
+		return errors.New("tls cert-file and key-file must be set unless plain-http is enabled")
+	}
+	switch conf.clientAuth() {
+	case ClientAuthNone:
+	case ClientAuthOptional, ClientAuthRequired:
+		if conf.ClientCAFile == "" {
+			return fmt.Errorf("tls client-auth '%s' requires client-ca-file", conf.clientAuth())
+		}
+	default:
+		return fmt.Errorf("tls client-auth must be one of %s, %s and %s", ClientAuthNone, ClientAuthOptional, ClientAuthRequired)
+	}
+	return nil
+}
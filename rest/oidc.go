@@ -0,0 +1,55 @@
+package rest
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/Kaese72/sdup-lib/logging"
+	"github.com/Kaese72/sdup-rest/audit"
+	"github.com/Kaese72/sdup-rest/faults"
+)
+
+// oidcLogin sends the browser to the identity provider, remembering in a cookie which login it started
+func (rest *SDUPRest) oidcLogin(writer http.ResponseWriter, reader *http.Request) {
+	if !rest.authentication.OIDCEnabled() {
+		faults.ServeProblem(writer, reader, errNoIdentityProvider)
+		return
+	}
+	url, state, err := rest.authentication.OIDCLoginURL()
+	if err != nil {
+		faults.ServeProblem(writer, reader, err)
+		return
+	}
+	// Lax, since the identity provider redirects back from another site
+	http.SetCookie(writer, &http.Cookie{Name: oidcStateCookieName, Value: state, Path: oidcPath, MaxAge: 600, HttpOnly: true, Secure: true, SameSite: http.SameSiteLaxMode})
+	http.Redirect(writer, reader, url, http.StatusFound)
+}
+
+// oidcCallback completes a login when the identity provider sends the browser back
+func (rest *SDUPRest) oidcCallback(writer http.ResponseWriter, reader *http.Request) {
+	if !rest.authentication.OIDCEnabled() {
+		faults.ServeProblem(writer, reader, errNoIdentityProvider)
+		return
+	}
+	query := reader.URL.Query()
+	if idpError := query.Get("error"); idpError != "" {
+		faults.ServeProblem(writer, reader, faults.ErrUnauthorized{Err: fmt.Errorf("Identity provider refused login: %s", idpError)})
+		return
+	}
+	cookie, err := reader.Cookie(oidcStateCookieName)
+	if err != nil || cookie.Value != query.Get("state") {
+		faults.ServeProblem(writer, reader, faults.ErrForbidden{Action: "complete a login started by another browser"})
+		return
+	}
+	http.SetCookie(writer, &http.Cookie{Name: oidcStateCookieName, Value: "", Path: oidcPath, MaxAge: -1, HttpOnly: true, Secure: true})
+
+	user, token, refreshToken, err := rest.authentication.OIDCLogin(reader.Context(), query.Get("state"), query.Get("code"))
+	rest.recordAuth(reader, audit.TypeLogin, user, err)
+	if err != nil {
+		logging.Error("OIDC login failed", map[string]string{"error": err.Error()})
+		faults.ServeProblem(writer, reader, faults.ErrUnauthorized{Err: err})
+		return
+	}
+	rest.setRefreshCookie(writer, refreshToken)
+	writeJSON(writer, http.StatusOK, tokenBody{Token: token})
+}
@@ -0,0 +1,245 @@
+package rest
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Kaese72/sdup-rest/audit"
+	"github.com/Kaese72/sdup-rest/auth"
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+const testSigningKeyEnv = "SDUP_REST_TEST_SIGNING_KEY"
+
+// mockIdP is an identity provider serving discovery, its keys and a token endpoint
+type mockIdP struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+
+	lock sync.Mutex
+	// nonce is put in the next id token, as the provider would remember it from the authorization request
+	nonce string
+}
+
+func newMockIdP(t *testing.T) *mockIdP {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := &mockIdP{key: key}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(writer http.ResponseWriter, reader *http.Request) {
+		writeJSON(writer, http.StatusOK, map[string]interface{}{
+			"issuer":                                idp.server.URL,
+			"authorization_endpoint":                idp.server.URL + "/authorize",
+			"token_endpoint":                        idp.server.URL + "/token",
+			"jwks_uri":                              idp.server.URL + "/keys",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/keys", func(writer http.ResponseWriter, reader *http.Request) {
+		writeJSON(writer, http.StatusOK, map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "idp",
+			"alg": "RS256",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(key.PublicKey.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.PublicKey.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(writer http.ResponseWriter, reader *http.Request) {
+		if err := reader.ParseForm(); err != nil || reader.PostForm.Get("code") != "the-code" {
+			writeJSON(writer, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+			return
+		}
+		idp.lock.Lock()
+		nonce := idp.nonce
+		idp.lock.Unlock()
+		writeJSON(writer, http.StatusOK, map[string]interface{}{
+			"access_token": "opaque",
+			"token_type":   "Bearer",
+			"expires_in":   300,
+			"id_token":     idp.sign(t, jwt.MapClaims{"aud": "sdup-rest", "nonce": nonce}),
+		})
+	})
+	idp.server = httptest.NewServer(mux)
+	return idp
+}
+
+// sign issues a token for kaese with the viewer role, claims override the defaults
+func (idp *mockIdP) sign(t *testing.T, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss":   idp.server.URL,
+		"sub":   "kaese",
+		"roles": []string{"viewer"},
+		"iat":   time.Now().Unix(),
+		"exp":   time.Now().Add(time.Minute).Unix(),
+	})
+	for name, value := range claims {
+		token.Claims.(jwt.MapClaims)[name] = value
+	}
+	token.Header["kid"] = "idp"
+	signed, err := token.SignedString(idp.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+// newOIDCRest delegates logins to the identity provider. The local user kaese is an administrator
+func newOIDCRest(t *testing.T, idp *mockIdP) *SDUPRest {
+	os.Setenv(testSigningKeyEnv, "a test secret that is long enough to sign with")
+	apiKeys, err := auth.NewAPIKeyStore(auth.APIKeysConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := auth.Config{
+		Issuer:             "sdup-rest",
+		AccessTokenMinutes: 5,
+		RefreshTokenHours:  1,
+		SigningKey:         auth.KeyConfig{ID: "test", Env: testSigningKeyEnv},
+		RBAC: auth.RBACConfig{
+			Roles: map[string]auth.RoleConfig{
+				"admin":  {Devices: []string{"*"}, Capabilities: []string{"*"}, Admin: true},
+				"viewer": {Devices: []string{"*"}},
+			},
+			UserRoles: map[string][]string{"kaese": {"admin"}},
+		},
+		OIDC: auth.OIDCConfig{
+			Issuer:      idp.server.URL,
+			ClientID:    "sdup-rest",
+			RedirectURL: "https://sdup-rest.example.com/rest/v0/auth/oidc/callback",
+			RolesClaim:  "roles",
+		},
+	}
+	wrap, err := auth.NewJWTWrapper(config, nil, apiKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain, err := auth.NewChain(config, wrap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auditLog, _ := audit.NewLog(audit.Config{})
+	return &SDUPRest{authentication: wrap, authChain: chain, audit: auditLog}
+}
+
+// startOIDCLogin returns the state cookie and, as the identity provider would see it, the authorization request
+func startOIDCLogin(t *testing.T, rest *SDUPRest) (*http.Cookie, url.Values) {
+	recorder := httptest.NewRecorder()
+	rest.oidcLogin(recorder, httptest.NewRequest("GET", oidcPath+"/login", nil))
+	if recorder.Code != http.StatusFound {
+		t.Fatalf("expected a redirect, got %d", recorder.Code)
+	}
+	location, err := url.Parse(recorder.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cookies := recorder.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != oidcStateCookieName {
+		t.Fatalf("expected a state cookie, got %v", cookies)
+	}
+	return cookies[0], location.Query()
+}
+
+func callback(rest *SDUPRest, cookie *http.Cookie, state string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest("GET", oidcPath+"/callback?"+url.Values{"state": {state}, "code": {"the-code"}}.Encode(), nil)
+	if cookie != nil {
+		request.AddCookie(cookie)
+	}
+	recorder := httptest.NewRecorder()
+	rest.oidcCallback(recorder, request)
+	return recorder
+}
+
+func TestOIDCCodeFlow(t *testing.T) {
+	idp := newMockIdP(t)
+	defer idp.server.Close()
+	rest := newOIDCRest(t, idp)
+
+	cookie, authorization := startOIDCLogin(t, rest)
+	idp.lock.Lock()
+	idp.nonce = authorization.Get("nonce")
+	idp.lock.Unlock()
+
+	recorder := callback(rest, cookie, authorization.Get("state"))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+	var body tokenBody
+	if err := json.NewDecoder(recorder.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	user, err := rest.authentication.ValidateToken(body.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The local kaese is an administrator, the one of the identity provider is not
+	if user.Name != "oidc:kaese" || len(user.Roles) != 1 || user.Roles[0] != "viewer" {
+		t.Errorf("expected oidc:kaese with the viewer role, got %+v", user)
+	}
+
+	// The state is used up
+	if recorder := callback(rest, cookie, authorization.Get("state")); recorder.Code != http.StatusUnauthorized {
+		t.Errorf("expected a replayed login to be refused with 401, got %d", recorder.Code)
+	}
+}
+
+func TestOIDCStateCookieMismatch(t *testing.T) {
+	idp := newMockIdP(t)
+	defer idp.server.Close()
+	rest := newOIDCRest(t, idp)
+
+	cookie, authorization := startOIDCLogin(t, rest)
+	otherCookie, _ := startOIDCLogin(t, rest)
+
+	if recorder := callback(rest, otherCookie, authorization.Get("state")); recorder.Code != http.StatusForbidden {
+		t.Errorf("expected a login started by another browser to be refused with 403, got %d", recorder.Code)
+	}
+	if recorder := callback(rest, nil, authorization.Get("state")); recorder.Code != http.StatusForbidden {
+		t.Errorf("expected a login without a state cookie to be refused with 403, got %d", recorder.Code)
+	}
+	if recorder := callback(rest, cookie, "forged"); recorder.Code != http.StatusForbidden {
+		t.Errorf("expected a forged state to be refused with 403, got %d", recorder.Code)
+	}
+}
+
+func TestOIDCBearerTokens(t *testing.T) {
+	idp := newMockIdP(t)
+	defer idp.server.Close()
+	rest := newOIDCRest(t, idp)
+
+	authenticate := func(token string) (auth.Principal, error) {
+		request := httptest.NewRequest("GET", "/rest/v0/devices", nil)
+		request.Header.Set("Authorization", "Bearer "+token)
+		return rest.authChain.Authenticate(auth.HTTPCredentials(request))
+	}
+
+	principal, err := authenticate(idp.sign(t, jwt.MapClaims{"aud": "sdup-rest"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if principal.Name != "oidc:kaese" || principal.Method != auth.MethodOIDC || principal.IsAdmin() {
+		t.Errorf("expected oidc:kaese without the roles of the local kaese, got %+v", principal)
+	}
+
+	for name, claims := range map[string]jwt.MapClaims{
+		"wrong issuer":   {"aud": "sdup-rest", "iss": "https://idp.example.com"},
+		"wrong audience": {"aud": "another-service"},
+		"expired":        {"aud": "sdup-rest", "exp": time.Now().Add(-time.Minute).Unix()},
+	} {
+		if _, err := authenticate(idp.sign(t, claims)); err == nil {
+			t.Errorf("%s: the token was accepted", name)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package rest
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Kaese72/sdup-rest/auth"
+	"github.com/Kaese72/sdup-rest/faults"
+	"github.com/Kaese72/sdup-rest/metrics"
+	"github.com/Kaese72/sdup-rest/ratelimit"
+)
+
+// Names of the limits in metrics
+const (
+	limitIP        = "ip"
+	limitLogin     = "login"
+	limitPrincipal = "principal"
+)
+
+// clientAddress is who a request is from, as far as rate limits are concerned
+func (rest *SDUPRest) clientAddress(reader *http.Request) string {
+	if rest.rateLimits.TrustForwardedFor {
+		if forwarded := reader.Header.Get("X-Forwarded-For"); forwarded != "" {
+			addresses := strings.Split(forwarded, ",")
+			return strings.TrimSpace(addresses[len(addresses)-1])
+		}
+	}
+	host, _, err := net.SplitHostPort(reader.RemoteAddr)
+	if err != nil {
+		return reader.RemoteAddr
+	}
+	return host
+}
+
+func serveRateLimited(writer http.ResponseWriter, reader *http.Request, limit string, retryAfter time.Duration) {
+	metrics.RateLimited.WithLabelValues(limit).Inc()
+	faults.ServeProblem(writer, reader, faults.ErrRateLimited{RetryAfter: retryAfter})
+}
+
+// ipRateLimitMiddleware limits requests by client address, and attempts to authenticate more strictly
+func (rest *SDUPRest) ipRateLimitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, reader *http.Request) {
+		address := rest.clientAddress(reader)
+		if ok, retryAfter := rest.ipLimiter.Allow(address); !ok {
+			serveRateLimited(writer, reader, limitIP, retryAfter)
+			return
+		}
+		if strings.HasPrefix(reader.URL.Path, authPath+"/") {
+			if ok, retryAfter := rest.loginLimiter.Allow(address); !ok {
+				serveRateLimited(writer, reader, limitLogin, retryAfter)
+				return
+			}
+		}
+		next.ServeHTTP(writer, reader)
+	})
+}
+
+// principalRateLimitMiddleware must run after authenticationMiddleware
+func (rest *SDUPRest) principalRateLimitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, reader *http.Request) {
+		principal, _ := auth.PrincipalFromContext(reader.Context())
+		// Anonymous requests share a principal, they are limited by address instead
+		if principal.Method != auth.MethodAnonymous {
+			if ok, retryAfter := rest.principalLimiter.Allow(principalLimitKey(principal)); !ok {
+				serveRateLimited(writer, reader, limitPrincipal, retryAfter)
+				return
+			}
+		}
+		next.ServeHTTP(writer, reader)
+	})
+}
+
+// chargeBatch takes a token from the principal's bucket for every trigger of a batch, on top of the one the request took.
+// Batches larger than either the principal or the trigger limit could ever allow are refused as invalid.
+// It returns false if the batch was refused, in which case the response has been served.
+func (rest *SDUPRest) chargeBatch(writer http.ResponseWriter, reader *http.Request, size int) bool {
+	for _, limit := range []ratelimit.LimitConfig{rest.rateLimits.PerPrincipal, rest.rateLimits.Triggers} {
+		if limit.Enabled() && size > limit.Burst {
+			faults.ServeProblem(writer, reader, faults.ErrValidation{Message: fmt.Sprintf("A batch may trigger at most %d capabilities at a time, this one would trigger %d", limit.Burst, size)})
+			return false
+		}
+	}
+	principal, _ := auth.PrincipalFromContext(reader.Context())
+	if principal.Method == auth.MethodAnonymous || size <= 1 {
+		return true
+	}
+	if ok, retryAfter := rest.principalLimiter.AllowN(principalLimitKey(principal), size-1); !ok {
+		serveRateLimited(writer, reader, limitPrincipal, retryAfter)
+		return false
+	}
+	return true
+}
+
+// principalLimitKey is the bucket of a principal
+func principalLimitKey(principal auth.Principal) string {
+	return principal.Method + ":" + principal.Name
+}
+
+func newLimiters(config ratelimit.Config) (ip, login, principal *ratelimit.Limiter) {
+	return ratelimit.NewLimiter(config.PerIP), ratelimit.NewLimiter(config.Login), ratelimit.NewLimiter(config.PerPrincipal)
+}
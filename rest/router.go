@@ -1,150 +1,205 @@
 package rest
 
 import (
-	"crypto/tls"
-	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"net/http"
-	"strings"
-	"time"
 
 	"github.com/Kaese72/sdup-lib/httpsdup"
 	"github.com/Kaese72/sdup-lib/logging"
 	"github.com/Kaese72/sdup-lib/sduptemplates"
-	"github.com/Kaese72/sdup-lib/subscription"
+	"github.com/Kaese72/sdup-rest/audit"
+	"github.com/Kaese72/sdup-rest/auth"
 	"github.com/Kaese72/sdup-rest/cache"
 	"github.com/Kaese72/sdup-rest/cache/filters"
+	"github.com/Kaese72/sdup-rest/faults"
+	"github.com/Kaese72/sdup-rest/graphqlsdup"
+	"github.com/Kaese72/sdup-rest/ratelimit"
+	"github.com/Kaese72/sdup-rest/stream"
+	"github.com/Kaese72/sdup-rest/webhooks"
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 type SDUPRest struct {
-	authentication JWTWrapper
+	authentication auth.JWTWrapper
+	authChain      auth.Chain
 	config         httpsdup.Config
+	tlsConfig      TLSConfig
 	cache          cache.SDUPCache
+	broker         *stream.Broker
+	webhooks       *webhooks.Manager
+	audit          *audit.Log
+
+	rateLimits       ratelimit.Config
+	ipLimiter        *ratelimit.Limiter
+	loginLimiter     *ratelimit.Limiter
+	principalLimiter *ratelimit.Limiter
 }
 
-func NewSDUPRestCache(config httpsdup.Config, cache cache.SDUPCache) *SDUPRest {
+// NewSDUPRestCache creates the REST API on top of an initialized cache and the broker distributing its updates
+func NewSDUPRestCache(config httpsdup.Config, tlsConfig TLSConfig, cache cache.SDUPCache, broker *stream.Broker, authentication auth.JWTWrapper, authChain auth.Chain, webhooks *webhooks.Manager, auditLog *audit.Log, rateLimits ratelimit.Config) *SDUPRest {
 	var rest SDUPRest
 	rest.config = config
-	//FIXME Config for key
-	rest.authentication = NewJWTWrapper("kindofsecretkey", "sdup-rest", 5, 24)
+	rest.tlsConfig = tlsConfig
+	rest.authentication = authentication
+	rest.authChain = authChain
 	rest.cache = cache
+	rest.broker = broker
+	rest.webhooks = webhooks
+	rest.audit = auditLog
+	rest.rateLimits = rateLimits
+	rest.ipLimiter, rest.loginLimiter, rest.principalLimiter = newLimiters(rateLimits)
 
 	return &rest
 }
 
-const cookieName = "sdup-refresh-1"
-const loginPath = "/rest/v0/auth/login"
+// The refresh cookie changed format from a JWT to an opaque token in version 2
+const cookieName = "sdup-refresh-2"
+const authPath = "/rest/v0/auth"
+const loginPath = authPath + "/login"
+const refreshPath = authPath + "/refresh"
+const logoutPath = authPath + "/logout"
+const oidcPath = authPath + "/oidc"
 
-func (rest *SDUPRest) ListenAndServe() error {
-	_, channel, err := rest.cache.Initialize()
-	if err != nil {
-		//FIXME No reason to panic
-		panic(err)
-	}
-	subs := subscription.NewSubscriptions(channel)
-	router := mux.NewRouter()
+var errNoIdentityProvider = faults.ErrNotFound{Err: errors.New("No identity provider is configured")}
 
-	router.HandleFunc(loginPath, func(writer http.ResponseWriter, reader *http.Request) {
-		// ############################################
-		// # Try to authenticate with cookie contents #
-		// ############################################
-		//FIXME What about multiple cookies ?
-		cookie, err := reader.Cookie(cookieName)
-		if err == nil {
-			if !cookie.Expires.After(time.Now()) {
-				//Cookie is not expired and can be used
-				user, err := rest.authentication.ValidateToken(cookie.Value)
-				if err != nil {
-					http.Error(writer, "Could not parse cookie content", http.StatusInternalServerError)
-					return
-				}
-				token, err := rest.authentication.GenerateLoginToken(user.Name)
-				if err != nil {
-					http.Error(writer, err.Error(), http.StatusForbidden)
-					return
-				}
-				http.Error(writer, fmt.Sprintf("{\"token\": \"%s\"}", token), http.StatusOK)
-				return
+// oidcStateCookieName binds a login at the identity provider to the browser that started it
+const oidcStateCookieName = "sdup-oidc-state"
+
+// tokenBody is returned when logging in or refreshing
+type tokenBody struct {
+	Token string `json:"token"`
+}
+
+// setRefreshCookie hands the refresh token to the client, only ever to be sent back to the auth endpoints
+func (rest *SDUPRest) setRefreshCookie(writer http.ResponseWriter, refreshToken string) {
+	http.SetCookie(writer, &http.Cookie{
+		Name:     cookieName,
+		Value:    refreshToken,
+		Path:     authPath,
+		MaxAge:   int(rest.authentication.RefreshExpiration().Seconds()),
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+func (rest *SDUPRest) clearRefreshCookie(writer http.ResponseWriter) {
+	http.SetCookie(writer, &http.Cookie{Name: cookieName, Value: "", Path: authPath, MaxAge: -1, HttpOnly: true, Secure: true})
+}
+
+// parseAttributeFilters collects all attributefilter query parameters of a request
+func parseAttributeFilters(reader *http.Request) (filters.AttributeFilters, error) {
+	attrFilters := filters.AttributeFilters{}
+	if afparams, ok := reader.URL.Query()["attributefilter"]; ok {
+		for _, afparam := range afparams {
+			var ps filters.AttributeFilters
+			err := json.Unmarshal([]byte(afparam), &ps)
+			if err != nil {
+				return nil, err
 			}
-			//Cookie is expired. Move along
+			attrFilters = append(attrFilters, ps...)
 		}
+	}
+	return attrFilters, nil
+}
 
-		// ##########################################
-		// # Try to authenticate with body contents #
-		// ##########################################
-		var login LoginBody
-		err = json.NewDecoder(reader.Body).Decode(&login)
+func (rest *SDUPRest) ListenAndServe() error {
+	router := mux.NewRouter()
+	router.Use(rest.ipRateLimitMiddleware)
+
+	router.HandleFunc(loginPath, func(writer http.ResponseWriter, reader *http.Request) {
+		var login auth.LoginBody
+		err := json.NewDecoder(reader.Body).Decode(&login)
 		if err != nil {
-			http.Error(writer, err.Error(), http.StatusBadRequest)
+			faults.ServeProblem(writer, reader, faults.ErrMalformedRequest{Err: err})
 			return
 		}
 		token, err := rest.authentication.UserPassToToken(login.User, login.Password)
+		rest.recordAuth(reader, audit.TypeLogin, login.User, err)
+		if err != nil {
+			faults.ServeProblem(writer, reader, faults.ErrUnauthorized{Err: err})
+			return
+		}
+
+		refreshToken, err := rest.authentication.NewRefreshToken(login.User)
 		if err != nil {
-			http.Error(writer, err.Error(), http.StatusForbidden)
+			faults.ServeProblem(writer, reader, err)
 			return
 		}
+		rest.setRefreshCookie(writer, refreshToken)
+		writeJSON(writer, http.StatusOK, tokenBody{Token: token})
+	}).Methods("POST")
 
-		refreshToken, err := rest.authentication.GenerateRefreshToken(login.User)
+	router.HandleFunc(refreshPath, func(writer http.ResponseWriter, reader *http.Request) {
+		cookie, err := reader.Cookie(cookieName)
+		if err != nil {
+			faults.ServeProblem(writer, reader, faults.ErrUnauthorized{Err: errors.New("No refresh token provided")})
+			return
+		}
+		user, token, refreshToken, err := rest.authentication.Refresh(cookie.Value)
+		rest.recordAuth(reader, audit.TypeRefresh, user, err)
 		if err != nil {
-			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			rest.clearRefreshCookie(writer)
+			faults.ServeProblem(writer, reader, faults.ErrUnauthorized{Err: err})
+			return
+		}
+		rest.setRefreshCookie(writer, refreshToken)
+		writeJSON(writer, http.StatusOK, tokenBody{Token: token})
+	}).Methods("POST")
+
+	router.HandleFunc(logoutPath, func(writer http.ResponseWriter, reader *http.Request) {
+		if cookie, err := reader.Cookie(cookieName); err == nil {
+			rest.recordAuth(reader, audit.TypeLogout, rest.authentication.Logout(cookie.Value), nil)
 		}
-		refreshCookie := http.Cookie{Name: cookieName, Value: refreshToken, HttpOnly: true, Path: loginPath}
-		http.SetCookie(writer, &refreshCookie)
-		http.Error(writer, fmt.Sprintf("{\"token\": \"%s\"}", token), http.StatusOK)
+		rest.clearRefreshCookie(writer)
+		writer.WriteHeader(http.StatusNoContent)
 	}).Methods("POST")
 
-	//Everything else (not /auth/login) should have the authentication middleware
+	router.HandleFunc(oidcPath+"/login", rest.oidcLogin).Methods("GET")
+	router.HandleFunc(oidcPath+"/callback", rest.oidcCallback).Methods("GET")
+
+	router.Handle("/metrics", promhttp.Handler()).Methods("GET")
+
+	router.HandleFunc("/.well-known/jwks.json", func(writer http.ResponseWriter, reader *http.Request) {
+		// Keys change rarely, but should be picked up reasonably soon after a rotation
+		writer.Header().Set("Cache-Control", "public, max-age=300")
+		writeJSON(writer, http.StatusOK, rest.authentication.JWKS())
+	}).Methods("GET")
+
+	//Everything else (not /auth/*) should have the authentication middleware
 	apiv0 := router.PathPrefix("/rest/v0/").Subrouter()
-	apiv0.Use(rest.authenticationMiddleware)
+	apiv0.Use(rest.authenticationMiddleware, rest.principalRateLimitMiddleware)
 
 	apiv0.HandleFunc("/devices", func(writer http.ResponseWriter, reader *http.Request) {
-		attrFilters := filters.AttributeFilters{}
-		if afparams, ok := reader.URL.Query()["attributefilter"]; ok {
-			for _, afparam := range afparams {
-				var ps filters.AttributeFilters
-				err := json.Unmarshal([]byte(afparam), &ps)
-				if err != nil {
-					http.Error(writer, err.Error(), http.StatusInternalServerError)
-					return
-				}
-				attrFilters = append(attrFilters, ps...)
-			}
-		}
-
-		devices, err := rest.cache.Devices(attrFilters)
+		attrFilters, err := parseAttributeFilters(reader)
 		if err != nil {
-			//log.Log(log.Error, err.Error(), nil)
-			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			faults.ServeProblem(writer, reader, faults.ErrMalformedRequest{Err: err})
 			return
 		}
 
-		jsonEncoded, err := json.MarshalIndent(devices, "", "   ")
+		devices, err := auth.AuthorizedCache(reader.Context(), rest.cache).Devices(attrFilters)
 		if err != nil {
 			//log.Log(log.Error, err.Error(), nil)
-			http.Error(writer, "Failed to JSON encode SDUPDevices", http.StatusInternalServerError)
+			faults.ServeProblem(writer, reader, err)
+			return
 		}
-		writer.Write(jsonEncoded)
+		writeJSON(writer, http.StatusOK, devices)
 	})
 
 	apiv0.HandleFunc("/devices/{deviceID}", func(writer http.ResponseWriter, reader *http.Request) {
 		vars := mux.Vars(reader)
 		deviceID := vars["deviceID"]
 
-		device, err := rest.cache.Device(sduptemplates.DeviceID(deviceID))
-		if err != nil {
-			cache.ServeErrorContent(err, writer)
-		}
-		jsonEncoded, err := json.MarshalIndent(device, "", "   ")
+		device, err := auth.AuthorizedCache(reader.Context(), rest.cache).Device(sduptemplates.DeviceID(deviceID))
 		if err != nil {
-			//log.Log(log.Error, err.Error(), nil)
-			http.Error(writer, "Failed to JSON encode SDUPDevices", http.StatusInternalServerError)
+			faults.ServeProblem(writer, reader, err)
+			return
 		}
-		writer.Write(jsonEncoded)
-
+		writeJSON(writer, http.StatusOK, device)
 	}).Methods("GET")
 
 	apiv0.HandleFunc("/capability/{deviceID}/{capabilityKey}", func(writer http.ResponseWriter, reader *http.Request) {
@@ -160,111 +215,153 @@ func (rest *SDUPRest) ListenAndServe() error {
 				//No body was sent. That is fine
 				args = sduptemplates.CapabilityArgument{}
 			} else {
-				http.Error(writer, err.Error(), http.StatusBadRequest)
+				faults.ServeProblem(writer, reader, faults.ErrMalformedRequest{Err: err})
 				return
 			}
 		}
-		err = rest.cache.TriggerCapability(sduptemplates.DeviceID(deviceID), sduptemplates.CapabilityKey(capabilityKey), args)
+		waitConditions, waitTimeout, err := parseWait(reader.URL.Query())
 		if err != nil {
-			//FIXME Do not use httpsdup
-			http.Error(writer, err.Error(), httpsdup.HTTPStatusCode(err))
+			faults.ServeProblem(writer, reader, err)
 			return
+		}
+		authorizedCache := auth.AuthorizedCache(reader.Context(), rest.cache)
+		var subscription *stream.Subscription
+		if len(waitConditions) > 0 {
+			if err := checkWaitAttributes(authorizedCache, sduptemplates.DeviceID(deviceID), waitConditions); err != nil {
+				faults.ServeProblem(writer, reader, err)
+				return
+			}
+			subscription = rest.broker.Subscribe()
+			defer rest.broker.Unsubscribe(subscription)
+		}
 
+		err = authorizedCache.TriggerCapability(sduptemplates.DeviceID(deviceID), sduptemplates.CapabilityKey(capabilityKey), args)
+		if err != nil {
+			faults.ServeProblem(writer, reader, err)
+			return
 		}
-		http.Error(writer, "OK", http.StatusOK)
+		if subscription == nil {
+			// v0 used to answer 200 with a plain text "OK". It answers 204 since errors are problem details,
+			// clients of v0 should accept any 2xx status. Later API versions keep 204
+			writer.WriteHeader(http.StatusNoContent)
+			return
+		}
+		device, err := waitForState(reader.Context(), subscription, authorizedCache, sduptemplates.DeviceID(deviceID), waitConditions, waitTimeout)
+		if err != nil {
+			faults.ServeProblem(writer, reader, err)
+			return
+		}
+		writeJSON(writer, http.StatusOK, device)
 
 	}).Methods("POST")
 
-	apiv0.HandleFunc("/subscribe", func(writer http.ResponseWriter, reader *http.Request) {
-		//log.Log(log.Info, "Started SSE handler", nil)
-		// prepare the header
-		writer.Header().Set("Content-Type", "text/event-stream")
-		writer.Header().Set("Cache-Control", "no-cache")
-		writer.Header().Set("Connection", "keep-alive")
-		writer.Header().Set("Access-Control-Allow-Origin", "*")
-
-		flusher, _ := writer.(http.Flusher)
-
-		subscription := subs.Subscribe()
-		doneChan := reader.Context().Done()
-		for {
-
-			select {
-			// connection is closed then defer will be executed
-			case <-doneChan:
-				// Communicate the cancellation of this subscription
-				subs.UnSubscribe(subscription)
-				doneChan = nil
-
-			case event, ok := <-subscription.Updates():
-				if ok {
-					jsonString, err := json.Marshal(event)
-					if err != nil {
-						//log.Log(log.Error, "Failed to Marshal device update", nil)
-
-					} else {
-						fmt.Fprintf(writer, "data: %s\n\n", jsonString)
-						flusher.Flush()
-					}
-
-				} else {
-					return
-				}
-			}
-		}
-	})
+	apiv0.HandleFunc("/capabilities:batch", rest.triggerBatch).Methods("POST")
+
+	apiv0.HandleFunc("/subscribe", rest.subscribeHandler(rest.broker))
 
-	caCert, err := ioutil.ReadFile("~/Development/Private/huemie/huemie-ca/CA/rootCACert.pem")
+	apiv0.HandleFunc("/ws", rest.websocketHandler(rest.broker))
+
+	graphqlHandler, err := graphqlsdup.NewHandler(rest.cache, rest.broker)
 	if err != nil {
 		logging.Error(err.Error())
 		return err
 	}
+	apiv0.Handle("/graphql", graphqlHandler).Methods("GET", "POST")
 
-	caCertPool := x509.NewCertPool()
-	caCertPool.AppendCertsFromPEM(caCert)
+	//Administrative endpoints additionally require an admin role
+	admin := apiv0.PathPrefix("/admin/").Subrouter()
+	admin.Use(rest.adminMiddleware)
 
-	tlsConfig := &tls.Config{
-		ClientCAs:  caCertPool,
-		ClientAuth: tls.VerifyClientCertIfGiven,
-	}
+	admin.HandleFunc("/webhooks", rest.listWebhooks).Methods("GET")
+	admin.HandleFunc("/webhooks", rest.createWebhook).Methods("POST")
+	admin.HandleFunc("/webhooks/{webhookID}", rest.getWebhook).Methods("GET")
+	admin.HandleFunc("/webhooks/{webhookID}", rest.updateWebhook).Methods("PUT")
+	admin.HandleFunc("/webhooks/{webhookID}", rest.deleteWebhook).Methods("DELETE")
+
+	admin.HandleFunc("/users", rest.listUsers).Methods("GET")
+	admin.HandleFunc("/users", rest.createUser).Methods("POST")
+	admin.HandleFunc("/users/{userName}/disable", rest.setUserDisabled(true)).Methods("POST")
+	admin.HandleFunc("/users/{userName}/enable", rest.setUserDisabled(false)).Methods("POST")
+	admin.HandleFunc("/users/{userName}/password", rest.resetUserPassword).Methods("PUT")
+
+	admin.HandleFunc("/api-keys", rest.listAPIKeys).Methods("GET")
+	admin.HandleFunc("/api-keys", rest.createAPIKey).Methods("POST")
+	admin.HandleFunc("/api-keys/{keyID}", rest.revokeAPIKey).Methods("DELETE")
+
+	admin.HandleFunc("/audit", rest.queryAudit).Methods("GET")
 
 	server := &http.Server{
-		Handler:   router,
-		Addr:      fmt.Sprintf("%s:%d", rest.config.ListenAddress, rest.config.ListenPort),
-		TLSConfig: tlsConfig,
+		Handler: router,
+		Addr:    fmt.Sprintf("%s:%d", rest.config.ListenAddress, rest.config.ListenPort),
 	}
 
-	if err := server.ListenAndServeTLS("~/Development/Private/huemie/huemie-ca/sdup-rest/dev.sdup-rest.crt", "~/Development/Private/huemie/huemie-ca/sdup-rest/dev.sdup-rest.key"); err != nil {
+	if rest.tlsConfig.PlainHTTP {
+		logging.Info("Serving plain HTTP, TLS has to be terminated in front of sdup-rest")
+		err = server.ListenAndServe()
+
+	} else {
+		var reloader *tlsReloader
+		reloader, err = newTLSReloader(rest.tlsConfig)
+		if err != nil {
+			logging.Error(err.Error())
+			return err
+		}
+		go reloader.watch()
+		server.TLSConfig = reloader.serverTLSConfig()
+		// The certificate comes from the reloader, not from files given here
+		err = server.ListenAndServeTLS("", "")
+	}
+	if err != nil {
 		logging.Error(err.Error())
 		return err
 	}
 	return nil
 }
 
+// authenticationMiddleware attaches the principal found by the authentication chain to the request
 func (rest *SDUPRest) authenticationMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(writer http.ResponseWriter, reader *http.Request) {
-		authHeaderVal := reader.Header.Get("authorization")
-		certificateProvided := len(reader.TLS.PeerCertificates) > 0
-		if certificateProvided {
-			next.ServeHTTP(writer, reader)
-
-		} else if authHeaderVal != "" {
-			if !strings.HasPrefix(strings.ToLower(authHeaderVal), "bearer ") {
-				// FIXME improve bearer parsing. bearer should be case insensitive
-				http.Error(writer, "You are not logged in", http.StatusForbidden)
-				return
+		principal, err := rest.authChain.Authenticate(auth.HTTPCredentials(reader))
+		if err != nil {
+			// Requests without credentials are turned away, but are not attempts to authenticate
+			if err != auth.ErrNoCredentials {
+				rest.recordAuth(reader, audit.TypeAuthFailure, "", err)
 			}
-			token := authHeaderVal[7:]
-			_, err := rest.authentication.ValidateToken(token)
-
-			if err != nil {
-				http.Error(writer, err.Error(), http.StatusForbidden)
-				return
+			// Refused credentials are unauthorized unless the authenticator said otherwise
+			if _, ok := err.(faults.Fault); !ok {
+				err = faults.ErrUnauthorized{Err: err}
 			}
-			next.ServeHTTP(writer, reader)
+			faults.ServeProblem(writer, reader, err)
+			return
+		}
+		logPrincipal(principal, reader)
+		next.ServeHTTP(writer, reader.WithContext(auth.WithPrincipal(reader.Context(), principal)))
+	})
+}
 
-		} else {
-			http.Error(writer, "No authentication method provided", http.StatusForbidden)
+// recordAuth adds a login, refresh, logout or refused request to the audit log
+func (rest *SDUPRest) recordAuth(reader *http.Request, eventType string, user string, err error) {
+	event := audit.Event{Type: eventType, Principal: user, RemoteAddr: reader.RemoteAddr, Result: audit.ResultSuccess}
+	if err != nil {
+		event.Result = audit.ResultFailure
+		event.Error = err.Error()
+	}
+	rest.audit.Record(event)
+}
+
+// logPrincipal records who made a request, regardless of how they authenticated
+func logPrincipal(principal auth.Principal, reader *http.Request) {
+	logging.Info("Authenticated request", map[string]string{"principal": principal.Name, "method": principal.Method, "path": reader.URL.Path})
+}
+
+// adminMiddleware must run after authenticationMiddleware
+func (rest *SDUPRest) adminMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, reader *http.Request) {
+		principal, ok := auth.PrincipalFromContext(reader.Context())
+		if !ok || !principal.IsAdmin() {
+			faults.ServeProblem(writer, reader, faults.ErrForbidden{Action: "use administrative endpoints"})
+			return
 		}
+		next.ServeHTTP(writer, reader)
 	})
 }
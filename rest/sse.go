@@ -0,0 +1,111 @@
+package rest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/Kaese72/sdup-lib/logging"
+	"github.com/Kaese72/sdup-lib/sduptemplates"
+	"github.com/Kaese72/sdup-rest/auth"
+	"github.com/Kaese72/sdup-rest/faults"
+	"github.com/Kaese72/sdup-rest/stream"
+)
+
+// sseKeepAliveInterval is how often a comment is sent on an otherwise idle stream
+// so that proxies do not consider the connection dead
+const sseKeepAliveInterval = 15 * time.Second
+
+// writeSSEEvent writes a single named event with a JSON encoded payload
+func writeSSEEvent(writer http.ResponseWriter, event stream.EventType, payload interface{}) error {
+	jsonString, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(writer, "event: %s\ndata: %s\n\n", event, jsonString)
+	return err
+}
+
+// writeSSEKeepAlive writes a comment line, which clients ignore
+func writeSSEKeepAlive(writer http.ResponseWriter) error {
+	_, err := fmt.Fprint(writer, ":keepalive\n\n")
+	return err
+}
+
+// ssePayload picks what to send for an event. Added devices are sent in full since the client has not seen them before
+func ssePayload(event stream.EventType, update sduptemplates.DeviceUpdate, device sduptemplates.DeviceSpec) interface{} {
+	if event == stream.EventAdded {
+		return device
+	}
+	return update
+}
+
+func (rest *SDUPRest) subscribeHandler(broker *stream.Broker) http.HandlerFunc {
+	return func(writer http.ResponseWriter, reader *http.Request) {
+		flusher, ok := writer.(http.Flusher)
+		if !ok {
+			faults.ServeProblem(writer, reader, faults.ErrStreamingUnsupported{})
+			return
+		}
+
+		attrFilters, err := parseAttributeFilters(reader)
+		if err != nil {
+			faults.ServeProblem(writer, reader, faults.ErrMalformedRequest{Err: err})
+			return
+		}
+
+		// Subscribe before taking the snapshot so that no update falls between the two
+		subscription := broker.Subscribe()
+		defer broker.Unsubscribe(subscription)
+
+		view, devices, err := stream.NewView(auth.AuthorizedCache(reader.Context(), rest.cache), attrFilters)
+		if err != nil {
+			faults.ServeProblem(writer, reader, err)
+			return
+		}
+
+		// prepare the header
+		writer.Header().Set("Content-Type", "text/event-stream")
+		writer.Header().Set("Cache-Control", "no-cache")
+		writer.Header().Set("Connection", "keep-alive")
+		writer.Header().Set("Access-Control-Allow-Origin", "*")
+
+		if err := writeSSEEvent(writer, stream.EventSnapshot, devices); err != nil {
+			return
+		}
+		flusher.Flush()
+
+		keepAlive := time.NewTicker(sseKeepAliveInterval)
+		defer keepAlive.Stop()
+
+		for {
+			select {
+			case <-reader.Context().Done():
+				// Client went away, the deferred unsubscribe cleans up
+				return
+
+			case <-keepAlive.C:
+				if err := writeSSEKeepAlive(writer); err != nil {
+					return
+				}
+				flusher.Flush()
+
+			case update, ok := <-subscription.Updates():
+				if !ok {
+					// Upstream is gone or we could not keep up. Either way the client has to reconnect
+					return
+				}
+				event, device, ok := view.Classify(update)
+				if !ok {
+					continue
+				}
+				if err := writeSSEEvent(writer, event, ssePayload(event, update, device)); err != nil {
+					logging.Error("Failed to write SSE event", map[string]string{"event": string(event), "error": err.Error()})
+					return
+				}
+				flusher.Flush()
+			}
+		}
+	}
+}
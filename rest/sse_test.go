@@ -0,0 +1,134 @@
+package rest
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Kaese72/sdup-rest/auth"
+	"github.com/Kaese72/sdup-rest/cache"
+	"github.com/Kaese72/sdup-rest/faults"
+	"github.com/Kaese72/sdup-rest/internal/sduptest"
+	"github.com/Kaese72/sdup-rest/stream"
+)
+
+// newTestRest serves a single lamp through a broker, without authentication or rate limits
+func newTestRest(t *testing.T) (*SDUPRest, *sduptest.Target) {
+	target := sduptest.NewTarget(sduptest.Device("lamp", "active", false))
+	sdupCache := cache.NewSDUPCache(target, nil)
+	_, updates, err := sdupCache.Initialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &SDUPRest{cache: sdupCache, broker: stream.NewBroker(updates)}, target
+}
+
+// withViewer lets requests read every device, as if they had authenticated
+func withViewer(next http.Handler) http.Handler {
+	rbac := auth.RBACConfig{Roles: map[string]auth.RoleConfig{"viewer": {Devices: []string{"*"}}}}
+	viewer := auth.AnonymousAuthenticator(rbac, []string{"viewer"})
+	return http.HandlerFunc(func(writer http.ResponseWriter, reader *http.Request) {
+		principal, _, _ := viewer.Authenticate(auth.HTTPCredentials(reader))
+		next.ServeHTTP(writer, reader.WithContext(auth.WithPrincipal(reader.Context(), principal)))
+	})
+}
+
+func TestSubscribeConcurrentConnectDisconnect(t *testing.T) {
+	rest, target := newTestRest(t)
+
+	var active int32
+	handler := rest.subscribeHandler(rest.broker)
+	server := httptest.NewServer(withViewer(http.HandlerFunc(func(writer http.ResponseWriter, reader *http.Request) {
+		atomic.AddInt32(&active, 1)
+		defer atomic.AddInt32(&active, -1)
+		handler(writer, reader)
+	})))
+	defer server.Close()
+
+	// Keep updates flowing while clients come and go
+	stopUpdates := make(chan struct{})
+	updatesStopped := make(chan struct{})
+	go func() {
+		defer close(updatesStopped)
+		for i := 0; ; i++ {
+			select {
+			case <-stopUpdates:
+				return
+			case target.Updates <- sduptest.BoolUpdate("lamp", "active", i%2 == 0):
+			}
+		}
+	}()
+	defer func() {
+		close(stopUpdates)
+		<-updatesStopped
+	}()
+
+	const rounds, clients = 5, 20
+	for round := 0; round < rounds; round++ {
+		var wait sync.WaitGroup
+		for i := 0; i < clients; i++ {
+			wait.Add(1)
+			go func() {
+				defer wait.Done()
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+				request, _ := http.NewRequest("GET", server.URL, nil)
+				response, err := http.DefaultClient.Do(request.WithContext(ctx))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				defer response.Body.Close()
+				if response.StatusCode != http.StatusOK {
+					t.Errorf("expected 200, got %d", response.StatusCode)
+					return
+				}
+				line, err := bufio.NewReader(response.Body).ReadString('\n')
+				if err != nil || line != "event: "+string(stream.EventSnapshot)+"\n" {
+					t.Errorf("expected a snapshot first, got %q (%v)", line, err)
+				}
+			}()
+		}
+		wait.Wait()
+	}
+
+	if !sduptest.WaitFor(2*time.Second, func() bool { return atomic.LoadInt32(&active) == 0 }) {
+		t.Errorf("%d handlers still running after their clients disconnected", atomic.LoadInt32(&active))
+	}
+	if !sduptest.WaitFor(2*time.Second, func() bool { return rest.broker.Subscribers() == 0 }) {
+		t.Errorf("%d subscriptions left after every client disconnected", rest.broker.Subscribers())
+	}
+}
+
+// plainWriter is a ResponseWriter that can not flush
+type plainWriter struct {
+	header http.Header
+	status int
+	body   strings.Builder
+}
+
+func (writer *plainWriter) Header() http.Header         { return writer.header }
+func (writer *plainWriter) WriteHeader(status int)      { writer.status = status }
+func (writer *plainWriter) Write(b []byte) (int, error) { return writer.body.Write(b) }
+
+func TestSubscribeRequiresFlushing(t *testing.T) {
+	rest, _ := newTestRest(t)
+	writer := &plainWriter{header: http.Header{}}
+	rest.subscribeHandler(rest.broker)(writer, httptest.NewRequest("GET", "/rest/v0/subscribe", nil))
+
+	if writer.status != http.StatusInternalServerError {
+		t.Errorf("expected 500, got %d", writer.status)
+	}
+	if contentType := writer.header.Get("Content-Type"); contentType != faults.ProblemContentType {
+		t.Errorf("expected a problem, got %s", contentType)
+	}
+	if rest.broker.Subscribers() != 0 {
+		t.Error("a subscription was made for a request that can not stream")
+	}
+}
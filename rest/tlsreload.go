@@ -0,0 +1,145 @@
+package rest
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Kaese72/sdup-lib/logging"
+	"github.com/Kaese72/sdup-rest/metrics"
+)
+
+// tlsReloadInterval is how often the TLS files are checked for changes
+const tlsReloadInterval = 30 * time.Second
+
+// tlsReloader serves the certificate and client CAs from the configured files and picks up changes to them,
+// so that certificates rotated by an external agent are used without a restart
+type tlsReloader struct {
+	config TLSConfig
+
+	lock        sync.RWMutex
+	certificate *tls.Certificate
+	clientCAs   *x509.CertPool
+	// modTimes of the files as they were last loaded successfully
+	modTimes map[string]time.Time
+}
+
+// newTLSReloader loads the files, which have to be valid at startup
+func newTLSReloader(config TLSConfig) (*tlsReloader, error) {
+	reloader := &tlsReloader{config: config, modTimes: map[string]time.Time{}}
+	if _, err := reloader.reload(); err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+func (reloader *tlsReloader) files() []string {
+	files := []string{reloader.config.CertFile, reloader.config.KeyFile}
+	if reloader.config.clientAuth() != ClientAuthNone {
+		files = append(files, reloader.config.ClientCAFile)
+	}
+	return files
+}
+
+// reload loads the files if any of them changed since they were last loaded.
+// On failure the previous certificate stays in use and loading is retried on the next call.
+func (reloader *tlsReloader) reload() (bool, error) {
+	modTimes := map[string]time.Time{}
+	changed := false
+	for _, file := range reloader.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			return false, err
+		}
+		modTimes[file] = info.ModTime()
+		if !info.ModTime().Equal(reloader.modTimes[file]) {
+			changed = true
+		}
+	}
+	if !changed {
+		return false, nil
+	}
+
+	certificate, err := tls.LoadX509KeyPair(reloader.config.CertFile, reloader.config.KeyFile)
+	if err != nil {
+		return false, err
+	}
+	leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+	if err != nil {
+		return false, err
+	}
+	certificate.Leaf = leaf
+
+	var clientCAs *x509.CertPool
+	if reloader.config.clientAuth() != ClientAuthNone {
+		caCert, err := ioutil.ReadFile(reloader.config.ClientCAFile)
+		if err != nil {
+			return false, err
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(caCert) {
+			return false, fmt.Errorf("no certificates found in %s", reloader.config.ClientCAFile)
+		}
+	}
+
+	reloader.lock.Lock()
+	reloader.certificate = &certificate
+	reloader.clientCAs = clientCAs
+	reloader.modTimes = modTimes
+	reloader.lock.Unlock()
+
+	metrics.TLSCertificateExpiry.Set(float64(leaf.NotAfter.Unix()))
+	logging.Info("Loaded TLS certificate", map[string]string{"subject": leaf.Subject.String(), "expires": leaf.NotAfter.Format(time.RFC3339)})
+	return true, nil
+}
+
+// watch checks for changed files until the process exits
+func (reloader *tlsReloader) watch() {
+	ticker := time.NewTicker(tlsReloadInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		changed, err := reloader.reload()
+		if err != nil {
+			metrics.TLSReloads.WithLabelValues("failure").Inc()
+			logging.Error("Failed to reload TLS files, keeping the previous ones", map[string]string{"error": err.Error()})
+		} else if changed {
+			metrics.TLSReloads.WithLabelValues("success").Inc()
+		}
+	}
+}
+
+func (reloader *tlsReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	reloader.lock.RLock()
+	defer reloader.lock.RUnlock()
+	return reloader.certificate, nil
+}
+
+// serverTLSConfig builds the TLS configuration for the server.
+// The client CAs are picked per connection since tls.Config.ClientCAs can not be changed once serving.
+func (reloader *tlsReloader) serverTLSConfig() *tls.Config {
+	tlsConfig := &tls.Config{
+		GetCertificate: reloader.getCertificate,
+		ClientAuth:     tls.NoClientCert,
+	}
+	switch reloader.config.clientAuth() {
+	case ClientAuthRequired:
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	case ClientAuthOptional:
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	default:
+		return tlsConfig
+	}
+	tlsConfig.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		reloader.lock.RLock()
+		defer reloader.lock.RUnlock()
+		clientConfig := tlsConfig.Clone()
+		clientConfig.GetConfigForClient = nil
+		clientConfig.ClientCAs = reloader.clientCAs
+		return clientConfig, nil
+	}
+	return tlsConfig
+}
@@ -0,0 +1,83 @@
+package rest
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/Kaese72/sdup-rest/auth"
+	"github.com/Kaese72/sdup-rest/faults"
+	"github.com/gorilla/mux"
+)
+
+// passwordBody is accepted when resetting a password
+type passwordBody struct {
+	Password string `json:"password"`
+}
+
+// serveUserError serves errors from the user store. Anything it does not reject as invalid,
+// such as failing to save the users file, is an internal error
+func serveUserError(writer http.ResponseWriter, reader *http.Request, err error) {
+	var invalid auth.ErrInvalidUser
+	switch {
+	case err == auth.ErrNoSuchUser:
+		faults.ServeProblem(writer, reader, faults.ErrNotFound{Err: err})
+	case err == auth.ErrUserExists:
+		faults.ServeProblem(writer, reader, faults.ErrConflict{Err: err})
+	case errors.As(err, &invalid):
+		faults.ServeProblem(writer, reader, faults.ErrValidation{Message: err.Error()})
+	default:
+		faults.ServeProblem(writer, reader, err)
+	}
+}
+
+func (rest *SDUPRest) listUsers(writer http.ResponseWriter, reader *http.Request) {
+	users, err := rest.authentication.Users().Users()
+	if err != nil {
+		faults.ServeProblem(writer, reader, err)
+		return
+	}
+	writeJSON(writer, http.StatusOK, users)
+}
+
+func (rest *SDUPRest) createUser(writer http.ResponseWriter, reader *http.Request) {
+	var login auth.LoginBody
+	if err := json.NewDecoder(reader.Body).Decode(&login); err != nil {
+		faults.ServeProblem(writer, reader, faults.ErrMalformedRequest{Err: err})
+		return
+	}
+	if err := rest.authentication.Users().CreateUser(login.User, login.Password); err != nil {
+		serveUserError(writer, reader, err)
+		return
+	}
+	writeJSON(writer, http.StatusCreated, auth.User{Name: login.User})
+}
+
+func (rest *SDUPRest) setUserDisabled(disabled bool) http.HandlerFunc {
+	return func(writer http.ResponseWriter, reader *http.Request) {
+		name := mux.Vars(reader)["userName"]
+		if err := rest.authentication.Users().SetDisabled(name, disabled); err != nil {
+			serveUserError(writer, reader, err)
+			return
+		}
+		if disabled {
+			rest.authentication.RevokeUserSessions(name)
+		}
+		writeJSON(writer, http.StatusOK, auth.User{Name: name, Disabled: disabled})
+	}
+}
+
+func (rest *SDUPRest) resetUserPassword(writer http.ResponseWriter, reader *http.Request) {
+	var body passwordBody
+	if err := json.NewDecoder(reader.Body).Decode(&body); err != nil {
+		faults.ServeProblem(writer, reader, faults.ErrMalformedRequest{Err: err})
+		return
+	}
+	name := mux.Vars(reader)["userName"]
+	if err := rest.authentication.Users().ResetPassword(name, body.Password); err != nil {
+		serveUserError(writer, reader, err)
+		return
+	}
+	rest.authentication.RevokeUserSessions(name)
+	writer.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,131 @@
+package rest
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Kaese72/sdup-lib/sduptemplates"
+	"github.com/Kaese72/sdup-rest/cache"
+	"github.com/Kaese72/sdup-rest/cache/filters"
+	"github.com/Kaese72/sdup-rest/faults"
+	"github.com/Kaese72/sdup-rest/stream"
+)
+
+const (
+	// defaultWaitTimeout is how long to wait for the effect of a trigger unless asked otherwise
+	defaultWaitTimeout = 10 * time.Second
+	maxWaitTimeout     = time.Minute
+)
+
+const waitAttributePrefix = "attribute:"
+
+// parseWaitValue reads the expected state of an attribute as a number, true or false, or else a string.
+// Only the literals true and false are booleans, since "1" and "0" are far more likely numeric states.
+func parseWaitValue(value string) interface{} {
+	if number, err := strconv.ParseFloat(value, 32); err == nil {
+		return float32(number)
+	}
+	switch value {
+	case "true":
+		return true
+	case "false":
+		return false
+	}
+	return strings.Trim(value, `"`)
+}
+
+// parseWait reads the wait and timeout query parameters of a capability trigger.
+// Every wait condition is on the form attribute:<key>==<value>, and all of them have to be met.
+// No conditions means the trigger does not wait.
+func parseWait(values url.Values) (filters.AttributeFilters, time.Duration, error) {
+	conditions := filters.AttributeFilters{}
+	for _, wait := range values["wait"] {
+		parts := strings.SplitN(strings.TrimPrefix(wait, waitAttributePrefix), "==", 2)
+		if !strings.HasPrefix(wait, waitAttributePrefix) || len(parts) != 2 || parts[0] == "" {
+			return nil, 0, faults.ErrValidation{
+				Message: fmt.Sprintf("Can not wait for '%s'", wait),
+				Fields:  map[string]string{"wait": "must be on the form attribute:<key>==<value>"},
+			}
+		}
+		conditions = append(conditions, filters.AttributeFilter{
+			Key:      filters.AttributeFilterKey(parts[0]),
+			Operator: filters.Equal,
+			Value:    parseWaitValue(parts[1]),
+		})
+	}
+
+	timeout := defaultWaitTimeout
+	if value := values.Get("timeout"); value != "" {
+		var err error
+		timeout, err = time.ParseDuration(value)
+		if err != nil || timeout <= 0 || timeout > maxWaitTimeout {
+			return nil, 0, faults.ErrValidation{
+				Message: fmt.Sprintf("Invalid timeout '%s'", value),
+				Fields:  map[string]string{"timeout": fmt.Sprintf("must be a duration, such as 5s, of at most %s", maxWaitTimeout)},
+			}
+		}
+	}
+	return conditions, timeout, nil
+}
+
+// checkWaitAttributes refuses to wait for attributes the device does not have, since they would never match
+func checkWaitAttributes(sdupCache cache.SDUPCache, deviceID sduptemplates.DeviceID, conditions filters.AttributeFilters) error {
+	device, err := sdupCache.Device(deviceID)
+	if err != nil {
+		return err
+	}
+	for _, condition := range conditions {
+		if _, ok := device.Attributes[sduptemplates.AttributeKey(condition.Key)]; !ok {
+			return faults.ErrEntityNotFound{ID: deviceID, EntityType: faults.ETAttribute, Key: string(condition.Key)}
+		}
+	}
+	return nil
+}
+
+// waitForState returns the device once the cache has it in a state matching the conditions.
+// The subscription has to be made before triggering, so that no update is missed.
+func waitForState(ctx context.Context, subscription *stream.Subscription, sdupCache cache.SDUPCache, deviceID sduptemplates.DeviceID, conditions filters.AttributeFilters, timeout time.Duration) (sduptemplates.DeviceSpec, error) {
+	start := time.Now()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	// The state may have been reached before the trigger, or before the subscription delivered anything
+	device, err := sdupCache.Device(deviceID)
+	for {
+		if err != nil {
+			return sduptemplates.DeviceSpec{}, err
+		}
+		match, matchErr := cache.DeviceMatchesFilters(device, conditions)
+		if matchErr != nil {
+			return sduptemplates.DeviceSpec{}, faults.ErrValidation{Message: matchErr.Error(), Fields: map[string]string{"wait": matchErr.Error()}}
+		}
+		if match {
+			return device, nil
+		}
+
+		select {
+		case update, ok := <-subscription.Updates():
+			if !ok {
+				// The broker drops subscribers that fall behind
+				return sduptemplates.DeviceSpec{}, faults.ErrUpdatesStopped{ID: deviceID}
+			}
+			if update.ID != deviceID {
+				continue
+			}
+			// The cache is updated before updates are passed on, so it has the complete state
+			device, err = sdupCache.Device(deviceID)
+		case <-timer.C:
+			return sduptemplates.DeviceSpec{}, faults.ErrWaitTimeout{ID: deviceID, Timeout: timeout}
+		case <-ctx.Done():
+			// The client went away or the server gave up on the request before the wait was over
+			if ctx.Err() == context.DeadlineExceeded {
+				return sduptemplates.DeviceSpec{}, faults.ErrWaitTimeout{ID: deviceID, Timeout: time.Since(start).Round(time.Millisecond)}
+			}
+			return sduptemplates.DeviceSpec{}, faults.ErrCancelled{Err: ctx.Err()}
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package rest
+
+import (
+	"context"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Kaese72/sdup-rest/cache/filters"
+	"github.com/Kaese72/sdup-rest/faults"
+)
+
+func TestParseWaitValues(t *testing.T) {
+	for _, test := range []struct {
+		wait     string
+		expected interface{}
+	}{
+		{"attribute:active==true", true},
+		{"attribute:active==false", false},
+		{"attribute:level==1", float32(1)},
+		{"attribute:level==0", float32(0)},
+		{"attribute:level==42.5", float32(42.5)},
+		{"attribute:mode==eco", "eco"},
+		{`attribute:mode=="true"`, "true"},
+		{"attribute:mode==True", "True"},
+	} {
+		conditions, timeout, err := parseWait(url.Values{"wait": {test.wait}})
+		if err != nil {
+			t.Errorf("%s: %s", test.wait, err.Error())
+			continue
+		}
+		if timeout != defaultWaitTimeout {
+			t.Errorf("%s: expected the default timeout, got %s", test.wait, timeout)
+		}
+		if len(conditions) != 1 || !reflect.DeepEqual(conditions[0].Value, test.expected) {
+			t.Errorf("%s: expected %#v, got %#v", test.wait, test.expected, conditions)
+		}
+	}
+}
+
+func TestParseWaitRefusals(t *testing.T) {
+	for _, query := range []url.Values{
+		{"wait": {"active==true"}},
+		{"wait": {"attribute:active=true"}},
+		{"wait": {"attribute:==true"}},
+		{"wait": {"attribute:active==true"}, "timeout": {"soon"}},
+		{"wait": {"attribute:active==true"}, "timeout": {(2 * maxWaitTimeout).String()}},
+	} {
+		if _, _, err := parseWait(query); err == nil {
+			t.Errorf("%v: expected an error", query)
+		}
+	}
+	if _, timeout, _ := parseWait(url.Values{"timeout": {"5s"}}); timeout != 5*time.Second {
+		t.Errorf("expected a 5s timeout, got %s", timeout)
+	}
+}
+
+func TestWaitForStateEndings(t *testing.T) {
+	rest, _ := newTestRest(t)
+	conditions := filters.AttributeFilters{{Key: "active", Operator: filters.Equal, Value: true}}
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	expired, cancelExpired := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancelExpired()
+
+	for _, test := range []struct {
+		name string
+		ctx  context.Context
+		// dropped ends the subscription before waiting, as the broker does to subscribers that fall behind
+		dropped bool
+		code    string
+	}{
+		{"client gone", cancelled, false, faults.CodeCancelled},
+		{"server timeout", expired, false, faults.CodeWaitTimeout},
+		{"updates stopped", context.Background(), true, faults.CodeUpdatesStopped},
+	} {
+		subscription := rest.broker.Subscribe()
+		if test.dropped {
+			rest.broker.Unsubscribe(subscription)
+		}
+		_, err := waitForState(test.ctx, subscription, rest.cache, "lamp", conditions, time.Minute)
+		rest.broker.Unsubscribe(subscription)
+		if problem := faults.NewProblem(err); problem.Code != test.code {
+			t.Errorf("%s: expected %s, got %s (%v)", test.name, test.code, problem.Code, err)
+		}
+	}
+}
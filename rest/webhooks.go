@@ -0,0 +1,90 @@
+package rest
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/Kaese72/sdup-rest/faults"
+	"github.com/Kaese72/sdup-rest/webhooks"
+	"github.com/gorilla/mux"
+)
+
+// serveWebhookError serves errors from the webhook manager. Anything but a missing or invalid webhook,
+// such as failing to save the store, is an internal error
+func serveWebhookError(writer http.ResponseWriter, reader *http.Request, err error) {
+	var invalid webhooks.ErrInvalidWebhook
+	switch {
+	case err == webhooks.ErrNoSuchWebhook:
+		faults.ServeProblem(writer, reader, faults.ErrNotFound{Err: err})
+	case errors.As(err, &invalid):
+		faults.ServeProblem(writer, reader, faults.ErrValidation{Message: err.Error()})
+	default:
+		faults.ServeProblem(writer, reader, err)
+	}
+}
+
+func writeJSON(writer http.ResponseWriter, status int, content interface{}) {
+	jsonEncoded, err := json.MarshalIndent(content, "", "   ")
+	if err != nil {
+		http.Error(writer, "Failed to JSON encode response", http.StatusInternalServerError)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(status)
+	writer.Write(jsonEncoded)
+}
+
+func (rest *SDUPRest) listWebhooks(writer http.ResponseWriter, reader *http.Request) {
+	redacted := []webhooks.Webhook{}
+	for _, webhook := range rest.webhooks.List() {
+		redacted = append(redacted, webhook.Redacted())
+	}
+	writeJSON(writer, http.StatusOK, redacted)
+}
+
+func (rest *SDUPRest) createWebhook(writer http.ResponseWriter, reader *http.Request) {
+	var webhook webhooks.Webhook
+	if err := json.NewDecoder(reader.Body).Decode(&webhook); err != nil {
+		faults.ServeProblem(writer, reader, faults.ErrMalformedRequest{Err: err})
+		return
+	}
+	webhook, err := rest.webhooks.Create(webhook)
+	if err != nil {
+		serveWebhookError(writer, reader, err)
+		return
+	}
+	// The only response that ever contains the secret, which may have been generated
+	writeJSON(writer, http.StatusCreated, webhook)
+}
+
+func (rest *SDUPRest) getWebhook(writer http.ResponseWriter, reader *http.Request) {
+	webhook, err := rest.webhooks.Get(mux.Vars(reader)["webhookID"])
+	if err != nil {
+		serveWebhookError(writer, reader, err)
+		return
+	}
+	writeJSON(writer, http.StatusOK, webhook.Redacted())
+}
+
+func (rest *SDUPRest) updateWebhook(writer http.ResponseWriter, reader *http.Request) {
+	var webhook webhooks.Webhook
+	if err := json.NewDecoder(reader.Body).Decode(&webhook); err != nil {
+		faults.ServeProblem(writer, reader, faults.ErrMalformedRequest{Err: err})
+		return
+	}
+	webhook, err := rest.webhooks.Update(mux.Vars(reader)["webhookID"], webhook)
+	if err != nil {
+		serveWebhookError(writer, reader, err)
+		return
+	}
+	writeJSON(writer, http.StatusOK, webhook.Redacted())
+}
+
+func (rest *SDUPRest) deleteWebhook(writer http.ResponseWriter, reader *http.Request) {
+	if err := rest.webhooks.Delete(mux.Vars(reader)["webhookID"]); err != nil {
+		serveWebhookError(writer, reader, err)
+		return
+	}
+	writer.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,283 @@
+package rest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Kaese72/sdup-lib/logging"
+	"github.com/Kaese72/sdup-lib/sduptemplates"
+	"github.com/Kaese72/sdup-rest/auth"
+	"github.com/Kaese72/sdup-rest/cache"
+	"github.com/Kaese72/sdup-rest/cache/filters"
+	"github.com/Kaese72/sdup-rest/faults"
+	"github.com/Kaese72/sdup-rest/stream"
+	"github.com/gorilla/websocket"
+)
+
+// Message types a client may send on the websocket
+const (
+	wsTypeSubscribe   = "subscribe"
+	wsTypeUnsubscribe = "unsubscribe"
+	wsTypeTrigger     = "trigger"
+)
+
+// Message types the server sends on the websocket. Device events are named by their stream.EventType.
+const (
+	wsTypeResult = "result"
+)
+
+const (
+	wsWriteTimeout = 10 * time.Second
+	wsPongTimeout  = 60 * time.Second
+	wsPingInterval = 30 * time.Second
+)
+
+// wsMaxPendingTriggers is how many triggers a connection may have in flight, further triggers are refused until one is done
+const wsMaxPendingTriggers = 8
+
+// wsRequest is a message from the client.
+// ID is chosen by the client and is echoed in the result so requests and responses can be correlated.
+// For subscriptions the ID also names the subscription in later events and when unsubscribing.
+type wsRequest struct {
+	ID            string                           `json:"id"`
+	Type          string                           `json:"type"`
+	Filters       filters.AttributeFilters         `json:"filters,omitempty"`
+	DeviceID      sduptemplates.DeviceID           `json:"device,omitempty"`
+	CapabilityKey sduptemplates.CapabilityKey      `json:"capability,omitempty"`
+	Args          sduptemplates.CapabilityArgument `json:"args,omitempty"`
+}
+
+// wsMessage is a message from the server.
+// Results carry ID and possibly Error, described like REST errors are. Device events carry Subscription and Data.
+type wsMessage struct {
+	ID           string          `json:"id,omitempty"`
+	Type         string          `json:"type"`
+	Subscription string          `json:"subscription,omitempty"`
+	Error        *faults.Problem `json:"error,omitempty"`
+	Data         interface{}     `json:"data,omitempty"`
+}
+
+type wsConnection struct {
+	// ctx ends when the connection is closed, so work started for it is dropped
+	ctx    context.Context
+	cancel context.CancelFunc
+	// cache is limited to what the caller that opened the connection may do
+	cache cache.SDUPCache
+	conn  *websocket.Conn
+	// triggers holds a slot for every trigger in flight
+	triggers chan struct{}
+
+	writeLock sync.Mutex
+
+	subLock       sync.Mutex
+	subscriptions map[string]*stream.View
+}
+
+// send skips messages once the connection is closed
+func (conn *wsConnection) send(message wsMessage) error {
+	conn.writeLock.Lock()
+	defer conn.writeLock.Unlock()
+	if conn.ctx.Err() != nil {
+		return conn.ctx.Err()
+	}
+	conn.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	return conn.conn.WriteJSON(message)
+}
+
+func (conn *wsConnection) ping() error {
+	conn.writeLock.Lock()
+	defer conn.writeLock.Unlock()
+	if conn.ctx.Err() != nil {
+		return conn.ctx.Err()
+	}
+	return conn.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteTimeout))
+}
+
+// close ends the context before closing the connection, under the write lock so that nothing is written after
+func (conn *wsConnection) close() {
+	conn.cancel()
+	conn.writeLock.Lock()
+	defer conn.writeLock.Unlock()
+	conn.conn.Close()
+}
+
+func (conn *wsConnection) result(request wsRequest, err error) error {
+	message := wsMessage{ID: request.ID, Type: wsTypeResult}
+	if err != nil {
+		problem := faults.NewProblem(err)
+		message.Error = &problem
+	}
+	return conn.send(message)
+}
+
+func (conn *wsConnection) subscribe(request wsRequest) error {
+	if request.ID == "" {
+		return conn.result(request, faults.ErrValidation{Message: "subscriptions require an id"})
+	}
+
+	conn.subLock.Lock()
+	defer conn.subLock.Unlock()
+	if _, ok := conn.subscriptions[request.ID]; ok {
+		return conn.result(request, faults.ErrConflict{Err: fmt.Errorf("subscription '%s' already exists", request.ID)})
+	}
+	view, devices, err := stream.NewView(conn.cache, request.Filters)
+	if err != nil {
+		return conn.result(request, err)
+	}
+	conn.subscriptions[request.ID] = view
+
+	if err := conn.result(request, nil); err != nil {
+		return err
+	}
+	// Sending the snapshot while holding the lock guarantees it precedes any update for this subscription
+	return conn.send(wsMessage{Type: string(stream.EventSnapshot), Subscription: request.ID, Data: devices})
+}
+
+func (conn *wsConnection) unsubscribe(request wsRequest) error {
+	conn.subLock.Lock()
+	_, ok := conn.subscriptions[request.ID]
+	delete(conn.subscriptions, request.ID)
+	conn.subLock.Unlock()
+
+	if !ok {
+		return conn.result(request, faults.ErrNotFound{Err: fmt.Errorf("no subscription '%s'", request.ID)})
+	}
+	return conn.result(request, nil)
+}
+
+func (conn *wsConnection) trigger(request wsRequest) error {
+	args := request.Args
+	if args == nil {
+		args = sduptemplates.CapabilityArgument{}
+	}
+	select {
+	case conn.triggers <- struct{}{}:
+	default:
+		return conn.result(request, faults.ErrRateLimited{RetryAfter: time.Second})
+	}
+	// Capabilities may be slow, do not hold up reading further requests
+	go func() {
+		// Requests still queued when the connection closes are dropped
+		if conn.ctx.Err() != nil {
+			<-conn.triggers
+			return
+		}
+		err := conn.cache.TriggerCapability(request.DeviceID, request.CapabilityKey, args)
+		// The slot is free once the trigger is done, so that clients seeing the result may trigger again
+		<-conn.triggers
+		if err := conn.result(request, err); err != nil && conn.ctx.Err() == nil {
+			logging.Error("Failed to send websocket result", map[string]string{"error": err.Error()})
+		}
+	}()
+	return nil
+}
+
+func (conn *wsConnection) publish(update sduptemplates.DeviceUpdate) error {
+	conn.subLock.Lock()
+	defer conn.subLock.Unlock()
+	for id, view := range conn.subscriptions {
+		event, device, ok := view.Classify(update)
+		if !ok {
+			continue
+		}
+		if err := conn.send(wsMessage{Type: string(event), Subscription: id, Data: ssePayload(event, update, device)}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pump forwards updates and pings to the client until the connection or the subscription ends
+func (conn *wsConnection) pump(subscription *stream.Subscription, done <-chan struct{}) {
+	ticker := time.NewTicker(wsPingInterval)
+	defer ticker.Stop()
+	// Whatever makes us stop, make sure the read loop notices as well
+	defer conn.close()
+
+	for {
+		select {
+		case <-done:
+			return
+
+		case <-ticker.C:
+			if err := conn.ping(); err != nil {
+				return
+			}
+
+		case update, ok := <-subscription.Updates():
+			if !ok {
+				return
+			}
+			if err := conn.publish(update); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (rest *SDUPRest) websocketHandler(broker *stream.Broker) http.HandlerFunc {
+	upgrader := websocket.Upgrader{}
+	return func(writer http.ResponseWriter, reader *http.Request) {
+		wsConn, err := upgrader.Upgrade(writer, reader, nil)
+		if err != nil {
+			// The upgrader has already replied with an error
+			return
+		}
+		ctx, cancel := context.WithCancel(reader.Context())
+		conn := &wsConnection{
+			ctx:           ctx,
+			cancel:        cancel,
+			cache:         auth.AuthorizedCache(ctx, rest.cache),
+			conn:          wsConn,
+			triggers:      make(chan struct{}, wsMaxPendingTriggers),
+			subscriptions: map[string]*stream.View{},
+		}
+		defer conn.close()
+
+		subscription := broker.Subscribe()
+		defer broker.Unsubscribe(subscription)
+
+		done := make(chan struct{})
+		defer close(done)
+		go conn.pump(subscription, done)
+
+		wsConn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+		wsConn.SetPongHandler(func(string) error {
+			return wsConn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+		})
+
+		for {
+			_, data, err := wsConn.ReadMessage()
+			if err != nil {
+				if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+					logging.Error("Websocket read failed", map[string]string{"error": err.Error()})
+				}
+				return
+			}
+
+			var request wsRequest
+			if jsonErr := json.Unmarshal(data, &request); jsonErr != nil {
+				err = conn.result(request, faults.ErrMalformedRequest{Err: jsonErr})
+
+			} else {
+				switch request.Type {
+				case wsTypeSubscribe:
+					err = conn.subscribe(request)
+				case wsTypeUnsubscribe:
+					err = conn.unsubscribe(request)
+				case wsTypeTrigger:
+					err = conn.trigger(request)
+				default:
+					err = conn.result(request, faults.ErrValidation{Message: fmt.Sprintf("unknown message type '%s'", request.Type)})
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package rest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Kaese72/sdup-lib/sduptemplates"
+	"github.com/Kaese72/sdup-rest/auth"
+	"github.com/Kaese72/sdup-rest/cache"
+	"github.com/Kaese72/sdup-rest/faults"
+	"github.com/Kaese72/sdup-rest/internal/sduptest"
+	"github.com/Kaese72/sdup-rest/stream"
+	"github.com/gorilla/websocket"
+)
+
+// slowTarget holds on to triggers until released
+type slowTarget struct {
+	*sduptest.Target
+	entered  chan struct{}
+	release  chan struct{}
+	returned chan struct{}
+}
+
+func (target *slowTarget) TriggerCapability(sduptemplates.DeviceID, sduptemplates.CapabilityKey, sduptemplates.CapabilityArgument) error {
+	target.entered <- struct{}{}
+	<-target.release
+	defer func() { target.returned <- struct{}{} }()
+	return nil
+}
+
+// startWebsocket serves the websocket of a target to an operator, who may trigger every capability.
+// The returned channel is closed when the handler returns
+func startWebsocket(t *testing.T, target sduptemplates.SDUPTarget) (*httptest.Server, *websocket.Conn, chan struct{}) {
+	sdupCache := cache.NewSDUPCache(target, nil)
+	_, updates, err := sdupCache.Initialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rest := &SDUPRest{cache: sdupCache, broker: stream.NewBroker(updates)}
+
+	rbac := auth.RBACConfig{
+		Roles:     map[string]auth.RoleConfig{"operator": {Devices: []string{"*"}, Capabilities: []string{"*"}}},
+		UserRoles: map[string][]string{"kaese": {"operator"}},
+	}
+	principal := rbac.UserPrincipal("kaese", auth.MethodToken)
+	handlerDone := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, reader *http.Request) {
+		defer close(handlerDone)
+		rest.websocketHandler(rest.broker)(writer, reader.WithContext(auth.WithPrincipal(reader.Context(), principal)))
+	}))
+
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		server.Close()
+		t.Fatal(err)
+	}
+	return server, client, handlerDone
+}
+
+// readResult skips device events until the next result
+func readResult(t *testing.T, client *websocket.Conn) wsMessage {
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		var message wsMessage
+		if err := client.ReadJSON(&message); err != nil {
+			t.Fatal(err)
+		}
+		if message.Type == wsTypeResult {
+			return message
+		}
+	}
+}
+
+func TestWebsocketResultsAreProblems(t *testing.T) {
+	server, client, _ := startWebsocket(t, sduptest.NewTarget(sduptest.Device("lamp", "active", false)))
+	defer server.Close()
+	defer client.Close()
+
+	for _, test := range []struct {
+		request wsRequest
+		code    string
+	}{
+		{wsRequest{ID: "1", Type: "explode"}, faults.CodeValidationFailed},
+		{wsRequest{ID: "2", Type: wsTypeUnsubscribe}, faults.CodeNotFound},
+		{wsRequest{ID: "3", Type: wsTypeTrigger, DeviceID: "missing", CapabilityKey: "activate"}, faults.CodeDeviceNotFound},
+	} {
+		if err := client.WriteJSON(test.request); err != nil {
+			t.Fatal(err)
+		}
+		result := readResult(t, client)
+		if result.Error == nil || result.Error.Code != test.code {
+			t.Errorf("%s: expected %s, got %+v", test.request.ID, test.code, result.Error)
+		}
+	}
+}
+
+func TestWebsocketTriggerOutlivesConnection(t *testing.T) {
+	target := &slowTarget{
+		Target:   sduptest.NewTarget(sduptest.Device("lamp", "active", false)),
+		entered:  make(chan struct{}, 1),
+		release:  make(chan struct{}),
+		returned: make(chan struct{}, 1),
+	}
+	server, client, handlerDone := startWebsocket(t, target)
+	defer server.Close()
+
+	if err := client.WriteJSON(wsRequest{ID: "1", Type: wsTypeTrigger, DeviceID: "lamp", CapabilityKey: "activate"}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-target.entered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the capability was never triggered")
+	}
+
+	// The connection closes without waiting for the trigger, whose result is then dropped
+	client.Close()
+	select {
+	case <-handlerDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the connection did not close while a trigger was in flight")
+	}
+	close(target.release)
+	select {
+	case <-target.returned:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the trigger never returned")
+	}
+}
+
+func TestWebsocketBoundsPendingTriggers(t *testing.T) {
+	target := &slowTarget{
+		Target:   sduptest.NewTarget(sduptest.Device("lamp", "active", false)),
+		entered:  make(chan struct{}, wsMaxPendingTriggers),
+		release:  make(chan struct{}),
+		returned: make(chan struct{}, wsMaxPendingTriggers),
+	}
+	server, client, _ := startWebsocket(t, target)
+	defer server.Close()
+	defer client.Close()
+
+	for i := 0; i < wsMaxPendingTriggers; i++ {
+		if err := client.WriteJSON(wsRequest{ID: "pending", Type: wsTypeTrigger, DeviceID: "lamp", CapabilityKey: "activate"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < wsMaxPendingTriggers; i++ {
+		select {
+		case <-target.entered:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("only %d triggers reached the target", i)
+		}
+	}
+	if err := client.WriteJSON(wsRequest{ID: "refused", Type: wsTypeTrigger, DeviceID: "lamp", CapabilityKey: "activate"}); err != nil {
+		t.Fatal(err)
+	}
+	if result := readResult(t, client); result.ID != "refused" || result.Error == nil || result.Error.Code != faults.CodeRateLimited {
+		t.Errorf("expected the trigger to be refused, got %+v", result)
+	}
+
+	close(target.release)
+	for i := 0; i < wsMaxPendingTriggers; i++ {
+		<-target.returned
+		if result := readResult(t, client); result.ID != "pending" || result.Error != nil {
+			t.Errorf("expected a pending trigger to succeed, got %+v", result)
+		}
+	}
+	if err := client.WriteJSON(wsRequest{ID: "after", Type: wsTypeTrigger, DeviceID: "lamp", CapabilityKey: "activate"}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-target.entered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("triggers were refused after the pending ones were done")
+	}
+	if result := readResult(t, client); result.ID != "after" || result.Error != nil {
+		t.Errorf("expected the trigger to succeed, got %+v", result)
+	}
+}
@@ -0,0 +1,104 @@
+package stream
+
+import (
+	"sync"
+
+	"github.com/Kaese72/sdup-lib/logging"
+	"github.com/Kaese72/sdup-lib/sduptemplates"
+)
+
+// subscriptionBuffer is how many updates may be queued for a subscriber before it is considered stuck
+const subscriptionBuffer = 64
+
+// Subscription is a single consumer of device updates
+type Subscription struct {
+	updates chan sduptemplates.DeviceUpdate
+}
+
+// Updates returns the channel updates are delivered on.
+// The channel is closed when the subscription ends, for whatever reason.
+func (sub *Subscription) Updates() <-chan sduptemplates.DeviceUpdate {
+	return sub.updates
+}
+
+// Broker fans out device updates from a single channel to any number of subscribers
+type Broker struct {
+	lock        sync.Mutex
+	subscribers map[*Subscription]struct{}
+	closed      bool
+}
+
+// NewBroker starts distributing updates received on the given channel.
+// When the channel is closed every subscription is ended.
+func NewBroker(updates <-chan sduptemplates.DeviceUpdate) *Broker {
+	broker := &Broker{
+		subscribers: map[*Subscription]struct{}{},
+	}
+	go broker.run(updates)
+	return broker
+}
+
+func (broker *Broker) run(updates <-chan sduptemplates.DeviceUpdate) {
+	for update := range updates {
+		broker.publish(update)
+	}
+
+	broker.lock.Lock()
+	defer broker.lock.Unlock()
+	broker.closed = true
+	for sub := range broker.subscribers {
+		broker.remove(sub)
+	}
+}
+
+func (broker *Broker) publish(update sduptemplates.DeviceUpdate) {
+	broker.lock.Lock()
+	defer broker.lock.Unlock()
+	for sub := range broker.subscribers {
+		select {
+		case sub.updates <- update:
+		default:
+			// Never let a single stuck consumer hold back everyone else
+			logging.Error("Dropping subscriber that is not keeping up with updates")
+			broker.remove(sub)
+		}
+	}
+}
+
+// remove must be called with the lock held
+func (broker *Broker) remove(sub *Subscription) {
+	if _, ok := broker.subscribers[sub]; ok {
+		delete(broker.subscribers, sub)
+		close(sub.updates)
+	}
+}
+
+// Subscribe registers a new subscriber. If the broker has already shut down
+// the returned subscription is already ended.
+func (broker *Broker) Subscribe() *Subscription {
+	sub := &Subscription{updates: make(chan sduptemplates.DeviceUpdate, subscriptionBuffer)}
+
+	broker.lock.Lock()
+	defer broker.lock.Unlock()
+	if broker.closed {
+		close(sub.updates)
+	} else {
+		broker.subscribers[sub] = struct{}{}
+	}
+	return sub
+}
+
+// Subscribers counts the subscriptions that have not ended
+func (broker *Broker) Subscribers() int {
+	broker.lock.Lock()
+	defer broker.lock.Unlock()
+	return len(broker.subscribers)
+}
+
+// Unsubscribe ends a subscription. It returns immediately and may be called
+// any number of times, also on subscriptions that have already ended.
+func (broker *Broker) Unsubscribe(sub *Subscription) {
+	broker.lock.Lock()
+	defer broker.lock.Unlock()
+	broker.remove(sub)
+}
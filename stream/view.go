@@ -0,0 +1,76 @@
+package stream
+
+import (
+	"github.com/Kaese72/sdup-lib/logging"
+	"github.com/Kaese72/sdup-lib/sduptemplates"
+	"github.com/Kaese72/sdup-rest/cache"
+	"github.com/Kaese72/sdup-rest/cache/filters"
+)
+
+// EventType names what an update means to a consumer of a View
+type EventType string
+
+const (
+	// EventSnapshot carries every device matching the filters when the view was created
+	EventSnapshot EventType = "snapshot"
+	// EventUpdate is a change to a device that matches the filters
+	EventUpdate EventType = "update"
+	// EventAdded is a device that started matching the filters
+	EventAdded EventType = "added"
+	// EventRemoved is a device that stopped matching the filters
+	EventRemoved EventType = "removed"
+)
+
+// View tracks what devices match a set of filters as updates arrive
+type View struct {
+	cache    cache.SDUPCache
+	filters  filters.AttributeFilters
+	matching map[sduptemplates.DeviceID]bool
+}
+
+// NewView creates a view and returns the devices currently matching the filters.
+// Subscribe before creating the view so that no update falls between the snapshot and the subscription.
+func NewView(sdupCache cache.SDUPCache, attrFilters filters.AttributeFilters) (*View, []sduptemplates.DeviceSpec, error) {
+	devices, err := sdupCache.Devices(attrFilters)
+	if err != nil {
+		return nil, nil, err
+	}
+	view := &View{
+		cache:    sdupCache,
+		filters:  attrFilters,
+		matching: map[sduptemplates.DeviceID]bool{},
+	}
+	for _, device := range devices {
+		view.matching[device.ID] = true
+	}
+	return view, devices, nil
+}
+
+// Classify decides what a consumer of the view should see for an update.
+// The device is the state of the device after the update.
+// ok is false if the update is irrelevant to the view.
+func (view *View) Classify(update sduptemplates.DeviceUpdate) (event EventType, device sduptemplates.DeviceSpec, ok bool) {
+	device, err := view.cache.Device(update.ID)
+	if err != nil {
+		// The cache does not know about the device, so neither should the consumer
+		return
+	}
+	match, err := cache.DeviceMatchesFilters(device, view.filters)
+	if err != nil {
+		logging.Error("Failed to match device against filters", map[string]string{"device": string(update.ID), "error": err.Error()})
+		return
+	}
+
+	switch {
+	case match && view.matching[update.ID]:
+		return EventUpdate, device, true
+	case match:
+		view.matching[update.ID] = true
+		return EventAdded, device, true
+	case view.matching[update.ID]:
+		delete(view.matching, update.ID)
+		return EventRemoved, device, true
+	default:
+		return
+	}
+}
@@ -0,0 +1,60 @@
+package webhooks
+
+import (
+	"errors"
+	"time"
+)
+
+const (
+	defaultMaxAttempts    = 5
+	defaultInitialBackoff = time.Second
+	defaultTimeout        = 10 * time.Second
+	maxBackoff            = time.Minute
+)
+
+// Config for webhook delivery. Every field is optional.
+type Config struct {
+	// StoreFile persists the webhooks managed through the admin API. Without it webhooks are lost on restart
+	StoreFile string `json:"store-file"`
+	// DeadLetterFile receives a JSON line for every delivery that ran out of attempts
+	DeadLetterFile        string `json:"dead-letter-file"`
+	MaxAttempts           int    `json:"max-attempts"`
+	InitialBackoffSeconds int    `json:"initial-backoff-seconds"`
+	TimeoutSeconds        int    `json:"timeout-seconds"`
+}
+
+func (conf *Config) PopulateExample() {
+	conf.StoreFile = "/var/lib/sdup-rest/webhooks.json"
+	conf.DeadLetterFile = "/var/log/sdup-rest/webhooks-dead-letter.jsonl"
+	conf.MaxAttempts = defaultMaxAttempts
+	conf.InitialBackoffSeconds = int(defaultInitialBackoff / time.Second)
+	conf.TimeoutSeconds = int(defaultTimeout / time.Second)
+}
+
+func (conf Config) Validate() error {
+	if conf.MaxAttempts < 0 || conf.InitialBackoffSeconds < 0 || conf.TimeoutSeconds < 0 {
+		return errors.New("webhook attempts, backoff and timeout may not be negative")
+	}
+	return nil
+}
+
+func (conf Config) maxAttempts() int {
+	if conf.MaxAttempts == 0 {
+		return defaultMaxAttempts
+	}
+	return conf.MaxAttempts
+}
+
+func (conf Config) initialBackoff() time.Duration {
+	if conf.InitialBackoffSeconds == 0 {
+		return defaultInitialBackoff
+	}
+	return time.Duration(conf.InitialBackoffSeconds) * time.Second
+}
+
+func (conf Config) timeout() time.Duration {
+	if conf.TimeoutSeconds == 0 {
+		return defaultTimeout
+	}
+	return time.Duration(conf.TimeoutSeconds) * time.Second
+}
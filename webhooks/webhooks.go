@@ -0,0 +1,428 @@
+package webhooks
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Kaese72/sdup-lib/logging"
+	"github.com/Kaese72/sdup-lib/sduptemplates"
+	"github.com/Kaese72/sdup-rest/cache"
+	"github.com/Kaese72/sdup-rest/cache/filters"
+	"github.com/Kaese72/sdup-rest/stream"
+)
+
+// SignatureHeader carries the hex encoded HMAC-SHA256 of the request body, keyed with the webhook secret
+const SignatureHeader = "X-SDUP-Signature"
+
+// queueSize is how many deliveries may be waiting for a single webhook before new ones are dead-lettered
+const queueSize = 100
+
+// minSecretLength keeps chosen secrets from being guessable
+const minSecretLength = 16
+
+var ErrNoSuchWebhook = errors.New("no such webhook")
+
+// ErrInvalidWebhook is returned for webhooks that can not be created or updated as given
+type ErrInvalidWebhook struct {
+	Err error
+}
+
+func (err ErrInvalidWebhook) Error() string { return err.Err.Error() }
+func (err ErrInvalidWebhook) Unwrap() error { return err.Err }
+
+// Webhook is an external endpoint that is notified of device updates matching its filters.
+// Every delivery is signed with the secret, which is generated unless one is chosen when the webhook is created.
+type Webhook struct {
+	ID      string                   `json:"id"`
+	URL     string                   `json:"url"`
+	Filters filters.AttributeFilters `json:"filters"`
+	Secret  string                   `json:"secret,omitempty"`
+}
+
+// Redacted returns the webhook without its secret, for showing to clients
+func (webhook Webhook) Redacted() Webhook {
+	webhook.Secret = ""
+	return webhook
+}
+
+func (webhook Webhook) validate() error {
+	parsed, err := url.Parse(webhook.URL)
+	if err != nil {
+		return ErrInvalidWebhook{Err: err}
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return ErrInvalidWebhook{Err: errors.New("webhook url must be http or https")}
+	}
+	for _, filter := range webhook.Filters {
+		if _, err := filter.GetOperator(); err != nil {
+			return ErrInvalidWebhook{Err: err}
+		}
+	}
+	// An empty secret is replaced, see Create and Update
+	if webhook.Secret != "" && len(webhook.Secret) < minSecretLength {
+		return ErrInvalidWebhook{Err: fmt.Errorf("webhook secret must be at least %d characters", minSecretLength)}
+	}
+	return nil
+}
+
+// Payload is the JSON body POSTed to webhooks
+type Payload struct {
+	Webhook   string                     `json:"webhook"`
+	Delivery  string                     `json:"delivery"`
+	Timestamp int64                      `json:"timestamp"`
+	Update    sduptemplates.DeviceUpdate `json:"update"`
+	Device    sduptemplates.DeviceSpec   `json:"device"`
+}
+
+// deadLetter is what is recorded for deliveries that could not be made
+type deadLetter struct {
+	Time     time.Time `json:"time"`
+	URL      string    `json:"url"`
+	Attempts int       `json:"attempts"`
+	Error    string    `json:"error"`
+	Payload  Payload   `json:"payload"`
+}
+
+type delivery struct {
+	payload Payload
+	body    []byte
+}
+
+// Manager keeps track of webhooks and delivers updates to them
+type Manager struct {
+	config Config
+	cache  cache.SDUPCache
+	client *http.Client
+	// initialBackoff is the first wait between attempts, doubling up to maxBackoff
+	initialBackoff time.Duration
+
+	lock     sync.Mutex
+	webhooks map[string]Webhook
+	queues   map[string]chan delivery
+
+	deadLetterLock sync.Mutex
+}
+
+// NewManager loads any previously stored webhooks. Call Run to start delivering updates
+func NewManager(config Config, sdupCache cache.SDUPCache) (*Manager, error) {
+	manager := &Manager{
+		config:         config,
+		cache:          sdupCache,
+		client:         &http.Client{Timeout: config.timeout()},
+		initialBackoff: config.initialBackoff(),
+		webhooks:       map[string]Webhook{},
+		queues:         map[string]chan delivery{},
+	}
+	if config.StoreFile == "" {
+		return manager, nil
+	}
+	content, err := ioutil.ReadFile(config.StoreFile)
+	if os.IsNotExist(err) {
+		return manager, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var stored []Webhook
+	if err := json.Unmarshal(content, &stored); err != nil {
+		return nil, fmt.Errorf("could not parse webhook store: %s", err.Error())
+	}
+	generated := false
+	for _, webhook := range stored {
+		// Webhooks stored before secrets were required are signed from now on
+		if webhook.Secret == "" {
+			if webhook.Secret, err = newSecret(); err != nil {
+				return nil, err
+			}
+			generated = true
+			logging.Info("Generated a secret for a webhook without one, set a new one to verify its deliveries", map[string]string{"webhook": webhook.ID})
+		}
+		manager.webhooks[webhook.ID] = webhook
+		manager.startWorker(webhook.ID)
+	}
+	if generated {
+		if err := manager.save(); err != nil {
+			return nil, err
+		}
+	}
+	return manager, nil
+}
+
+func newID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+func newSecret() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// save must be called with the lock held
+func (manager *Manager) save() error {
+	if manager.config.StoreFile == "" {
+		return nil
+	}
+	content, err := json.MarshalIndent(manager.list(), "", "   ")
+	if err != nil {
+		return err
+	}
+	tmpFile := manager.config.StoreFile + ".tmp"
+	if err := ioutil.WriteFile(tmpFile, content, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, manager.config.StoreFile)
+}
+
+// list must be called with the lock held
+func (manager *Manager) list() []Webhook {
+	webhooks := []Webhook{}
+	for _, webhook := range manager.webhooks {
+		webhooks = append(webhooks, webhook)
+	}
+	sort.Slice(webhooks, func(i, j int) bool { return webhooks[i].ID < webhooks[j].ID })
+	return webhooks
+}
+
+func (manager *Manager) List() []Webhook {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+	return manager.list()
+}
+
+func (manager *Manager) Get(id string) (Webhook, error) {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+	webhook, ok := manager.webhooks[id]
+	if !ok {
+		return Webhook{}, ErrNoSuchWebhook
+	}
+	return webhook, nil
+}
+
+// Create adds a webhook. Any ID in the given webhook is replaced by a generated one,
+// and a secret is generated unless one is given. The returned webhook has the secret
+func (manager *Manager) Create(webhook Webhook) (Webhook, error) {
+	if err := webhook.validate(); err != nil {
+		return Webhook{}, err
+	}
+	id, err := newID()
+	if err != nil {
+		return Webhook{}, err
+	}
+	webhook.ID = id
+	if webhook.Secret == "" {
+		if webhook.Secret, err = newSecret(); err != nil {
+			return Webhook{}, err
+		}
+	}
+
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+	manager.webhooks[webhook.ID] = webhook
+	if err := manager.save(); err != nil {
+		delete(manager.webhooks, webhook.ID)
+		return Webhook{}, err
+	}
+	manager.startWorker(webhook.ID)
+	return webhook, nil
+}
+
+// Update replaces the webhook with the given ID. An empty secret keeps the current one
+func (manager *Manager) Update(id string, webhook Webhook) (Webhook, error) {
+	if err := webhook.validate(); err != nil {
+		return Webhook{}, err
+	}
+	webhook.ID = id
+
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+	previous, ok := manager.webhooks[id]
+	if !ok {
+		return Webhook{}, ErrNoSuchWebhook
+	}
+	if webhook.Secret == "" {
+		webhook.Secret = previous.Secret
+	}
+	manager.webhooks[id] = webhook
+	if err := manager.save(); err != nil {
+		manager.webhooks[id] = previous
+		return Webhook{}, err
+	}
+	return webhook, nil
+}
+
+func (manager *Manager) Delete(id string) error {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+	previous, ok := manager.webhooks[id]
+	if !ok {
+		return ErrNoSuchWebhook
+	}
+	delete(manager.webhooks, id)
+	if err := manager.save(); err != nil {
+		manager.webhooks[id] = previous
+		return err
+	}
+	close(manager.queues[id])
+	delete(manager.queues, id)
+	return nil
+}
+
+// startWorker must be called with the lock held
+func (manager *Manager) startWorker(id string) {
+	queue := make(chan delivery, queueSize)
+	manager.queues[id] = queue
+	go func() {
+		for delivery := range queue {
+			manager.deliver(id, delivery)
+		}
+	}()
+}
+
+// Run dispatches updates to matching webhooks until the update stream ends
+func (manager *Manager) Run(broker *stream.Broker) {
+	subscription := broker.Subscribe()
+	defer broker.Unsubscribe(subscription)
+
+	for update := range subscription.Updates() {
+		device, err := manager.cache.Device(update.ID)
+		if err != nil {
+			continue
+		}
+		manager.dispatch(update, device)
+	}
+	logging.Error("Webhook dispatch stopped, update stream ended")
+}
+
+func (manager *Manager) dispatch(update sduptemplates.DeviceUpdate, device sduptemplates.DeviceSpec) {
+	// Dead letters are written once the lock is released, so that the file does not hold back webhook management
+	var dropped []deadLetter
+	manager.lock.Lock()
+	for id, webhook := range manager.webhooks {
+		match, err := cache.DeviceMatchesFilters(device, webhook.Filters)
+		if err != nil || !match {
+			continue
+		}
+		deliveryID, err := newID()
+		if err != nil {
+			logging.Error("Failed to generate webhook delivery id", map[string]string{"error": err.Error()})
+			continue
+		}
+		payload := Payload{
+			Webhook:   id,
+			Delivery:  deliveryID,
+			Timestamp: time.Now().Unix(),
+			Update:    update,
+			Device:    device,
+		}
+		body, err := json.Marshal(payload)
+		if err != nil {
+			logging.Error("Failed to encode webhook payload", map[string]string{"error": err.Error()})
+			continue
+		}
+		select {
+		case manager.queues[id] <- delivery{payload: payload, body: body}:
+		default:
+			// Never let a single unresponsive endpoint hold back the others
+			dropped = append(dropped, deadLetter{URL: webhook.URL, Payload: payload})
+		}
+	}
+	manager.lock.Unlock()
+	for _, letter := range dropped {
+		manager.recordDeadLetter(letter.URL, 0, errors.New("delivery queue full"), letter.Payload)
+	}
+}
+
+// Sign computes the value of the signature header for a body
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (manager *Manager) post(webhook Webhook, body []byte) error {
+	request, err := http.NewRequest(http.MethodPost, webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(SignatureHeader, Sign(webhook.Secret, body))
+	response, err := manager.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	ioutil.ReadAll(response.Body)
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("webhook responded with %d", response.StatusCode)
+	}
+	return nil
+}
+
+// deliver attempts delivery with exponential backoff, dead-lettering it when attempts run out
+func (manager *Manager) deliver(id string, delivery delivery) {
+	backoff := manager.initialBackoff
+	var webhook Webhook
+	var err error
+	attempt := 0
+	for attempt < manager.config.maxAttempts() {
+		// Fetch the webhook every attempt, it may have been changed or removed meanwhile
+		webhook, err = manager.Get(id)
+		if err != nil {
+			return
+		}
+		attempt++
+		if err = manager.post(webhook, delivery.body); err == nil {
+			return
+		}
+		logging.Error("Webhook delivery failed", map[string]string{"webhook": id, "attempt": fmt.Sprint(attempt), "error": err.Error()})
+		if attempt < manager.config.maxAttempts() {
+			time.Sleep(backoff)
+			backoff *= 2
+			if backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+		}
+	}
+	manager.recordDeadLetter(webhook.URL, attempt, err, delivery.payload)
+}
+
+func (manager *Manager) recordDeadLetter(url string, attempts int, err error, payload Payload) {
+	logging.Error("Webhook delivery abandoned", map[string]string{"webhook": payload.Webhook, "delivery": payload.Delivery, "error": err.Error()})
+	if manager.config.DeadLetterFile == "" {
+		return
+	}
+	line, jsonErr := json.Marshal(deadLetter{Time: time.Now(), URL: url, Attempts: attempts, Error: err.Error(), Payload: payload})
+	if jsonErr != nil {
+		return
+	}
+
+	manager.deadLetterLock.Lock()
+	defer manager.deadLetterLock.Unlock()
+	file, fileErr := os.OpenFile(manager.config.DeadLetterFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if fileErr != nil {
+		logging.Error("Failed to open webhook dead letter file", map[string]string{"error": fileErr.Error()})
+		return
+	}
+	defer file.Close()
+	file.Write(append(line, '\n'))
+}
@@ -0,0 +1,144 @@
+package webhooks
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Kaese72/sdup-rest/internal/sduptest"
+)
+
+const testSecret = "0123456789abcdef0123456789abcdef"
+
+func newTestManager(t *testing.T, config Config) *Manager {
+	dir, err := ioutil.TempDir("", "sdup-rest-webhooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	config.DeadLetterFile = filepath.Join(dir, "dead-letters.jsonl")
+	manager, err := NewManager(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manager.initialBackoff = 10 * time.Millisecond
+	return manager
+}
+
+// deadLetters reads what has been dead-lettered so far
+func deadLetters(t *testing.T, manager *Manager) []deadLetter {
+	content, err := ioutil.ReadFile(manager.config.DeadLetterFile)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	letters := []deadLetter{}
+	for _, line := range strings.Split(strings.TrimSpace(string(content)), "\n") {
+		var letter deadLetter
+		if err := json.Unmarshal([]byte(line), &letter); err != nil {
+			t.Fatal(err)
+		}
+		letters = append(letters, letter)
+	}
+	return letters
+}
+
+func dispatchLamp(manager *Manager) {
+	manager.dispatch(sduptest.BoolUpdate("lamp", "active", true), sduptest.Device("lamp", "active", true))
+}
+
+func TestDeliveriesAreSigned(t *testing.T) {
+	type received struct {
+		signature string
+		body      []byte
+	}
+	deliveries := make(chan received, 1)
+	receiver := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, reader *http.Request) {
+		body, _ := ioutil.ReadAll(reader.Body)
+		deliveries <- received{signature: reader.Header.Get(SignatureHeader), body: body}
+	}))
+	defer receiver.Close()
+	manager := newTestManager(t, Config{})
+	webhook, err := manager.Create(Webhook{URL: receiver.URL, Secret: testSecret})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dispatchLamp(manager)
+	var delivery received
+	select {
+	case delivery = <-deliveries:
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook was not delivered")
+	}
+	mac := hmac.New(sha256.New, []byte(testSecret))
+	mac.Write(delivery.body)
+	if expected := "sha256=" + hex.EncodeToString(mac.Sum(nil)); delivery.signature != expected {
+		t.Errorf("expected signature %s, got %s", expected, delivery.signature)
+	}
+	var payload Payload
+	if err := json.Unmarshal(delivery.body, &payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.Webhook != webhook.ID || payload.Update.ID != "lamp" {
+		t.Errorf("unexpected payload %+v", payload)
+	}
+}
+
+func TestDeliveryRetriesThenDeadLetters(t *testing.T) {
+	var lock sync.Mutex
+	var attempts []time.Time
+	receiver := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, reader *http.Request) {
+		lock.Lock()
+		attempts = append(attempts, time.Now())
+		lock.Unlock()
+		writer.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer receiver.Close()
+	manager := newTestManager(t, Config{MaxAttempts: 3})
+	if _, err := manager.Create(Webhook{URL: receiver.URL, Secret: testSecret}); err != nil {
+		t.Fatal(err)
+	}
+
+	dispatchLamp(manager)
+	if !sduptest.WaitFor(5*time.Second, func() bool { return len(deadLetters(t, manager)) > 0 }) {
+		t.Fatal("delivery was not dead-lettered")
+	}
+	letters := deadLetters(t, manager)
+	if len(letters) != 1 || letters[0].Attempts != 3 || letters[0].URL != receiver.URL || letters[0].Payload.Update.ID != "lamp" {
+		t.Errorf("unexpected dead letters %+v", letters)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if len(attempts) != 3 {
+		t.Fatalf("expected 3 attempts, got %d", len(attempts))
+	}
+	// Backoff doubles between attempts
+	if first, second := attempts[1].Sub(attempts[0]), attempts[2].Sub(attempts[1]); first < 10*time.Millisecond || second < 20*time.Millisecond {
+		t.Errorf("expected backoffs of at least 10ms and 20ms, got %s and %s", first, second)
+	}
+}
+
+func TestDispatchDeadLettersWhenTheQueueIsFull(t *testing.T) {
+	manager := newTestManager(t, Config{})
+	// A queue nobody reads from is always full
+	manager.webhooks["stuck"] = Webhook{ID: "stuck", URL: "http://localhost/stuck", Secret: testSecret}
+	manager.queues["stuck"] = make(chan delivery)
+
+	dispatchLamp(manager)
+	letters := deadLetters(t, manager)
+	if len(letters) != 1 || letters[0].Attempts != 0 || letters[0].Error != "delivery queue full" || letters[0].Payload.Webhook != "stuck" {
+		t.Errorf("unexpected dead letters %+v", letters)
+	}
+}